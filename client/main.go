@@ -8,7 +8,10 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func getServerURL() string {
@@ -26,31 +29,75 @@ type UploadResponse struct {
 	BytesReceived int64 `json:"bytes_received"`
 }
 
+type DownloadSummary struct {
+	BytesWritten   int64   `json:"bytes_written"`
+	DurationMs     int64   `json:"duration_ms"`
+	ThroughputMbps float64 `json:"throughput_mbps"`
+	Samples        int     `json:"-"`
+}
+
+type ConfigResponse struct {
+	DualStack *struct {
+		IPv4URL string `json:"ipv4_url"`
+		IPv6URL string `json:"ipv6_url"`
+	} `json:"dual_stack"`
+}
+
+// testIDTransport sends the test session ID with every request, so the
+// server keeps one diagnostics trace for the whole run
+type testIDTransport struct {
+	id string
+}
+
+func (t testIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Test-ID", t.id)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestID returns a random test session ID
+func newTestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return fmt.Sprintf("%x", id)
+}
+
 func main() {
 	fmt.Println("Speed Test Client")
 	fmt.Println("=================")
 
+	testID := newTestID()
+	http.DefaultClient.Transport = testIDTransport{id: testID}
+	fmt.Printf("Test ID: %s (quote it when reporting a problem)\n", testID)
+
+	if len(os.Args) > 1 && os.Args[1] == "dualstack" {
+		testDualStack()
+		return
+	}
+
+	serverURL := getServerURL()
+
 	// Test latency
 	fmt.Println("\n1. Testing Latency...")
-	testLatency()
+	testLatency(serverURL)
 
 	// Test download speed
 	fmt.Println("\n2. Testing Download Speed...")
-	testDownload()
+	testDownload(serverURL)
 
 	// Test upload speed
 	fmt.Println("\n3. Testing Upload Speed...")
-	testUpload()
+	testUpload(serverURL)
 
 	// Get IP info
 	fmt.Println("\n4. Getting IP Information...")
 	getIPInfo()
 }
 
-func testLatency() {
+// testLatency returns the average round trip of a few pings, 0 on error
+func testLatency(serverURL string) time.Duration {
 	const numPings = 5
 	var totalLatency time.Duration
-	serverURL := getServerURL()
 
 	for i := 0; i < numPings; i++ {
 		start := time.Now()
@@ -58,7 +105,7 @@ func testLatency() {
 		resp, err := http.Get(serverURL + "/ping")
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
-			return
+			return 0
 		}
 
 		var pingResp PingResponse
@@ -73,11 +120,13 @@ func testLatency() {
 
 	avgLatency := totalLatency / numPings
 	fmt.Printf("Average latency: %v\n", avgLatency)
+	return avgLatency
 }
 
-func testDownload() {
+// testDownload returns the speed of the largest successful download in Mbps
+func testDownload(serverURL string) float64 {
 	sizes := []int{1024 * 1024, 10 * 1024 * 1024} // 1MB, 10MB
-	serverURL := getServerURL()
+	var result float64
 
 	for _, size := range sizes {
 		fmt.Printf("Testing download of %d bytes...\n", size)
@@ -88,6 +137,7 @@ func testDownload() {
 			fmt.Printf("Error: %v\n", err)
 			continue
 		}
+		serverView := watchDownloadProgress(serverURL, resp.Header.Get("X-Progress-URL"))
 
 		bytesRead, err := io.Copy(io.Discard, resp.Body)
 		if err != nil {
@@ -101,12 +151,19 @@ func testDownload() {
 		speedMbps := float64(bytesRead) * 8 / duration.Seconds() / 1000000
 
 		fmt.Printf("Downloaded %d bytes in %v (%.2f Mbps)\n", bytesRead, duration, speedMbps)
+		if summary := <-serverView; summary != nil {
+			fmt.Printf("Server wrote %d bytes in %dms (%.2f Mbps after ramp-up, %d samples)\n",
+				summary.BytesWritten, summary.DurationMs, summary.ThroughputMbps, summary.Samples)
+		}
+		result = speedMbps
 	}
+	return result
 }
 
-func testUpload() {
+// testUpload returns the speed of the largest successful upload in Mbps
+func testUpload(serverURL string) float64 {
 	sizes := []int{1024 * 1024, 5 * 1024 * 1024} // 1MB, 5MB
-	serverURL := getServerURL()
+	var result float64
 
 	for _, size := range sizes {
 		fmt.Printf("Testing upload of %d bytes...\n", size)
@@ -130,7 +187,9 @@ func testUpload() {
 		speedMbps := float64(uploadResp.BytesReceived) * 8 / duration.Seconds() / 1000000
 
 		fmt.Printf("Uploaded %d bytes in %v (%.2f Mbps)\n", uploadResp.BytesReceived, duration, speedMbps)
+		result = speedMbps
 	}
+	return result
 }
 
 func getIPInfo() {
@@ -147,3 +206,110 @@ func getIPInfo() {
 
 	fmt.Printf("Your IP: %v\n", ipInfo["ip"])
 }
+
+// testDualStack measures latency and throughput over the server's IPv4-only
+// and IPv6-only hosts and stores both sets of figures as one result. The
+// server records which family this client preferred for the dual-stack host.
+func testDualStack() {
+	serverURL := getServerURL()
+
+	resp, err := http.Get(serverURL + "/config")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	var cfg ConfigResponse
+	json.NewDecoder(resp.Body).Decode(&cfg)
+	resp.Body.Close()
+
+	if cfg.DualStack == nil {
+		fmt.Println("The server has no IPv4-only and IPv6-only hosts configured")
+		return
+	}
+
+	result := map[string]interface{}{"test_type": "dualstack"}
+	families := []struct {
+		name   string
+		url    string
+		prefix string
+	}{
+		{"IPv4", cfg.DualStack.IPv4URL, "ipv4"},
+		{"IPv6", cfg.DualStack.IPv6URL, "ipv6"},
+	}
+	for _, family := range families {
+		fmt.Printf("\n%s (%s)\n", family.name, family.url)
+		latency := testLatency(family.url)
+		if latency == 0 {
+			// Family not reachable from this network; leave its figures empty
+			continue
+		}
+		result[family.prefix+"_latency_ms"] = float64(latency) / float64(time.Millisecond)
+		if mbps := testDownload(family.url); mbps > 0 {
+			result[family.prefix+"_download_mbps"] = mbps
+		}
+		if mbps := testUpload(family.url); mbps > 0 {
+			result[family.prefix+"_upload_mbps"] = mbps
+		}
+	}
+
+	body, _ := json.Marshal(result)
+	req, _ := http.NewRequest("POST", serverURL+"/api/tests", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey := os.Getenv("API_KEY"); apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Printf("Error saving result: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var saved map[string]string
+	json.NewDecoder(resp.Body).Decode(&saved)
+	if resp.StatusCode != http.StatusCreated {
+		fmt.Printf("Error saving result: %s %s\n", resp.Status, saved["error"])
+		return
+	}
+	fmt.Printf("\nSaved dual-stack result %s\n", saved["id"])
+}
+
+// watchDownloadProgress follows the server's view of a download over its
+// progress WebSocket. The channel yields the summary, or nil if the server
+// does not publish progress.
+func watchDownloadProgress(serverURL, progressPath string) <-chan *DownloadSummary {
+	result := make(chan *DownloadSummary, 1)
+	if progressPath == "" {
+		result <- nil
+		return result
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(serverURL, "http") + progressPath
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		result <- nil
+		return result
+	}
+
+	go func() {
+		defer conn.Close()
+		samples := 0
+		for {
+			var message struct {
+				Type    string           `json:"type"`
+				Summary *DownloadSummary `json:"summary"`
+			}
+			if err := conn.ReadJSON(&message); err != nil {
+				result <- nil
+				return
+			}
+			if message.Type == "done" && message.Summary != nil {
+				message.Summary.Samples = samples
+				result <- message.Summary
+				return
+			}
+			samples++
+		}
+	}()
+	return result
+}
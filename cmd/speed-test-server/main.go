@@ -11,17 +11,65 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"os"
 
+	"github.com/Krea-University/speed-test-server/internal/config"
+	"github.com/Krea-University/speed-test-server/internal/logging"
 	"github.com/Krea-University/speed-test-server/internal/server"
 )
 
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] [config show]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// "config show" prints the effective configuration and exits
+	if args := flag.Args(); len(args) > 0 {
+		if len(args) != 2 || args[0] != "config" || args[1] != "show" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(showConfig(*configPath))
+	}
+
+	if _, err := config.Init(*configPath); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if err := logging.Setup(config.GetLogSettings()); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
 	// Create and start the server
 	srv := server.New()
 
 	// Start server with graceful shutdown handling
 	if err := srv.Start(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+		slog.Error("Server failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// showConfig prints the validated configuration with secrets redacted,
+// returning the process exit code
+func showConfig(path string) int {
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	out, err := cfg.Redacted().YAML()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to render configuration: %v\n", err)
+		return 1
 	}
+	os.Stdout.Write(out)
+	return 0
 }
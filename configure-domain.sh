@@ -73,8 +73,8 @@ MYSQL_PASSWORD=speedtest_$(date +%s | tail -c 6)
 # Database Connection URL (for application)
 DATABASE_URL=speedtest:speedtest@tcp(mysql:3306)/speedtest?charset=utf8mb4&parseTime=True&loc=Local
 
-# IPInfo.io API Token (optional, fallback token is provided)
-IPINFO_TOKEN=20e16b08cd509a
+# IPInfo.io API Token (optional; ipinfo.io is skipped without one)
+IPINFO_TOKEN=
 
 # Application Configuration
 ENVIRONMENT=production
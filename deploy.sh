@@ -284,7 +284,7 @@ LOG_LEVEL=info
 ADMIN_API_KEY=${ADMIN_API_KEY}
 
 # IP Geolocation Service
-IPINFO_TOKEN=20e16b08cd509a
+IPINFO_TOKEN=${IPINFO_TOKEN:-}
 
 # Rate Limiting
 RATE_LIMIT_ENABLED=true
@@ -2,32 +2,78 @@
 package auth
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Krea-University/speed-test-server/internal/clientip"
+	"github.com/Krea-University/speed-test-server/internal/config"
 	"github.com/Krea-University/speed-test-server/internal/database"
+	"github.com/Krea-University/speed-test-server/internal/diagnostics"
+	"github.com/Krea-University/speed-test-server/internal/logging"
+	"github.com/Krea-University/speed-test-server/internal/ratelimit"
+	"github.com/gorilla/mux"
 )
 
+// contextKey is the type used for values stored in the request context
+type contextKey int
+
+// apiKeyIDKey holds the ID of the API key verified by APIKeyAuth
+const apiKeyIDKey contextKey = iota
+
 // Service provides authentication and rate limiting
 type Service struct {
-	db *database.Service
+	db      *database.Service
+	limiter *ratelimit.Limiter
+	traces  *diagnostics.Store // nil unless rate limit decisions go into test traces
 }
 
 // New creates a new auth service
 func New(db *database.Service) *Service {
-	return &Service{db: db}
+	var store ratelimit.Store
+	if config.GetRateLimitStore() == "database" {
+		slog.Info("Rate limiter state: shared (database)")
+		store = db.RateLimitStore()
+	} else {
+		slog.Info("Rate limiter state: local memory")
+		store = ratelimit.NewMemoryStore()
+	}
+
+	return &Service{
+		db:      db,
+		limiter: ratelimit.NewLimiter(store),
+	}
+}
+
+// SetTraceStore records rate limit rejections of requests naming a test
+// session in that session's diagnostics trace
+func (s *Service) SetTraceStore(traces *diagnostics.Store) {
+	s.traces = traces
 }
 
 // RateLimitConfig defines rate limiting configuration
 type RateLimitConfig struct {
 	RequestsPerMinute int
+	Burst             int // Maximum burst size; defaults to RequestsPerMinute
 	WhitelistEnabled  bool
 }
 
+// Limit converts the configuration to a token bucket limit
+func (c RateLimitConfig) Limit() ratelimit.Limit {
+	limit := ratelimit.PerMinute(c.RequestsPerMinute)
+	if c.Burst > 0 {
+		limit.Burst = c.Burst
+	}
+	return limit
+}
+
 // DefaultRateLimits defines default rate limits for different endpoints
 var DefaultRateLimits = map[string]RateLimitConfig{
 	"/ping":     {RequestsPerMinute: 60, WhitelistEnabled: true},
@@ -58,7 +104,7 @@ func (s *Service) APIKeyAuth(next http.Handler) http.Handler {
 		}
 
 		if apiKey == "" {
-			http.Error(w, `{"error":"API key required","code":"MISSING_API_KEY"}`, http.StatusUnauthorized)
+			logging.Error(w, r, `{"error":"API key required","code":"MISSING_API_KEY"}`, http.StatusUnauthorized)
 			return
 		}
 
@@ -66,135 +112,152 @@ func (s *Service) APIKeyAuth(next http.Handler) http.Handler {
 		keyHash := fmt.Sprintf("%x", sha256.Sum256([]byte(apiKey)))
 
 		// Verify API key
-		key, err := s.db.GetAPIKey(keyHash)
+		key, err := s.db.GetAPIKey(r.Context(), keyHash)
 		if err != nil {
-			http.Error(w, `{"error":"Invalid API key","code":"INVALID_API_KEY"}`, http.StatusUnauthorized)
+			logging.Error(w, r, `{"error":"Invalid API key","code":"INVALID_API_KEY"}`, http.StatusUnauthorized)
 			return
 		}
 
-		// Update last used timestamp
-		go s.db.UpdateAPIKeyLastUsed(keyHash)
+		// Update last used timestamp, outliving the request but kept in its trace
+		go s.db.UpdateAPIKeyLastUsed(context.WithoutCancel(r.Context()), keyHash)
 
 		// Store API key info in request context for later use
 		r.Header.Set("X-API-Key-ID", key.ID)
 		r.Header.Set("X-API-Key-Name", key.Name)
+		r = r.WithContext(context.WithValue(r.Context(), apiKeyIDKey, key.ID))
 
 		next.ServeHTTP(w, r)
 	})
 }
 
-// RateLimit middleware for rate limiting
+// RateLimit middleware for rate limiting. It must run after APIKeyAuth so
+// that API requests are limited per verified key.
 func (s *Service) RateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Get client identifier (IP address)
-		clientIP := getClientIP(r)
-
-		// Check if IP is whitelisted
-		isWhitelisted, err := s.db.IsWhitelisted(clientIP)
-		if err != nil {
-			// Log error but continue (fail open)
-			fmt.Printf("Error checking whitelist: %v\n", err)
+		clientIP := clientip.FromRequest(r)
+
+		// Check if IP is whitelisted, in the config file or the database
+		isWhitelisted := config.IsRateLimitWhitelisted(clientIP)
+		if !isWhitelisted {
+			var err error
+			isWhitelisted, err = s.db.IsWhitelisted(r.Context(), clientIP)
+			if err != nil {
+				// Log error but continue (fail open)
+				slog.ErrorContext(r.Context(), "Error checking whitelist", "error", err)
+			}
 		}
 
 		// Determine rate limit config
-		endpoint := r.URL.Path
-		config := getRateLimitConfig(endpoint)
+		route, routeConfig := getRateLimitConfig(r)
 
 		// Skip rate limiting for whitelisted IPs if enabled
-		if config.WhitelistEnabled && isWhitelisted {
+		if routeConfig.WhitelistEnabled && isWhitelisted {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Use API key rate limit if available
-		limit := config.RequestsPerMinute
+		limit := routeConfig.Limit()
 		identifier := clientIP
 
-		// For API endpoints, use API key specific limits
-		if strings.HasPrefix(r.URL.Path, "/api/") {
-			apiKeyID := r.Header.Get("X-API-Key-ID")
-			if apiKeyID != "" {
-				identifier = "api:" + apiKeyID
-				// Could fetch specific API key rate limit here
-			}
+		// For API endpoints, use API key specific limits. Only a key verified
+		// by APIKeyAuth counts; the X-API-Key-ID header can be sent by anyone.
+		if apiKeyID, ok := r.Context().Value(apiKeyIDKey).(string); ok {
+			identifier = "api:" + apiKeyID
+			// Could fetch specific API key rate limit here
 		}
 
 		// Check rate limit
-		allowed, err := s.db.CheckRateLimit(identifier, endpoint, limit)
+		result, err := s.limiter.Allow(r.Context(), identifier+"|"+route, limit)
 		if err != nil {
 			// Log error but continue (fail open)
-			fmt.Printf("Error checking rate limit: %v\n", err)
+			slog.ErrorContext(r.Context(), "Error checking rate limit", "error", err)
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		if !allowed {
-			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
-			w.Header().Set("X-RateLimit-Remaining", "0")
-			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
-			http.Error(w, `{"error":"Rate limit exceeded","code":"RATE_LIMIT_EXCEEDED","retry_after":60}`, http.StatusTooManyRequests)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(result.ResetAfter).Unix(), 10))
+
+		if !result.Allowed {
+			retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			if id := diagnostics.RequestTestID(r); id != "" {
+				s.traces.Record(id, clientIP, r.UserAgent(), diagnostics.Event{
+					Type:   "rate_limited",
+					Error:  "rate limit exceeded",
+					Fields: map[string]interface{}{"limiter": "route", "route": route, "retry_after_s": retryAfter},
+				})
+			}
+			logging.Error(w, r, fmt.Sprintf(`{"error":"Rate limit exceeded","code":"RATE_LIMIT_EXCEEDED","retry_after":%d}`, retryAfter), http.StatusTooManyRequests)
 			return
 		}
 
-		// Add rate limit headers
-		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
-		// Note: We don't track remaining requests in this simple implementation
-
 		next.ServeHTTP(w, r)
 	})
 }
 
-// getRateLimitConfig returns the rate limit configuration for an endpoint
-func getRateLimitConfig(endpoint string) RateLimitConfig {
-	// Check for exact match first
-	if config, exists := DefaultRateLimits[endpoint]; exists {
-		return config
+// defaultRouteLimit applies to endpoints matching no rate limit route
+var defaultRouteLimit = RateLimitConfig{RequestsPerMinute: 30, WhitelistEnabled: true}
+
+// getRateLimitConfig returns the bucket and rate limit configuration for a request.
+// Requests sharing a route pattern (e.g. /api/) share a bucket; other endpoints
+// each get their own, keyed by their route template. Limits set in
+// rate_limit.routes override the defaults.
+func getRateLimitConfig(r *http.Request) (string, RateLimitConfig) {
+	route, routeConfig := matchRateLimitRoute(r.URL.Path)
+	if perMinute := config.GetRateLimitRoute(route); perMinute > 0 {
+		routeConfig.RequestsPerMinute = perMinute
 	}
-
-	// Check for prefix matches
-	for pattern, config := range DefaultRateLimits {
-		if strings.HasPrefix(endpoint, pattern) {
-			return config
-		}
+	if route != "*" {
+		return route, routeConfig
 	}
 
-	// Default rate limit
-	return RateLimitConfig{
-		RequestsPerMinute: 30,
-		WhitelistEnabled:  true,
+	bucket := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			bucket = template
+		}
 	}
+	return bucket, routeConfig
 }
 
-// getClientIP extracts the real client IP from request headers
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	xForwardedFor := r.Header.Get("X-Forwarded-For")
-	if xForwardedFor != "" {
-		ips := strings.Split(xForwardedFor, ",")
-		clientIP := strings.TrimSpace(ips[0])
-		if clientIP != "" {
-			return clientIP
+// matchRateLimitRoute finds the longest route pattern, built in or configured
+// in rate_limit.routes, that prefixes an endpoint, or "*" if none does
+func matchRateLimitRoute(endpoint string) (string, RateLimitConfig) {
+	for _, pattern := range rateLimitPatterns() {
+		if strings.HasPrefix(endpoint, pattern) {
+			if routeConfig, ok := DefaultRateLimits[pattern]; ok {
+				return pattern, routeConfig
+			}
+			return pattern, defaultRouteLimit
 		}
 	}
 
-	// Check X-Real-IP header
-	xRealIP := r.Header.Get("X-Real-IP")
-	if xRealIP != "" {
-		return strings.TrimSpace(xRealIP)
-	}
+	return "*", defaultRouteLimit
+}
 
-	// Check X-Client-IP header
-	xClientIP := r.Header.Get("X-Client-IP")
-	if xClientIP != "" {
-		return strings.TrimSpace(xClientIP)
+// rateLimitPatterns returns the built-in and configured route patterns,
+// longest first so the most specific one matches
+func rateLimitPatterns() []string {
+	patterns := make([]string, 0, len(DefaultRateLimits))
+	for pattern := range DefaultRateLimits {
+		patterns = append(patterns, pattern)
 	}
-
-	// Fall back to RemoteAddr
-	if ip := strings.Split(r.RemoteAddr, ":")[0]; ip != "" {
-		return ip
+	for pattern := range config.Current().RateLimit.Routes {
+		if _, builtIn := DefaultRateLimits[pattern]; !builtIn && pattern != "*" {
+			patterns = append(patterns, pattern)
+		}
 	}
 
-	return "unknown"
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	return patterns
 }
 
 // GenerateAPIKey generates a new API key
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Krea-University/speed-test-server/internal/config"
+	"github.com/gorilla/mux"
+)
+
+func TestGetRateLimitConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("rate_limit:\n  routes:\n    /ipv6: 5\n    /download: 20\n"), 0600)
+	if _, err := config.Init(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path      string
+		bucket    string
+		perMinute int
+	}{
+		{"/ip", "/ip", 30},
+		{"/ipv6", "/ipv6", 5},          // The longer configured pattern wins over /ip
+		{"/download", "/download", 20}, // Configured limit overrides the built-in one
+		{"/api/tests", "/api/", 100},
+		{"/healthz", "/healthz", 30},        // Unmatched endpoints get their own bucket
+		{"/result/abc", "/result/{id}", 30}, // keyed by route template
+	}
+
+	r := mux.NewRouter()
+	var bucket string
+	var routeConfig RateLimitConfig
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		bucket, routeConfig = getRateLimitConfig(r)
+	}
+	for _, tt := range tests {
+		if tt.bucket != "/result/{id}" {
+			r.HandleFunc(tt.path, handler)
+		}
+	}
+	r.HandleFunc("/result/{id}", handler)
+
+	for _, tt := range tests {
+		bucket, routeConfig = "", RateLimitConfig{}
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+		if bucket != tt.bucket || routeConfig.RequestsPerMinute != tt.perMinute {
+			t.Errorf("%s: got bucket %q at %d/min, expected %q at %d/min", tt.path, bucket, routeConfig.RequestsPerMinute, tt.bucket, tt.perMinute)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Package clientip resolves the real client IP address of a request
+// when the server runs behind one or more trusted reverse proxies
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// contextKey is the type used for values stored in the request context
+type contextKey struct{}
+
+// Resolver determines client IPs, honouring forwarding headers only
+// when they were added by a trusted proxy
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+var (
+	defaultMu       sync.RWMutex
+	defaultResolver = mustResolver(DefaultTrustedProxies)
+)
+
+// DefaultTrustedProxies are trusted when no proxies are configured (local nginx)
+var DefaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// NewResolver creates a resolver trusting the given CIDRs or bare IP addresses
+func NewResolver(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, entry := range trustedProxies {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR %q: %v", entry, err)
+		}
+		r.trusted = append(r.trusted, network)
+	}
+	return r, nil
+}
+
+// mustResolver creates a resolver and panics on invalid input; used for built-in defaults
+func mustResolver(trustedProxies []string) *Resolver {
+	r, err := NewResolver(trustedProxies)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// SetDefault replaces the resolver used by FromRequest when no middleware ran
+func SetDefault(r *Resolver) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultResolver = r
+}
+
+// Default returns the process-wide resolver
+func Default() *Resolver {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultResolver
+}
+
+// IsTrusted reports whether ip belongs to a trusted proxy network
+func (r *Resolver) IsTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP extracts the client IP for a request.
+//
+// The immediate peer is taken from RemoteAddr. Forwarding headers are only
+// consulted when that peer is a trusted proxy, and are walked right to left
+// so that the first untrusted hop wins; entries further left could have
+// been supplied by the client itself.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	peer := hostIP(req.RemoteAddr)
+	if peer == nil {
+		if req.RemoteAddr == "" {
+			return "unknown"
+		}
+		return req.RemoteAddr
+	}
+
+	if !r.IsTrusted(peer) {
+		return peer.String()
+	}
+
+	// RFC 7239 Forwarded takes precedence over the de-facto X-Forwarded-For
+	if hops := forwardedFor(req.Header.Values("Forwarded")); len(hops) > 0 {
+		return r.walk(hops, peer).String()
+	}
+
+	if hops := xForwardedFor(req.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		return r.walk(hops, peer).String()
+	}
+
+	// X-Real-IP is set by nginx to a single address
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+
+	return peer.String()
+}
+
+// walk returns the rightmost untrusted hop, or the leftmost hop if every entry is trusted
+func (r *Resolver) walk(hops []net.IP, peer net.IP) net.IP {
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == nil {
+			// An unparseable hop cannot be vouched for, and the hops to its
+			// right are trusted proxies rather than the client; fall back to
+			// the peer
+			return peer
+		}
+		if !r.IsTrusted(hops[i]) {
+			return hops[i]
+		}
+	}
+	return hops[0]
+}
+
+// Middleware resolves the client IP once and stores it in the request context
+func (r *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := r.ClientIP(req)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), contextKey{}, ip)))
+	})
+}
+
+// FromRequest returns the client IP stored by Middleware, resolving it with
+// the default resolver if the middleware did not run
+func FromRequest(req *http.Request) string {
+	if ip, ok := req.Context().Value(contextKey{}).(string); ok && ip != "" {
+		return ip
+	}
+	return Default().ClientIP(req)
+}
+
+// Version returns 4 or 6 for the address family of ip, or 0 if it is not an
+// IP address. IPv4-mapped IPv6 addresses count as IPv4.
+func Version(ip string) int {
+	parsed := hostIP(ip)
+	switch {
+	case parsed == nil:
+		return 0
+	case parsed.To4() != nil:
+		return 4
+	default:
+		return 6
+	}
+}
+
+// Hostname returns the host a request was sent to, lower-cased and without
+// port or IPv6 brackets, for comparing against configured hostnames
+func Hostname(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// hostIP parses the IP part of a host:port or bare address, handling IPv6
+func hostIP(addr string) net.IP {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	// Strip an IPv6 zone identifier
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	ip := net.ParseIP(addr)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// xForwardedFor flattens X-Forwarded-For header values into a list of hops
+func xForwardedFor(values []string) []net.IP {
+	var hops []net.IP
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			hops = append(hops, hostIP(part))
+		}
+	}
+	return hops
+}
+
+// forwardedFor extracts the for= parameters of RFC 7239 Forwarded header values
+func forwardedFor(values []string) []net.IP {
+	var hops []net.IP
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				val = strings.Trim(strings.TrimSpace(val), `"`)
+				// Obfuscated identifiers ("unknown", "_hidden") are not addresses
+				hops = append(hops, hostIP(val))
+			}
+		}
+	}
+	return hops
+}
@@ -0,0 +1,112 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	resolver, err := NewResolver([]string{"10.0.0.0/8", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct peer", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted peer spoofing XFF", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "203.0.113.7"},
+		{"trusted proxy", "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"client-supplied prefix ignored", "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.1, 10.1.2.3"}, "198.51.100.1"},
+		{"all hops trusted", "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.5, 10.0.0.6"}, "10.0.0.5"},
+		{"IPv6 remote addr", "[2001:db8::1]:443", nil, "2001:db8::1"},
+		{"forwarded header", "127.0.0.1:1234", map[string]string{"Forwarded": `for=1.1.1.1, for="[2001:db8::2]:4711";proto=https`}, "2001:db8::2"},
+		{"forwarded preferred over XFF", "127.0.0.1:1234", map[string]string{"Forwarded": "for=198.51.100.9", "X-Forwarded-For": "198.51.100.1"}, "198.51.100.9"},
+		{"obfuscated hop", "127.0.0.1:1234", map[string]string{"Forwarded": "for=unknown"}, "127.0.0.1"},
+		{"unparseable middle hop", "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, garbage, 10.0.0.5"}, "127.0.0.1"},
+		{"real ip from trusted proxy", "127.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.3"}, "198.51.100.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := resolver.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostname(t *testing.T) {
+	for host, want := range map[string]string{
+		"speed.example.edu":       "speed.example.edu",
+		"V4.Speed.Example.edu:80": "v4.speed.example.edu",
+		"[2001:DB8::1]:8443":      "2001:db8::1",
+		"[2001:db8::1]":           "2001:db8::1",
+	} {
+		req := &http.Request{Host: host}
+		if got := Hostname(req); got != want {
+			t.Errorf("Hostname(%q) = %q, expected %q", host, got, want)
+		}
+	}
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 198.51.100.1 10.0.0.1 56324 443\r\nGET / HTTP/1.1\r\n"))
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "198.51.100.1:56324" {
+		t.Errorf("got %s", addr)
+	}
+	rest, _ := r.ReadString('\n')
+	if rest != "GET / HTTP/1.1\r\n" {
+		t.Errorf("payload not preserved, got %q", rest)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.Write([]byte{0x21, 0x21}) // v2 PROXY, TCP over IPv6
+	binary.Write(&buf, binary.BigEndian, uint16(36))
+	buf.Write(net.ParseIP("2001:db8::5").To16())
+	buf.Write(net.ParseIP("2001:db8::1").To16())
+	binary.Write(&buf, binary.BigEndian, uint16(40000))
+	binary.Write(&buf, binary.BigEndian, uint16(443))
+	buf.WriteString("payload")
+
+	r := bufio.NewReader(&buf)
+	addr, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "[2001:db8::5]:40000" {
+		t.Errorf("got %s", addr)
+	}
+	rest := make([]byte, 7)
+	r.Read(rest)
+	if string(rest) != "payload" {
+		t.Errorf("payload not preserved, got %q", rest)
+	}
+}
+
+func TestReadProxyHeaderMissing(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if _, err := readProxyHeader(r); err == nil {
+		t.Error("expected error for connection without PROXY header")
+	}
+}
@@ -0,0 +1,206 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature is the fixed 12-byte prefix of a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeaderTimeout bounds how long a connection may take to send its PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// maxProxyV1Length is the longest valid PROXY protocol v1 line, including CRLF
+const maxProxyV1Length = 107
+
+// ProxyListener wraps a net.Listener and decodes PROXY protocol v1/v2 headers
+// sent by trusted load balancers, replacing the connection's RemoteAddr with
+// the original client address. Connections from untrusted peers are passed
+// through untouched so they cannot spoof their address.
+type ProxyListener struct {
+	net.Listener
+	resolver *Resolver
+}
+
+// NewProxyListener creates a PROXY protocol aware listener
+func NewProxyListener(inner net.Listener, resolver *Resolver) *ProxyListener {
+	return &ProxyListener{Listener: inner, resolver: resolver}
+}
+
+// Accept waits for the next connection; the header is parsed lazily so a
+// slow peer cannot stall the accept loop
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	peer := hostIP(conn.RemoteAddr().String())
+	if !l.resolver.IsTrusted(peer) {
+		return conn, nil
+	}
+
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection whose first bytes carry a PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// Read reads application data following the PROXY header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address announced in the PROXY header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader consumes and decodes the PROXY header
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	addr, err := readProxyHeader(c.reader)
+	if err != nil {
+		c.err = fmt.Errorf("proxy protocol: %v", err)
+		c.Conn.Close()
+		return
+	}
+	c.remoteAddr = addr
+}
+
+// readProxyHeader decodes a v1 or v2 header; a nil address means the
+// sender did not supply one (LOCAL command or UNKNOWN protocol)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, errors.New("missing PROXY header")
+}
+
+// readProxyV1 decodes a text header such as "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxProxyV1Length {
+			return nil, errors.New("v1 header too long")
+		}
+	}
+
+	text := strings.TrimSuffix(string(line), "\r\n")
+	if len(text) == len(line) {
+		return nil, errors.New("v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", text)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 decodes a binary header
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	version := header[12] >> 4
+	command := header[12] & 0x0f
+	family := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections (health checks from the proxy itself) keep the real peer
+	if command == 0x0 {
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("short IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("short IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX carry no usable client address
+		return nil, nil
+	}
+}
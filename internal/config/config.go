@@ -2,8 +2,14 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -28,14 +34,618 @@ const (
 	// MaxConcurrentRequests is the maximum number of concurrent requests allowed
 	// Set to 0 to disable concurrent request limiting
 	MaxConcurrentRequests = 0
+
+	// QueueWaitTimeout is how long (seconds) a waiting room ticket survives without polling
+	QueueWaitTimeout = 30
+
+	// QueueAdmitTimeout is how long (seconds) an admitted ticket stays valid while unused
+	QueueAdmitTimeout = 30
+
+	// QueueTicketLifetime is how long (seconds) an admitted ticket stays valid, even while in use
+	QueueTicketLifetime = 300
+
+	// QueueMaxTicketsPerIP is the maximum number of live waiting room tickets per client
+	QueueMaxTicketsPerIP = 2
+
+	// QueueMaxRequestsPerTicket is how many concurrent requests one admitted ticket may run
+	QueueMaxRequestsPerTicket = 1
+
+	// IPCacheSize is the number of geolocation results kept in memory (0 disables caching)
+	IPCacheSize = 10000
+
+	// IPCacheTTL is how long (seconds) a geolocation result is cached
+	IPCacheTTL = 6 * 60 * 60
+
+	// IPCacheNegativeTTL is how long (seconds) a failed lookup is cached
+	IPCacheNegativeTTL = 60
+
+	// IPProviders is the default geolocation provider chain, in order of preference
+	IPProviders = "mmdb,ipinfo,ip-api,freeipapi"
+
+	// ProviderFailureThreshold is the number of consecutive failures that opens a provider's circuit
+	ProviderFailureThreshold = 3
+
+	// ProviderCooldown is how long (seconds) an open circuit skips its provider before a retry
+	ProviderCooldown = 30
+
+	// EnrichmentWorkers is the number of background workers enriching stored tests (0 disables)
+	EnrichmentWorkers = 2
+
+	// EnrichmentQueueSize is the maximum number of tests waiting for enrichment
+	EnrichmentQueueSize = 1000
+
+	// EnrichmentDNSTimeout is how long (seconds) a reverse DNS lookup may take
+	EnrichmentDNSTimeout = 2
+
+	// TraceMaxTests is the number of test session traces kept for diagnostics (0 disables)
+	TraceMaxTests = 10000
+
+	// TraceRetention is how long (seconds) a test session trace is kept after its last event
+	TraceRetention = 86400
+
+	// DefaultServerName is the server name shown in results
+	DefaultServerName = "Krea Speed Test Server"
+
+	// DefaultServerSponsor is the organization operating the server
+	DefaultServerSponsor = "Krea University"
+
+	// DefaultServerCountry is the ISO country code of the server
+	DefaultServerCountry = "IN"
+
+	// DefaultServerCity is the city the server is located in
+	DefaultServerCity = "Sri City"
+
+	// DefaultServerBaseURL is the public base URL used for result links
+	DefaultServerBaseURL = "https://speed.krea.edu.in"
+
+	// DefaultPublicHost is the host clients are told to reach the server on
+	DefaultPublicHost = "speed.krea.edu.in"
+
+	// DefaultPublicPort is the port clients are told to reach the server on
+	DefaultPublicPort = 8080
+
+	// BandwidthCapacityMbps is the uplink capacity used for test admission control
+	// Set to 0 to disable bandwidth-aware admission
+	BandwidthCapacityMbps = 0
+
+	// MinPerTestMbps is the bandwidth reserved per admitted test, capping concurrency
+	MinPerTestMbps = 100
+
+	// AdmissionQueueSize is the maximum number of tests waiting for bandwidth
+	AdmissionQueueSize = 32
+
+	// AdmissionQueueWait is how long (seconds) a test may wait for bandwidth
+	AdmissionQueueWait = 15
+
+	// ReadTimeout, WriteTimeout and IdleTimeout (seconds) apply to API routes
+	ReadTimeout  = 30
+	WriteTimeout = 30
+	IdleTimeout  = 120
+
+	// TestMinRateMbps is the slowest link a speed test transfer is given time to finish on
+	TestMinRateMbps = 1
+
+	// TestMaxDuration is the longest deadline (seconds) a speed test transfer gets
+	TestMaxDuration = 600
 )
 
-// GetMaxConcurrentRequests returns the maximum concurrent requests from environment or default
+// GetMaxConcurrentRequests returns the maximum concurrent requests (limits.max_concurrent_requests)
 func GetMaxConcurrentRequests() int {
-	if maxReqsStr := os.Getenv("MAX_CONCURRENT_REQUESTS"); maxReqsStr != "" {
-		if maxReqs, err := strconv.Atoi(maxReqsStr); err == nil && maxReqs > 0 {
-			return maxReqs
-		}
+	if maxReqs := Current().Limits.MaxConcurrentRequests; maxReqs > 0 {
+		return maxReqs
 	}
 	return MaxConcurrentRequests
 }
+
+// GetTrustedProxies returns the proxy CIDRs whose forwarding headers are trusted.
+// TRUSTED_PROXIES is a comma-separated list of CIDRs or IP addresses; nil means
+// the resolver defaults apply (loopback only, for nginx on the same host).
+func GetTrustedProxies() []string {
+	return Current().Server.TrustedProxies
+}
+
+// GetProxyProtocolEnabled reports whether the listener expects PROXY protocol headers
+func GetProxyProtocolEnabled() bool {
+	return Current().Server.ProxyProtocol
+}
+
+// GetRateLimitStore returns where rate limiter state is kept: "memory" (default,
+// per instance) or "database" (shared across instances via MySQL)
+func GetRateLimitStore() string {
+	if store := Current().RateLimit.Store; store == "database" {
+		return store
+	}
+	return "memory"
+}
+
+// IsRateLimitWhitelisted reports whether ip is exempt from rate limiting by
+// rate_limit.whitelist
+func IsRateLimitWhitelisted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range Current().RateLimit.whitelist {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRateLimitRoute returns the configured requests per minute for a route,
+// or 0 when the built-in limit applies
+func GetRateLimitRoute(route string) int {
+	return Current().RateLimit.Routes[route]
+}
+
+// GetBandwidthCapacityMbps returns the uplink capacity (limits.bandwidth_capacity_mbps)
+func GetBandwidthCapacityMbps() float64 {
+	return nonNegative(Current().Limits.BandwidthCapacityMbps, BandwidthCapacityMbps)
+}
+
+// GetMinPerTestMbps returns the per-test bandwidth reservation (limits.min_per_test_mbps)
+func GetMinPerTestMbps() float64 {
+	return nonNegative(Current().Limits.MinPerTestMbps, MinPerTestMbps)
+}
+
+// GetAdmissionQueueSize returns the admission queue size (limits.admission_queue_size)
+func GetAdmissionQueueSize() int {
+	if size := Current().Limits.AdmissionQueueSize; size >= 0 {
+		return size
+	}
+	return AdmissionQueueSize
+}
+
+// GetAdmissionQueueWait returns how long a test may wait for bandwidth; 0 rejects immediately
+func GetAdmissionQueueWait() time.Duration {
+	return nonNegativeDuration(Current().Limits.AdmissionQueueWait, AdmissionQueueWait)
+}
+
+// GetServerTimeouts returns the read, write and idle timeouts of the HTTP
+// server, which API routes keep; speed test routes extend them per request
+func GetServerTimeouts() (time.Duration, time.Duration, time.Duration) {
+	t := Current().Timeouts
+	return positiveDuration(t.Read, ReadTimeout), positiveDuration(t.Write, WriteTimeout), positiveDuration(t.Idle, IdleTimeout)
+}
+
+// GetTestMinRateMbps returns the slowest link rate test deadlines allow for
+func GetTestMinRateMbps() float64 {
+	if rate := Current().Timeouts.TestMinRateMbps; rate > 0 {
+		return rate
+	}
+	return TestMinRateMbps
+}
+
+// GetTestMaxDuration returns the upper bound of a test transfer's deadline
+func GetTestMaxDuration() time.Duration {
+	return positiveDuration(Current().Timeouts.TestMaxDuration, TestMaxDuration)
+}
+
+// positiveDuration returns value, or def seconds if value is not positive
+func positiveDuration(value Duration, def float64) time.Duration {
+	if value > 0 {
+		return value.Std()
+	}
+	return time.Duration(def * float64(time.Second))
+}
+
+// getEnvFloat parses a non-negative float environment variable, falling back to def
+func getEnvFloat(key string, def float64) float64 {
+	if valueStr := os.Getenv(key); valueStr != "" {
+		if value, err := strconv.ParseFloat(valueStr, 64); err == nil && value >= 0 {
+			return value
+		}
+	}
+	return def
+}
+
+// nonNegative returns value, or def if value is negative
+func nonNegative(value, def float64) float64 {
+	if value >= 0 {
+		return value
+	}
+	return def
+}
+
+// nonNegativeDuration returns value, or def seconds if value is negative
+func nonNegativeDuration(value Duration, def float64) time.Duration {
+	if value >= 0 {
+		return value.Std()
+	}
+	return time.Duration(def * float64(time.Second))
+}
+
+// GetQueueWaitTimeout returns the waiting ticket expiry (queue.wait_timeout)
+func GetQueueWaitTimeout() time.Duration {
+	return nonNegativeDuration(Current().Queue.WaitTimeout, QueueWaitTimeout)
+}
+
+// GetQueueAdmitTimeout returns the unused admitted ticket expiry (queue.admit_timeout)
+func GetQueueAdmitTimeout() time.Duration {
+	return nonNegativeDuration(Current().Queue.AdmitTimeout, QueueAdmitTimeout)
+}
+
+// GetQueueTicketLifetime returns how long an admitted ticket lasts (queue.ticket_lifetime)
+func GetQueueTicketLifetime() time.Duration {
+	return positiveDuration(Current().Queue.TicketLifetime, QueueTicketLifetime)
+}
+
+// GetQueueMaxRequestsPerTicket returns the concurrent requests allowed per
+// admitted ticket (queue.max_requests_per_ticket)
+func GetQueueMaxRequestsPerTicket() int {
+	if max := Current().Queue.MaxRequests; max > 0 {
+		return max
+	}
+	return QueueMaxRequestsPerTicket
+}
+
+// GetQueueMaxTicketsPerIP returns the per-client ticket limit (queue.max_tickets_per_ip)
+func GetQueueMaxTicketsPerIP() int {
+	if max := Current().Queue.MaxTicketsPerIP; max > 0 {
+		return max
+	}
+	return QueueMaxTicketsPerIP
+}
+
+// GetIPCacheSize returns the geolocation cache size (geoip.cache_size)
+func GetIPCacheSize() int {
+	if size := Current().GeoIP.CacheSize; size >= 0 {
+		return size
+	}
+	return IPCacheSize
+}
+
+// GetIPCacheTTL returns the geolocation cache TTL (geoip.cache_ttl)
+func GetIPCacheTTL() time.Duration {
+	return nonNegativeDuration(Current().GeoIP.CacheTTL, IPCacheTTL)
+}
+
+// GetIPCacheNegativeTTL returns the failed lookup cache TTL (geoip.cache_negative_ttl)
+func GetIPCacheNegativeTTL() time.Duration {
+	return nonNegativeDuration(Current().GeoIP.CacheNegativeTTL, IPCacheNegativeTTL)
+}
+
+// GetIPCachePersist reports whether geolocation results are also stored in the database
+func GetIPCachePersist() bool {
+	return Current().GeoIP.CachePersist
+}
+
+// GetIPProviders returns the geolocation provider chain (geoip.providers)
+func GetIPProviders() []string {
+	if providers := Current().GeoIP.Providers; len(providers) > 0 {
+		return providers
+	}
+	return strings.Split(IPProviders, ",")
+}
+
+// GetIPProviderMode returns how provider results are combined: "first" uses the
+// first provider that succeeds, "merge" fills missing fields from later providers
+func GetIPProviderMode() string {
+	if mode := Current().GeoIP.Mode; mode == "merge" {
+		return mode
+	}
+	return "first"
+}
+
+// GetIPProviderTimeout returns the request timeout for a provider, from
+// <NAME>_TIMEOUT_SECONDS, geoip.timeout (IP_PROVIDER_TIMEOUT_SECONDS) or the default
+func GetIPProviderTimeout(name string) time.Duration {
+	seconds := float64(HTTPTimeout)
+	if timeout := Current().GeoIP.Timeout; timeout > 0 {
+		seconds = timeout.Std().Seconds()
+	}
+	seconds = getEnvFloat(providerEnvKey(name)+"_TIMEOUT_SECONDS", seconds)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// GetIPProviderToken returns the API token for a provider and where it came
+// from. Sources are checked in order: the <NAME>_TOKEN environment variable,
+// the secrets file named by <NAME>_TOKEN_FILE, then the credentials file named
+// by geoip.credentials_file (IP_PROVIDER_CREDENTIALS_FILE). An empty token
+// means none is configured.
+func GetIPProviderToken(name string) (string, string, error) {
+	key := providerEnvKey(name)
+
+	if token := strings.TrimSpace(os.Getenv(key + "_TOKEN")); token != "" {
+		return token, key + "_TOKEN", nil
+	}
+
+	if path := os.Getenv(key + "_TOKEN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read %s_TOKEN_FILE: %v", key, err)
+		}
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, path, nil
+		}
+	}
+
+	if path := Current().GeoIP.CredentialsFile; path != "" {
+		credentials, err := loadProviderCredentials(path)
+		if err != nil {
+			return "", "", err
+		}
+		for provider, entry := range credentials {
+			if providerEnvKey(provider) == key && strings.TrimSpace(entry.Token) != "" {
+				return strings.TrimSpace(entry.Token), path, nil
+			}
+		}
+	}
+
+	return "", "", nil
+}
+
+// providerCredentials is one entry in the credentials file, e.g.
+// {"ipinfo": {"token": "..."}}
+type providerCredentials struct {
+	Token string `json:"token"`
+}
+
+// loadProviderCredentials reads the JSON credentials file keyed by provider name
+func loadProviderCredentials(path string) (map[string]providerCredentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provider credentials file: %v", err)
+	}
+
+	var credentials map[string]providerCredentials
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("failed to parse provider credentials file %s: %v", path, err)
+	}
+	return credentials, nil
+}
+
+// GetProviderFailureThreshold returns the consecutive failures that open a provider's circuit
+func GetProviderFailureThreshold() int {
+	if threshold := Current().GeoIP.FailureThreshold; threshold > 0 {
+		return threshold
+	}
+	return ProviderFailureThreshold
+}
+
+// GetProviderCooldown returns how long an open circuit skips its provider
+func GetProviderCooldown() time.Duration {
+	return nonNegativeDuration(Current().GeoIP.Cooldown, ProviderCooldown)
+}
+
+// GetCampusNetworksFile returns the path of the JSON file labelling campus subnets
+func GetCampusNetworksFile() string {
+	return Current().GeoIP.CampusNetworksFile
+}
+
+// GetGeoIPDatabases returns the paths of the MaxMind city and ASN databases
+func GetGeoIPDatabases() (string, string) {
+	geoip := Current().GeoIP
+	return geoip.CityDB, geoip.ASNDB
+}
+
+// GetEnrichmentWorkers returns the number of test enrichment workers (enrichment.workers)
+func GetEnrichmentWorkers() int {
+	if workers := Current().Enrichment.Workers; workers >= 0 {
+		return workers
+	}
+	return EnrichmentWorkers
+}
+
+// GetEnrichmentQueueSize returns the enrichment queue size (enrichment.queue_size)
+func GetEnrichmentQueueSize() int {
+	if size := Current().Enrichment.QueueSize; size > 0 {
+		return size
+	}
+	return EnrichmentQueueSize
+}
+
+// GetEnrichmentDNSTimeout returns the reverse DNS timeout (enrichment.dns_timeout)
+func GetEnrichmentDNSTimeout() time.Duration {
+	return nonNegativeDuration(Current().Enrichment.DNSTimeout, EnrichmentDNSTimeout)
+}
+
+// GetMetricsLogPath returns the directory metrics logs are written to
+func GetMetricsLogPath() string {
+	return Current().Metrics.LogPath
+}
+
+// GetTraceStoreLimits returns how many test session traces are kept and for
+// how long after their last event (metrics.trace_max_tests, metrics.trace_retention)
+func GetTraceStoreLimits() (int, time.Duration) {
+	metrics := Current().Metrics
+	maxTests := metrics.TraceMaxTests
+	if maxTests < 0 {
+		maxTests = TraceMaxTests
+	}
+	return maxTests, positiveDuration(metrics.TraceRetention, TraceRetention)
+}
+
+// GetLogSettings returns the log level and format (log.level, log.format)
+func GetLogSettings() (string, string) {
+	log := Current().Log
+	return log.Level, log.Format
+}
+
+// GetTracing returns the OTLP collector URL (empty when tracing is
+// disabled), the service name traces are reported under and the share of new
+// traces sampled (tracing.endpoint, tracing.service_name, tracing.sample_ratio)
+func GetTracing() (string, string, float64) {
+	tracing := Current().Tracing
+	return tracing.Endpoint, tracing.ServiceName, tracing.SampleRatio
+}
+
+// GetListenPort returns the port the HTTP server listens on (server.port)
+func GetListenPort() int {
+	return Current().Server.Port
+}
+
+// GetSwaggerHost returns the host advertised in the Swagger docs, empty for
+// the request host
+func GetSwaggerHost() string {
+	return Current().Server.SwaggerHost
+}
+
+// GetTLSFiles returns the certificate and key files; both are empty when
+// the server listens on plain HTTP
+func GetTLSFiles() (string, string) {
+	tls := Current().TLS
+	return tls.CertFile, tls.KeyFile
+}
+
+// GetTLSMinVersion returns the minimum TLS version as "1.2" or "1.3"
+func GetTLSMinVersion() string {
+	if version := Current().TLS.MinVersion; version == "1.3" {
+		return version
+	}
+	return "1.2"
+}
+
+// GetHTTPRedirectPort returns the plain HTTP port that redirects to HTTPS, 0 when disabled
+func GetHTTPRedirectPort() int {
+	return Current().TLS.RedirectPort
+}
+
+// GetHTTP3Port returns the UDP port serving test endpoints over HTTP/3, 0 when disabled
+func GetHTTP3Port() int {
+	return Current().TLS.HTTP3Port
+}
+
+// GetDualStackHosts returns the IPv4-only and IPv6-only host names used by
+// dual-stack tests; both are empty when dual-stack testing is not configured
+func GetDualStackHosts() (string, string) {
+	server := Current().Server
+	return server.IPv4Host, server.IPv6Host
+}
+
+// GetDualStackURLs returns base URLs for the IPv4-only and IPv6-only hosts,
+// keeping the scheme and port of the server's public base URL
+func GetDualStackURLs() (string, string) {
+	ipv4Host, ipv6Host := GetDualStackHosts()
+	if ipv4Host == "" {
+		return "", ""
+	}
+
+	base, err := url.Parse(GetServerIdentity().BaseURL)
+	if err != nil {
+		return "", ""
+	}
+	withHost := func(host string) string {
+		if port := base.Port(); port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		return base.Scheme + "://" + host
+	}
+	return withHost(ipv4Host), withHost(ipv6Host)
+}
+
+// GetDatabaseDSN returns the MySQL DSN from database.url, or built from the
+// individual database settings
+func GetDatabaseDSN() string {
+	db := Current().Database
+	if db.URL != "" {
+		return db.URL
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+		db.User, db.Password, db.Host, db.Port, db.Name)
+}
+
+// ServerIdentity describes who runs this server and where, so other campuses
+// can deploy it under their own name
+type ServerIdentity struct {
+	Name     string // Display name, e.g. "Krea Speed Test Server"
+	Sponsor  string // Operating organization
+	Country  string // ISO 3166-1 alpha-2 country code
+	City     string
+	Location string // Coordinates as "lat,lng", empty if unknown
+	BaseURL  string // Public base URL without trailing slash
+}
+
+// GetServerIdentity returns the server identity from the server section
+// (SERVER_NAME, SERVER_SPONSOR, SERVER_COUNTRY, SERVER_CITY, SERVER_LOCATION
+// and SERVER_URL), falling back to the defaults
+func GetServerIdentity() ServerIdentity {
+	server := Current().Server
+	identity := ServerIdentity{
+		Name:     orDefault(server.Name, DefaultServerName),
+		Sponsor:  orDefault(server.Sponsor, DefaultServerSponsor),
+		Country:  orDefault(server.Country, DefaultServerCountry),
+		City:     orDefault(server.City, DefaultServerCity),
+		Location: server.Location,
+		BaseURL:  DefaultServerBaseURL,
+	}
+
+	if serverURL := parseServerURL(server.URL); serverURL != nil && serverURL.Host != "" {
+		identity.BaseURL = strings.TrimSuffix(serverURL.String(), "/")
+	}
+
+	return identity
+}
+
+// orDefault returns the trimmed value, falling back to def when empty
+func orDefault(value, def string) string {
+	if value = strings.TrimSpace(value); value != "" {
+		return value
+	}
+	return def
+}
+
+// GetServerPublicHost returns the public host name of this server from
+// server.public_host, the host of server.url, or the default
+func GetServerPublicHost() string {
+	server := Current().Server
+	if host := strings.TrimSpace(server.PublicHost); host != "" {
+		return host
+	}
+	if serverURL := parseServerURL(server.URL); serverURL != nil && serverURL.Hostname() != "" {
+		return serverURL.Hostname()
+	}
+	return DefaultPublicHost
+}
+
+// GetServerPublicPort returns the public port of this server from
+// server.public_port, the port (or scheme) of server.url, or the default
+func GetServerPublicPort() int {
+	server := Current().Server
+	if port := server.PublicPort; port > 0 && port < 65536 {
+		return port
+	}
+	if serverURL := parseServerURL(server.URL); serverURL != nil {
+		if port, err := strconv.Atoi(serverURL.Port()); err == nil {
+			return port
+		}
+		switch serverURL.Scheme {
+		case "https":
+			return 443
+		case "http":
+			return 80
+		}
+	}
+	return DefaultPublicPort
+}
+
+// GetServerLocation returns this server's coordinates as "lat,lng", used to
+// report the distance to clients; empty when not configured
+func GetServerLocation() string {
+	return strings.TrimSpace(Current().Server.Location)
+}
+
+// parseServerURL parses the configured server URL, nil when unset or invalid
+func parseServerURL(value string) *url.URL {
+	if value == "" {
+		return nil
+	}
+	serverURL, err := url.Parse(value)
+	if err != nil {
+		return nil
+	}
+	return serverURL
+}
+
+// providerEnvKey maps a provider name to its environment prefix (ip-api -> IP_API)
+func providerEnvKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+}
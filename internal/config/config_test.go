@@ -0,0 +1,81 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetIPProviderTokenSources(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "ipinfo_token")
+	credentials := filepath.Join(dir, "credentials.json")
+	os.WriteFile(secret, []byte("from-secret\n"), 0600)
+	os.WriteFile(credentials, []byte(`{"ipinfo": {"token": "from-file"}, "ip-api": {"token": "pro-key"}}`), 0600)
+
+	t.Setenv("IPINFO_TOKEN", "")
+	t.Setenv("IP_PROVIDER_CREDENTIALS_FILE", credentials)
+	if token, source, err := GetIPProviderToken("ipinfo"); err != nil || token != "from-file" || source != credentials {
+		t.Errorf("credentials file: got %q from %q (%v)", token, source, err)
+	}
+	if token, _, _ := GetIPProviderToken("ip-api"); token != "pro-key" {
+		t.Errorf("credentials file lookup by normalized name: got %q", token)
+	}
+
+	t.Setenv("IPINFO_TOKEN_FILE", secret)
+	if token, _, _ := GetIPProviderToken("ipinfo"); token != "from-secret" {
+		t.Errorf("secrets file should override credentials file, got %q", token)
+	}
+
+	t.Setenv("IPINFO_TOKEN", "from-env")
+	if token, source, _ := GetIPProviderToken("ipinfo"); token != "from-env" || source != "IPINFO_TOKEN" {
+		t.Errorf("environment should take precedence, got %q from %q", token, source)
+	}
+
+	if token, _, err := GetIPProviderToken("freeipapi"); token != "" || err != nil {
+		t.Errorf("unconfigured provider: got %q (%v)", token, err)
+	}
+}
+
+func TestGetIPProviderTokenMissingSecretsFile(t *testing.T) {
+	t.Setenv("IPINFO_TOKEN", "")
+	t.Setenv("IPINFO_TOKEN_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, _, err := GetIPProviderToken("ipinfo"); err == nil {
+		t.Error("expected an error for an unreadable secrets file")
+	}
+}
+
+func TestGetServerIdentity(t *testing.T) {
+	t.Setenv("SERVER_NAME", "")
+	t.Setenv("SERVER_URL", "")
+	if identity := GetServerIdentity(); identity.Name != DefaultServerName || identity.BaseURL != DefaultServerBaseURL {
+		t.Errorf("unexpected default identity %+v", identity)
+	}
+
+	t.Setenv("SERVER_NAME", "IIT Campus Speed Test")
+	t.Setenv("SERVER_COUNTRY", "in")
+	t.Setenv("SERVER_URL", "https://speed.example.edu:8443/  # Used by client applications")
+	identity := GetServerIdentity()
+	if identity.Name != "IIT Campus Speed Test" || identity.Country != "IN" || identity.BaseURL != "https://speed.example.edu:8443" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+	if host, port := GetServerPublicHost(), GetServerPublicPort(); host != "speed.example.edu" || port != 8443 {
+		t.Errorf("public endpoint from SERVER_URL: got %s:%d", host, port)
+	}
+}
+
+func TestGetDualStackURLs(t *testing.T) {
+	t.Setenv("SERVER_IPV4_HOST", "")
+	t.Setenv("SERVER_IPV6_HOST", "")
+	if ipv4URL, ipv6URL := GetDualStackURLs(); ipv4URL != "" || ipv6URL != "" {
+		t.Errorf("expected no dual-stack URLs, got %q %q", ipv4URL, ipv6URL)
+	}
+
+	t.Setenv("SERVER_URL", "https://speed.example.edu:8443")
+	t.Setenv("SERVER_IPV4_HOST", "V4.speed.example.edu")
+	t.Setenv("SERVER_IPV6_HOST", "2001:db8::1")
+	ipv4URL, ipv6URL := GetDualStackURLs()
+	if ipv4URL != "https://v4.speed.example.edu:8443" || ipv6URL != "https://[2001:db8::1]:8443" {
+		t.Errorf("unexpected dual-stack URLs %q %q", ipv4URL, ipv6URL)
+	}
+}
@@ -0,0 +1,754 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete server configuration. It is loaded from defaults,
+// then an optional YAML or TOML file, then environment variables (named in
+// the env tags), and validated before use.
+type Config struct {
+	Server     ServerConfig     `yaml:"server" toml:"server"`
+	TLS        TLSConfig        `yaml:"tls" toml:"tls"`
+	Database   DatabaseConfig   `yaml:"database" toml:"database"`
+	Timeouts   TimeoutsConfig   `yaml:"timeouts" toml:"timeouts"`
+	Limits     LimitsConfig     `yaml:"limits" toml:"limits"`
+	Queue      QueueConfig      `yaml:"queue" toml:"queue"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit" toml:"rate_limit"`
+	GeoIP      GeoIPConfig      `yaml:"geoip" toml:"geoip"`
+	Enrichment EnrichmentConfig `yaml:"enrichment" toml:"enrichment"`
+	Metrics    MetricsConfig    `yaml:"metrics" toml:"metrics"`
+	Log        LogConfig        `yaml:"log" toml:"log"`
+	Tracing    TracingConfig    `yaml:"tracing" toml:"tracing"`
+}
+
+// ServerConfig holds listener settings and the server's public identity
+type ServerConfig struct {
+	Port           int      `yaml:"port" toml:"port" env:"PORT"`
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	ProxyProtocol  bool     `yaml:"proxy_protocol" toml:"proxy_protocol" env:"PROXY_PROTOCOL"`
+	SwaggerHost    string   `yaml:"swagger_host" toml:"swagger_host" env:"SWAGGER_HOST"`
+	URL            string   `yaml:"url" toml:"url" env:"SERVER_URL"`
+	PublicHost     string   `yaml:"public_host" toml:"public_host" env:"SERVER_PUBLIC_HOST"`
+	PublicPort     int      `yaml:"public_port" toml:"public_port" env:"SERVER_PUBLIC_PORT"`
+	Name           string   `yaml:"name" toml:"name" env:"SERVER_NAME"`
+	Sponsor        string   `yaml:"sponsor" toml:"sponsor" env:"SERVER_SPONSOR"`
+	Country        string   `yaml:"country" toml:"country" env:"SERVER_COUNTRY"`
+	City           string   `yaml:"city" toml:"city" env:"SERVER_CITY"`
+	Location       string   `yaml:"location" toml:"location" env:"SERVER_LOCATION"`
+	IPv4Host       string   `yaml:"ipv4_host" toml:"ipv4_host" env:"SERVER_IPV4_HOST"` // Hostname with only an A record, for dual-stack tests
+	IPv6Host       string   `yaml:"ipv6_host" toml:"ipv6_host" env:"SERVER_IPV6_HOST"` // Hostname with only an AAAA record, for dual-stack tests
+}
+
+// TLSConfig enables HTTPS on the main listener; certificates are reloaded
+// when the files change
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file" toml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile      string `yaml:"key_file" toml:"key_file" env:"TLS_KEY_FILE"`
+	MinVersion   string `yaml:"min_version" toml:"min_version" env:"TLS_MIN_VERSION"`        // "1.2" or "1.3"
+	RedirectPort int    `yaml:"redirect_port" toml:"redirect_port" env:"HTTP_REDIRECT_PORT"` // Plain HTTP port redirecting to HTTPS, 0 disables
+	HTTP3Port    int    `yaml:"http3_port" toml:"http3_port" env:"HTTP3_PORT"`               // UDP port serving test endpoints over HTTP/3, 0 disables
+}
+
+// DatabaseConfig holds the MySQL connection settings; URL takes precedence
+type DatabaseConfig struct {
+	URL      string `yaml:"url" toml:"url" env:"DATABASE_URL"`
+	Host     string `yaml:"host" toml:"host" env:"DB_HOST"`
+	Port     string `yaml:"port" toml:"port" env:"DB_PORT"`
+	User     string `yaml:"user" toml:"user" env:"DB_USER"`
+	Password string `yaml:"password" toml:"password" env:"DB_PASSWORD"`
+	Name     string `yaml:"name" toml:"name" env:"DB_NAME"`
+}
+
+// TimeoutsConfig holds the strict connection timeouts of API routes and the
+// bounds of the deadlines given to speed test transfers
+type TimeoutsConfig struct {
+	Read            Duration `yaml:"read" toml:"read" env:"READ_TIMEOUT_SECONDS"`
+	Write           Duration `yaml:"write" toml:"write" env:"WRITE_TIMEOUT_SECONDS"`
+	Idle            Duration `yaml:"idle" toml:"idle" env:"IDLE_TIMEOUT_SECONDS"`
+	TestMinRateMbps float64  `yaml:"test_min_rate_mbps" toml:"test_min_rate_mbps" env:"TEST_MIN_RATE_MBPS"`      // Slowest link a test transfer must be able to finish on
+	TestMaxDuration Duration `yaml:"test_max_duration" toml:"test_max_duration" env:"TEST_MAX_DURATION_SECONDS"` // Upper bound of a test transfer's deadline
+}
+
+// LimitsConfig holds concurrency and bandwidth admission limits
+type LimitsConfig struct {
+	MaxConcurrentRequests int      `yaml:"max_concurrent_requests" toml:"max_concurrent_requests" env:"MAX_CONCURRENT_REQUESTS"`
+	BandwidthCapacityMbps float64  `yaml:"bandwidth_capacity_mbps" toml:"bandwidth_capacity_mbps" env:"BANDWIDTH_CAPACITY_MBPS"`
+	MinPerTestMbps        float64  `yaml:"min_per_test_mbps" toml:"min_per_test_mbps" env:"BANDWIDTH_MIN_PER_TEST_MBPS"`
+	AdmissionQueueSize    int      `yaml:"admission_queue_size" toml:"admission_queue_size" env:"ADMISSION_QUEUE_SIZE"`
+	AdmissionQueueWait    Duration `yaml:"admission_queue_wait" toml:"admission_queue_wait" env:"ADMISSION_QUEUE_WAIT_SECONDS"`
+}
+
+// QueueConfig holds waiting room ticket settings
+type QueueConfig struct {
+	WaitTimeout     Duration `yaml:"wait_timeout" toml:"wait_timeout" env:"QUEUE_WAIT_TIMEOUT_SECONDS"`
+	AdmitTimeout    Duration `yaml:"admit_timeout" toml:"admit_timeout" env:"QUEUE_ADMIT_TIMEOUT_SECONDS"`
+	TicketLifetime  Duration `yaml:"ticket_lifetime" toml:"ticket_lifetime" env:"QUEUE_TICKET_LIFETIME_SECONDS"` // Admitted tickets expire this long after admission, even in use
+	MaxTicketsPerIP int      `yaml:"max_tickets_per_ip" toml:"max_tickets_per_ip" env:"QUEUE_MAX_TICKETS_PER_IP"`
+	MaxRequests     int      `yaml:"max_requests_per_ticket" toml:"max_requests_per_ticket" env:"QUEUE_MAX_REQUESTS_PER_TICKET"` // Concurrent requests one admitted ticket may run
+}
+
+// RateLimitConfig holds request rate limiting settings
+type RateLimitConfig struct {
+	Store     string         `yaml:"store" toml:"store" env:"RATE_LIMIT_STORE"`
+	Whitelist []string       `yaml:"whitelist" toml:"whitelist" env:"RATE_LIMIT_WHITELIST"` // IPs or CIDRs exempt from rate limits
+	Routes    map[string]int `yaml:"routes" toml:"routes"`                                  // Requests per minute by path prefix, overriding the built-in limits
+
+	whitelist []*net.IPNet
+}
+
+// GeoIPConfig holds geolocation provider and cache settings
+type GeoIPConfig struct {
+	Providers          []string `yaml:"providers" toml:"providers" env:"IP_PROVIDERS"`
+	Mode               string   `yaml:"mode" toml:"mode" env:"IP_PROVIDER_MODE"`
+	Timeout            Duration `yaml:"timeout" toml:"timeout" env:"IP_PROVIDER_TIMEOUT_SECONDS"`
+	FailureThreshold   int      `yaml:"failure_threshold" toml:"failure_threshold" env:"IP_PROVIDER_FAILURE_THRESHOLD"`
+	Cooldown           Duration `yaml:"cooldown" toml:"cooldown" env:"IP_PROVIDER_COOLDOWN_SECONDS"`
+	CredentialsFile    string   `yaml:"credentials_file" toml:"credentials_file" env:"IP_PROVIDER_CREDENTIALS_FILE"`
+	CampusNetworksFile string   `yaml:"campus_networks_file" toml:"campus_networks_file" env:"CAMPUS_NETWORKS_FILE"`
+	CityDB             string   `yaml:"city_db" toml:"city_db" env:"GEOIP_CITY_DB"`
+	ASNDB              string   `yaml:"asn_db" toml:"asn_db" env:"GEOIP_ASN_DB"`
+	CacheSize          int      `yaml:"cache_size" toml:"cache_size" env:"IP_CACHE_SIZE"`
+	CacheTTL           Duration `yaml:"cache_ttl" toml:"cache_ttl" env:"IP_CACHE_TTL_SECONDS"`
+	CacheNegativeTTL   Duration `yaml:"cache_negative_ttl" toml:"cache_negative_ttl" env:"IP_CACHE_NEGATIVE_TTL_SECONDS"`
+	CachePersist       bool     `yaml:"cache_persist" toml:"cache_persist" env:"IP_CACHE_PERSIST"`
+}
+
+// EnrichmentConfig holds background test enrichment settings
+type EnrichmentConfig struct {
+	Workers    int      `yaml:"workers" toml:"workers" env:"ENRICHMENT_WORKERS"`
+	QueueSize  int      `yaml:"queue_size" toml:"queue_size" env:"ENRICHMENT_QUEUE_SIZE"`
+	DNSTimeout Duration `yaml:"dns_timeout" toml:"dns_timeout" env:"ENRICHMENT_DNS_TIMEOUT_SECONDS"`
+}
+
+// MetricsConfig holds metrics logging settings
+type MetricsConfig struct {
+	LogPath        string   `yaml:"log_path" toml:"log_path" env:"METRICS_LOG_PATH"`
+	TraceMaxTests  int      `yaml:"trace_max_tests" toml:"trace_max_tests" env:"TRACE_MAX_TESTS"`         // Test sessions whose event traces are kept in memory, 0 disables
+	TraceRetention Duration `yaml:"trace_retention" toml:"trace_retention" env:"TRACE_RETENTION_SECONDS"` // How long a trace is kept after its last event
+}
+
+// LogConfig holds logging settings
+type LogConfig struct {
+	Level  string `yaml:"level" toml:"level" env:"LOG_LEVEL"`    // debug, info, warn or error
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT"` // text or json
+}
+
+// TracingConfig holds OpenTelemetry tracing settings
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"` // OTLP/HTTP collector URL, e.g. http://localhost:4318; empty disables tracing
+	ServiceName string  `yaml:"service_name" toml:"service_name" env:"OTEL_SERVICE_NAME"`
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"` // Share of new traces recorded; requests carrying a sampled parent are always recorded
+}
+
+// Duration is a time.Duration written as "30s" or "1m" in config files;
+// bare numbers (as used by the *_SECONDS environment variables) are seconds
+type Duration time.Duration
+
+// Std returns the value as a time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	value := strings.TrimSpace(string(text))
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q (use e.g. \"30s\" or a number of seconds)", value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalYAML accepts plain numbers as seconds as well as duration strings
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.UnmarshalText([]byte(node.Value))
+}
+
+// UnmarshalTOML accepts TOML integers and floats as seconds as well as duration strings
+func (d *Duration) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case int64:
+		*d = Duration(time.Duration(v) * time.Second)
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		return d.UnmarshalText([]byte(v))
+	default:
+		return fmt.Errorf("invalid duration %v", value)
+	}
+	return nil
+}
+
+// Defaults returns the built-in configuration
+func Defaults() *Config {
+	seconds := func(s float64) Duration { return Duration(s * float64(time.Second)) }
+
+	return &Config{
+		Server: ServerConfig{
+			Port:        8080,
+			SwaggerHost: "localhost:8080",
+			Name:        DefaultServerName,
+			Sponsor:     DefaultServerSponsor,
+			Country:     DefaultServerCountry,
+			City:        DefaultServerCity,
+		},
+		TLS: TLSConfig{
+			MinVersion: "1.2",
+		},
+		Database: DatabaseConfig{
+			Host:     "localhost",
+			Port:     "3306",
+			User:     "root",
+			Password: "password",
+			Name:     "speedtest",
+		},
+		Timeouts: TimeoutsConfig{
+			Read:            seconds(ReadTimeout),
+			Write:           seconds(WriteTimeout),
+			Idle:            seconds(IdleTimeout),
+			TestMinRateMbps: TestMinRateMbps,
+			TestMaxDuration: seconds(TestMaxDuration),
+		},
+		Limits: LimitsConfig{
+			MaxConcurrentRequests: MaxConcurrentRequests,
+			BandwidthCapacityMbps: BandwidthCapacityMbps,
+			MinPerTestMbps:        MinPerTestMbps,
+			AdmissionQueueSize:    AdmissionQueueSize,
+			AdmissionQueueWait:    seconds(AdmissionQueueWait),
+		},
+		Queue: QueueConfig{
+			WaitTimeout:     seconds(QueueWaitTimeout),
+			AdmitTimeout:    seconds(QueueAdmitTimeout),
+			TicketLifetime:  seconds(QueueTicketLifetime),
+			MaxTicketsPerIP: QueueMaxTicketsPerIP,
+			MaxRequests:     QueueMaxRequestsPerTicket,
+		},
+		RateLimit: RateLimitConfig{
+			Store: "memory",
+		},
+		GeoIP: GeoIPConfig{
+			Providers:        strings.Split(IPProviders, ","),
+			Mode:             "first",
+			Timeout:          seconds(HTTPTimeout),
+			FailureThreshold: ProviderFailureThreshold,
+			Cooldown:         seconds(ProviderCooldown),
+			CacheSize:        IPCacheSize,
+			CacheTTL:         seconds(IPCacheTTL),
+			CacheNegativeTTL: seconds(IPCacheNegativeTTL),
+		},
+		Enrichment: EnrichmentConfig{
+			Workers:    EnrichmentWorkers,
+			QueueSize:  EnrichmentQueueSize,
+			DNSTimeout: seconds(EnrichmentDNSTimeout),
+		},
+		Metrics: MetricsConfig{
+			LogPath:        "/tmp/speed-test-server-logs",
+			TraceMaxTests:  TraceMaxTests,
+			TraceRetention: seconds(TraceRetention),
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{
+			ServiceName: "speed-test-server",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// Load builds the configuration from defaults, the file at path (YAML or
+// TOML by extension; optional) and environment overrides, then validates it
+func Load(path string) (*Config, error) {
+	cfg := Defaults()
+
+	if path != "" {
+		if err := cfg.decodeFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	envErrors := cfg.applyEnv()
+	cfg.normalize()
+
+	if err := cfg.validate(envErrors); err != nil {
+		return nil, err
+	}
+	cfg.RateLimit.whitelist, _ = ParseNetworks(cfg.RateLimit.Whitelist)
+
+	return cfg, nil
+}
+
+// decodeFile overlays the settings in a YAML or TOML file, rejecting unknown keys
+func (c *Config) decodeFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("invalid config file %s: unknown keys: %s", path, strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("unsupported config file format %q (use .yaml, .yml or .toml)", filepath.Ext(path))
+	}
+
+	return nil
+}
+
+// applyEnv overrides fields from the environment variables named in their env
+// tags. Values that don't parse are reported and leave the field unchanged.
+func (c *Config) applyEnv() []string {
+	var problems []string
+
+	var walk func(v reflect.Value, t reflect.Type)
+	walk = func(v reflect.Value, t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			value := v.Field(i)
+
+			if field.Type.Kind() == reflect.Struct {
+				walk(value, field.Type)
+				continue
+			}
+
+			key := field.Tag.Get("env")
+			raw, ok := os.LookupEnv(key)
+			if key == "" || !ok || strings.TrimSpace(raw) == "" {
+				continue
+			}
+			if err := setFromString(value, strings.TrimSpace(raw)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+			}
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), reflect.TypeOf(*c))
+
+	return problems
+}
+
+// setFromString parses an environment value into a config field
+func setFromString(value reflect.Value, raw string) error {
+	if unmarshaler, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(raw))
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", raw)
+		}
+		value.SetInt(int64(parsed))
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", raw)
+		}
+		value.SetFloat(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", raw)
+		}
+		value.SetBool(parsed)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Kind())
+	}
+	return nil
+}
+
+// normalize canonicalizes case and whitespace so lookups can compare directly
+func (c *Config) normalize() {
+	c.Server.Country = strings.ToUpper(strings.TrimSpace(c.Server.Country))
+	c.Server.IPv4Host = strings.ToLower(strings.TrimSpace(c.Server.IPv4Host))
+	c.Server.IPv6Host = strings.ToLower(strings.TrimSpace(c.Server.IPv6Host))
+	c.RateLimit.Store = strings.ToLower(strings.TrimSpace(c.RateLimit.Store))
+	c.GeoIP.Mode = strings.ToLower(strings.TrimSpace(c.GeoIP.Mode))
+	c.Log.Level = strings.ToLower(strings.TrimSpace(c.Log.Level))
+	c.Log.Format = strings.ToLower(strings.TrimSpace(c.Log.Format))
+	c.Tracing.Endpoint = strings.TrimSpace(c.Tracing.Endpoint)
+	c.Tracing.ServiceName = strings.TrimSpace(c.Tracing.ServiceName)
+
+	providers := c.GeoIP.Providers[:0:0]
+	for _, name := range c.GeoIP.Providers {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			providers = append(providers, name)
+		}
+	}
+	c.GeoIP.Providers = providers
+
+	// SERVER_URL may carry a trailing comment when copied from .env.example
+	if fields := strings.Fields(c.Server.URL); len(fields) > 0 {
+		c.Server.URL = fields[0]
+	}
+}
+
+// Redacted returns a copy with secrets masked, for display
+func (c *Config) Redacted() *Config {
+	clone := *c
+	if clone.Database.Password != "" {
+		clone.Database.Password = "********"
+	}
+	if clone.Database.URL != "" {
+		if at := strings.LastIndex(clone.Database.URL, "@"); at > 0 {
+			if colon := strings.Index(clone.Database.URL[:at], ":"); colon >= 0 {
+				clone.Database.URL = clone.Database.URL[:colon+1] + "********" + clone.Database.URL[at:]
+			}
+		}
+	}
+	return &clone
+}
+
+// YAML renders the configuration as YAML
+func (c *Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+var (
+	current    atomic.Pointer[Config]
+	loadedPath string
+
+	reloadMu sync.Mutex
+	watchers []func(old, updated *Config)
+)
+
+// Init loads the configuration from path (may be empty) and makes it current.
+// It is called once at startup; errors describe every invalid setting.
+func Init(path string) (*Config, error) {
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reloadMu.Lock()
+	loadedPath = path
+	reloadMu.Unlock()
+
+	current.Store(cfg)
+	return cfg, nil
+}
+
+// Current returns the active configuration. Before Init it is built from
+// defaults and the environment on each call, ignoring invalid values.
+func Current() *Config {
+	if cfg := current.Load(); cfg != nil {
+		return cfg
+	}
+
+	cfg := Defaults()
+	cfg.applyEnv()
+	cfg.normalize()
+	cfg.RateLimit.whitelist, _ = ParseNetworks(cfg.RateLimit.Whitelist)
+	return cfg
+}
+
+// OnReload registers fn to be called with the old and new configuration
+// after each successful Reload
+func OnReload(fn func(old, updated *Config)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	watchers = append(watchers, fn)
+}
+
+// Reload re-reads the configuration file and environment. An invalid
+// configuration is rejected and the current one stays active.
+func Reload() (*Config, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	updated, err := Load(loadedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	old := Current()
+	current.Store(updated)
+	for _, fn := range watchers {
+		fn(old, updated)
+	}
+
+	return updated, nil
+}
+
+// RestartRequired lists the changed sections that only take effect after a restart
+func RestartRequired(old, updated *Config) []string {
+	var sections []string
+	if !reflect.DeepEqual(old.Server, updated.Server) {
+		sections = append(sections, "server")
+	}
+	if old.TLS != updated.TLS {
+		sections = append(sections, "tls")
+	}
+	if old.Timeouts.Read != updated.Timeouts.Read || old.Timeouts.Write != updated.Timeouts.Write ||
+		old.Timeouts.Idle != updated.Timeouts.Idle {
+		sections = append(sections, "timeouts")
+	}
+	if !reflect.DeepEqual(old.Database, updated.Database) {
+		sections = append(sections, "database")
+	}
+	if old.RateLimit.Store != updated.RateLimit.Store {
+		sections = append(sections, "rate_limit.store")
+	}
+	if old.GeoIP.CacheSize != updated.GeoIP.CacheSize || old.GeoIP.CacheTTL != updated.GeoIP.CacheTTL ||
+		old.GeoIP.CacheNegativeTTL != updated.GeoIP.CacheNegativeTTL || old.GeoIP.CachePersist != updated.GeoIP.CachePersist {
+		sections = append(sections, "geoip cache")
+	}
+	if !reflect.DeepEqual(old.Enrichment, updated.Enrichment) {
+		sections = append(sections, "enrichment")
+	}
+	if !reflect.DeepEqual(old.Metrics, updated.Metrics) {
+		sections = append(sections, "metrics")
+	}
+	if !reflect.DeepEqual(old.Tracing, updated.Tracing) {
+		sections = append(sections, "tracing")
+	}
+	return sections
+}
+
+// knownProviders are the provider names accepted in geoip.providers
+var knownProviders = map[string]bool{
+	"mmdb": true, "ipinfo": true, "ipinfo.io": true, "ip-api": true,
+	"ip-api.com": true, "freeipapi": true, "freeipapi.com": true,
+}
+
+// validate checks every setting and reports all problems at once, each
+// prefixed with its path in the config file
+func (c *Config) validate(problems []string) error {
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	checkFile := func(field, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", field, err))
+		}
+	}
+	checkNetworks := func(field string, values []string) {
+		if _, err := ParseNetworks(values); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", field, err))
+		}
+	}
+
+	s := c.Server
+	check(s.Port > 0 && s.Port < 65536, "server.port: must be between 1 and 65535, got %d", s.Port)
+	check(s.PublicPort >= 0 && s.PublicPort < 65536, "server.public_port: must be between 0 and 65535, got %d", s.PublicPort)
+	checkNetworks("server.trusted_proxies", s.TrustedProxies)
+	if s.URL != "" {
+		parsed, err := url.Parse(s.URL)
+		check(err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != "",
+			"server.url: must be an absolute http(s) URL, got %q", s.URL)
+	}
+	check(s.Name != "", "server.name: must not be empty")
+	check(len(s.Country) == 2, "server.country: must be an ISO 3166-1 alpha-2 code, got %q", s.Country)
+	if s.Location != "" {
+		check(validLocation(s.Location), "server.location: must be \"lat,lng\", got %q", s.Location)
+	}
+	check((s.IPv4Host == "") == (s.IPv6Host == ""), "server: ipv4_host and ipv6_host must be set together")
+	check(s.IPv4Host == "" || validHostname(s.IPv4Host), "server.ipv4_host: must be a host name without scheme or port, got %q", s.IPv4Host)
+	check(s.IPv6Host == "" || validHostname(s.IPv6Host), "server.ipv6_host: must be a host name without scheme or port, got %q", s.IPv6Host)
+	check(s.IPv4Host == "" || s.IPv4Host != s.IPv6Host, "server.ipv6_host: must differ from ipv4_host")
+
+	t := c.TLS
+	check((t.CertFile == "") == (t.KeyFile == ""), "tls: cert_file and key_file must be set together")
+	checkFile("tls.cert_file", t.CertFile)
+	checkFile("tls.key_file", t.KeyFile)
+	check(t.MinVersion == "1.2" || t.MinVersion == "1.3", "tls.min_version: must be \"1.2\" or \"1.3\", got %q", t.MinVersion)
+	check(t.RedirectPort >= 0 && t.RedirectPort < 65536, "tls.redirect_port: must be between 0 and 65535, got %d", t.RedirectPort)
+	check(t.RedirectPort == 0 || t.CertFile != "", "tls.redirect_port: requires cert_file and key_file")
+	check(t.RedirectPort == 0 || t.RedirectPort != s.Port, "tls.redirect_port: must differ from server.port")
+	check(t.HTTP3Port >= 0 && t.HTTP3Port < 65536, "tls.http3_port: must be between 0 and 65535, got %d", t.HTTP3Port)
+	check(t.HTTP3Port == 0 || t.CertFile != "", "tls.http3_port: requires cert_file and key_file")
+
+	to := c.Timeouts
+	check(to.Read > 0, "timeouts.read: must be positive")
+	check(to.Write > 0, "timeouts.write: must be positive")
+	check(to.Idle > 0, "timeouts.idle: must be positive")
+	check(to.TestMinRateMbps > 0, "timeouts.test_min_rate_mbps: must be positive")
+	check(to.TestMaxDuration >= to.Write, "timeouts.test_max_duration: must not be shorter than timeouts.write")
+
+	l := c.Limits
+	check(l.MaxConcurrentRequests >= 0, "limits.max_concurrent_requests: must not be negative")
+	check(l.BandwidthCapacityMbps >= 0, "limits.bandwidth_capacity_mbps: must not be negative")
+	check(l.MinPerTestMbps > 0 || l.BandwidthCapacityMbps == 0, "limits.min_per_test_mbps: must be positive when bandwidth_capacity_mbps is set")
+	check(l.AdmissionQueueSize >= 0, "limits.admission_queue_size: must not be negative")
+	check(l.AdmissionQueueWait >= 0, "limits.admission_queue_wait: must not be negative")
+
+	q := c.Queue
+	check(q.WaitTimeout > 0, "queue.wait_timeout: must be positive")
+	check(q.AdmitTimeout > 0, "queue.admit_timeout: must be positive")
+	check(q.TicketLifetime > 0, "queue.ticket_lifetime: must be positive")
+	check(q.MaxTicketsPerIP > 0, "queue.max_tickets_per_ip: must be positive")
+	check(q.MaxRequests > 0, "queue.max_requests_per_ticket: must be positive")
+
+	r := c.RateLimit
+	check(r.Store == "memory" || r.Store == "database", "rate_limit.store: must be \"memory\" or \"database\", got %q", r.Store)
+	checkNetworks("rate_limit.whitelist", r.Whitelist)
+	for route, limit := range r.Routes {
+		check(strings.HasPrefix(route, "/") || route == "*", "rate_limit.routes: %q must be a path starting with / or *", route)
+		check(limit > 0, "rate_limit.routes.%s: must be positive, got %d", route, limit)
+	}
+
+	g := c.GeoIP
+	check(len(g.Providers) > 0, "geoip.providers: must list at least one provider")
+	for _, name := range g.Providers {
+		check(knownProviders[name], "geoip.providers: unknown provider %q", name)
+	}
+	check(g.Mode == "first" || g.Mode == "merge", "geoip.mode: must be \"first\" or \"merge\", got %q", g.Mode)
+	check(g.Timeout > 0, "geoip.timeout: must be positive")
+	check(g.FailureThreshold > 0, "geoip.failure_threshold: must be positive")
+	check(g.Cooldown >= 0, "geoip.cooldown: must not be negative")
+	check(g.CacheSize >= 0, "geoip.cache_size: must not be negative")
+	check(g.CacheTTL >= 0, "geoip.cache_ttl: must not be negative")
+	check(g.CacheNegativeTTL >= 0, "geoip.cache_negative_ttl: must not be negative")
+	checkFile("geoip.credentials_file", g.CredentialsFile)
+	checkFile("geoip.campus_networks_file", g.CampusNetworksFile)
+	checkFile("geoip.city_db", g.CityDB)
+	checkFile("geoip.asn_db", g.ASNDB)
+
+	e := c.Enrichment
+	check(e.Workers >= 0, "enrichment.workers: must not be negative")
+	check(e.QueueSize > 0, "enrichment.queue_size: must be positive")
+	check(e.DNSTimeout > 0, "enrichment.dns_timeout: must be positive")
+
+	m := c.Metrics
+	check(m.TraceMaxTests >= 0, "metrics.trace_max_tests: must not be negative")
+	check(m.TraceRetention > 0, "metrics.trace_retention: must be positive")
+
+	lc := c.Log
+	check(lc.Level == "debug" || lc.Level == "info" || lc.Level == "warn" || lc.Level == "error",
+		"log.level: must be \"debug\", \"info\", \"warn\" or \"error\", got %q", lc.Level)
+	check(lc.Format == "text" || lc.Format == "json", "log.format: must be \"text\" or \"json\", got %q", lc.Format)
+
+	tc := c.Tracing
+	if tc.Endpoint != "" {
+		endpoint, err := url.Parse(tc.Endpoint)
+		check(err == nil && (endpoint.Scheme == "http" || endpoint.Scheme == "https") && endpoint.Host != "",
+			"tracing.endpoint: must be an http:// or https:// collector URL, got %q", tc.Endpoint)
+	}
+	check(tc.ServiceName != "", "tracing.service_name: must not be empty")
+	check(tc.SampleRatio >= 0 && tc.SampleRatio <= 1, "tracing.sample_ratio: must be between 0 and 1")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ParseNetworks parses a list of IP addresses and CIDRs; bare addresses
+// become single-host networks
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR %q", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// validLocation reports whether value is a "lat,lng" pair in range
+func validLocation(value string) bool {
+	latStr, lngStr, ok := strings.Cut(value, ",")
+	if !ok {
+		return false
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(lngStr), 64)
+	return err1 == nil && err2 == nil && lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// validHostname reports whether value is a DNS name or IP literal, with no
+// scheme, port or path
+func validHostname(value string) bool {
+	if net.ParseIP(value) != nil {
+		return true
+	}
+	if len(value) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(value, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadYAMLAndTOML(t *testing.T) {
+	t.Setenv("IP_PROVIDER_MODE", "")
+
+	yamlPath := writeConfig(t, "config.yaml", `
+limits:
+  max_concurrent_requests: 50
+queue:
+  wait_timeout: 1m
+geoip:
+  providers: [ip-api, FreeIPAPI]
+  mode: Merge
+  cooldown: 45
+rate_limit:
+  whitelist: [10.0.0.0/8, 192.0.2.7]
+  routes:
+    /download: 20
+`)
+	tomlPath := writeConfig(t, "config.toml", `
+[limits]
+max_concurrent_requests = 50
+
+[queue]
+wait_timeout = "1m"
+
+[geoip]
+providers = ["ip-api", "FreeIPAPI"]
+mode = "Merge"
+cooldown = 45
+
+[rate_limit]
+whitelist = ["10.0.0.0/8", "192.0.2.7"]
+
+[rate_limit.routes]
+"/download" = 20
+`)
+
+	for _, path := range []string{yamlPath, tomlPath} {
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(path), err)
+		}
+		if cfg.Limits.MaxConcurrentRequests != 50 || cfg.Queue.WaitTimeout.Std() != time.Minute {
+			t.Errorf("%s: limits not loaded: %+v %+v", filepath.Base(path), cfg.Limits, cfg.Queue)
+		}
+		if cfg.GeoIP.Mode != "merge" || cfg.GeoIP.Providers[1] != "freeipapi" || cfg.GeoIP.Cooldown.Std() != 45*time.Second {
+			t.Errorf("%s: geoip not normalized: %+v", filepath.Base(path), cfg.GeoIP)
+		}
+		if cfg.RateLimit.Routes["/download"] != 20 || len(cfg.RateLimit.whitelist) != 2 {
+			t.Errorf("%s: rate limits not loaded: %+v", filepath.Base(path), cfg.RateLimit)
+		}
+		// Unset sections keep their defaults
+		if cfg.Enrichment.Workers != EnrichmentWorkers || cfg.Server.Port != 8080 {
+			t.Errorf("%s: defaults lost: %+v %+v", filepath.Base(path), cfg.Enrichment, cfg.Server)
+		}
+	}
+}
+
+func TestLoadEnvironmentOverridesFile(t *testing.T) {
+	path := writeConfig(t, "config.yml", "limits:\n  max_concurrent_requests: 50\n")
+	t.Setenv("MAX_CONCURRENT_REQUESTS", "10")
+	t.Setenv("IP_PROVIDERS", "ip-api, freeipapi")
+	t.Setenv("QUEUE_ADMIT_TIMEOUT_SECONDS", "2.5")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Limits.MaxConcurrentRequests != 10 {
+		t.Errorf("environment should override the file, got %d", cfg.Limits.MaxConcurrentRequests)
+	}
+	if len(cfg.GeoIP.Providers) != 2 || cfg.GeoIP.Providers[1] != "freeipapi" {
+		t.Errorf("unexpected providers %v", cfg.GeoIP.Providers)
+	}
+	if cfg.Queue.AdmitTimeout.Std() != 2500*time.Millisecond {
+		t.Errorf("seconds not parsed, got %v", cfg.Queue.AdmitTimeout.Std())
+	}
+}
+
+func TestLoadReportsAllProblems(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+server:
+  port: 70000
+  ipv4_host: https://v4.example.edu
+rate_limit:
+  store: redis
+  whitelist: [not-an-ip]
+geoip:
+  providers: [maxmind]
+metrics:
+  trace_max_tests: -1
+tracing:
+  endpoint: localhost:4318
+  sample_ratio: 2
+`)
+	t.Setenv("QUEUE_MAX_TICKETS_PER_IP", "many")
+
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"server.port", "ipv4_host and ipv6_host", "server.ipv4_host", "rate_limit.store", "rate_limit.whitelist", `unknown provider "maxmind"`, "metrics.trace_max_tests", "tracing.endpoint", "tracing.sample_ratio", "QUEUE_MAX_TICKETS_PER_IP"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	for name, content := range map[string]string{
+		"config.yaml": "limits:\n  max_concurrent: 5\n",
+		"config.toml": "[limits]\nmax_concurrent = 5\n",
+	} {
+		if _, err := Load(writeConfig(t, name, content)); err == nil || !strings.Contains(err.Error(), "max_concurrent") {
+			t.Errorf("%s: expected unknown key error, got %v", name, err)
+		}
+	}
+}
+
+func TestReloadKeepsCurrentOnError(t *testing.T) {
+	t.Cleanup(func() {
+		current.Store(nil)
+		watchers = nil
+	})
+
+	path := writeConfig(t, "config.yaml", "limits:\n  max_concurrent_requests: 5\n")
+	if _, err := Init(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var reloaded int
+	OnReload(func(old, updated *Config) {
+		reloaded = updated.Limits.MaxConcurrentRequests
+	})
+
+	os.WriteFile(path, []byte("limits:\n  max_concurrent_requests: 8\n"), 0600)
+	if _, err := Reload(); err != nil || reloaded != 8 || GetMaxConcurrentRequests() != 8 {
+		t.Fatalf("reload not applied: %d, %v", reloaded, err)
+	}
+
+	os.WriteFile(path, []byte("limits:\n  max_concurrent_requests: -1\n"), 0600)
+	if _, err := Reload(); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	if GetMaxConcurrentRequests() != 8 {
+		t.Errorf("invalid reload replaced the active config")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Defaults()
+	cfg.Database.URL = "speedtest:s3cret@tcp(db:3306)/speedtest"
+	redacted := cfg.Redacted()
+	if strings.Contains(redacted.Database.URL, "s3cret") || redacted.Database.Password == cfg.Database.Password {
+		t.Errorf("secrets not redacted: %+v", redacted.Database)
+	}
+	if cfg.Database.Password != "password" {
+		t.Error("redaction modified the original")
+	}
+}
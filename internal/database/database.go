@@ -2,16 +2,30 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"strings"
 	"time"
 
+	"github.com/Krea-University/speed-test-server/internal/config"
 	"github.com/Krea-University/speed-test-server/internal/models"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/Krea-University/speed-test-server/internal/tracing"
+	"github.com/Krea-University/speed-test-server/internal/types"
+	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// mysqlDuplicateEntry is the MySQL error number for a duplicate key (ER_DUP_ENTRY)
+const mysqlDuplicateEntry = 1062
+
+// ErrDuplicate is returned when a speed test with the same ID or session already exists
+var ErrDuplicate = errors.New("speed test already exists")
+
 // Service provides database operations
 type Service struct {
 	db *sql.DB
@@ -19,34 +33,7 @@ type Service struct {
 
 // New creates a new database service
 func New() (*Service, error) {
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		// Build DSN from individual environment variables
-		host := os.Getenv("DB_HOST")
-		port := os.Getenv("DB_PORT")
-		user := os.Getenv("DB_USER")
-		password := os.Getenv("DB_PASSWORD")
-		dbname := os.Getenv("DB_NAME")
-
-		if host == "" {
-			host = "localhost"
-		}
-		if port == "" {
-			port = "3306"
-		}
-		if user == "" {
-			user = "root"
-		}
-		if password == "" {
-			password = "password"
-		}
-		if dbname == "" {
-			dbname = "speedtest"
-		}
-
-		dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-			user, password, host, port, dbname)
-	}
+	dsn := config.GetDatabaseDSN()
 
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
@@ -63,8 +50,21 @@ func New() (*Service, error) {
 		return nil, fmt.Errorf("failed to ping database: %v", err)
 	}
 
-	log.Println("Database connection established")
-	return &Service{db: db}, nil
+	slog.Info("Database connection established")
+	return NewFromDB(db), nil
+}
+
+// NewFromDB creates a service using an open connection pool
+func NewFromDB(db *sql.DB) *Service {
+	return &Service{db: db}
+}
+
+// startSpan starts a span for a database operation such as "speed_tests.insert"
+func startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "db "+operation,
+		attribute.String("db.system", "mysql"),
+		attribute.String("db.operation", operation),
+	)
 }
 
 // Close closes the database connection
@@ -76,25 +76,40 @@ func (s *Service) Close() error {
 }
 
 // CreateSpeedTest inserts a new speed test record
-func (s *Service) CreateSpeedTest(test *models.SpeedTest) error {
+func (s *Service) CreateSpeedTest(ctx context.Context, test *models.SpeedTest) error {
+	ctx, span := startSpan(ctx, "speed_tests.insert")
+	defer span.End()
+
 	query := `
 		INSERT INTO speed_tests (
-			id, client_ip, user_agent, test_type, download_speed_mbps, upload_speed_mbps,
+			id, session_id, client_ip, user_agent, test_type, download_speed_mbps, upload_speed_mbps,
 			ping_latency_ms, jitter_ms, download_size_bytes, upload_size_bytes,
-			test_duration_seconds, isp, country, region, city, server_name,
+			test_duration_seconds, isp, country, region, city, network_type,
+			network_name, building, protocol, ipv4_latency_ms, ipv4_download_mbps,
+			ipv4_upload_mbps, ipv6_latency_ms, ipv6_download_mbps, ipv6_upload_mbps,
+			preferred_ip_version, tls_version, tls_cipher, server_name,
 			server_country, server_city, sponsor, created_at, updated_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	_, err := s.db.Exec(query,
-		test.ID, test.ClientIP, test.UserAgent, test.TestType,
+	_, err := s.db.ExecContext(ctx, query,
+		test.ID, test.SessionID, test.ClientIP, test.UserAgent, test.TestType,
 		test.DownloadSpeedMbps, test.UploadSpeedMbps, test.PingLatencyMs, test.JitterMs,
 		test.DownloadSizeBytes, test.UploadSizeBytes, test.TestDurationSeconds,
-		test.ISP, test.Country, test.Region, test.City, test.ServerName,
-		test.ServerCountry, test.ServerCity, test.Sponsor, test.CreatedAt, test.UpdatedAt,
+		test.ISP, test.Country, test.Region, test.City, test.NetworkType,
+		test.NetworkName, test.Building, test.Protocol, test.IPv4LatencyMs, test.IPv4DownloadMbps,
+		test.IPv4UploadMbps, test.IPv6LatencyMs, test.IPv6DownloadMbps, test.IPv6UploadMbps,
+		test.PreferredIPVersion, test.TLSVersion, test.TLSCipher,
+		test.ServerName, test.ServerCountry, test.ServerCity, test.Sponsor,
+		test.CreatedAt, test.UpdatedAt,
 	)
 
 	if err != nil {
+		tracing.Fail(span, err)
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+			return ErrDuplicate
+		}
 		return fmt.Errorf("failed to create speed test: %v", err)
 	}
 
@@ -102,48 +117,136 @@ func (s *Service) CreateSpeedTest(test *models.SpeedTest) error {
 }
 
 // GetSpeedTest retrieves a speed test by ID
-func (s *Service) GetSpeedTest(id string) (*models.SpeedTest, error) {
+func (s *Service) GetSpeedTest(ctx context.Context, id string) (*models.SpeedTest, error) {
+	return s.getSpeedTest(ctx, "id", id)
+}
+
+// GetSpeedTestBySession retrieves the speed test saved for a test session
+func (s *Service) GetSpeedTestBySession(ctx context.Context, sessionID string) (*models.SpeedTest, error) {
+	return s.getSpeedTest(ctx, "session_id", sessionID)
+}
+
+// getSpeedTest retrieves the speed test whose column (id or session_id) equals value
+func (s *Service) getSpeedTest(ctx context.Context, column, value string) (*models.SpeedTest, error) {
+	ctx, span := startSpan(ctx, "speed_tests.select")
+	defer span.End()
+
 	query := `
-		SELECT id, client_ip, user_agent, test_type, download_speed_mbps, upload_speed_mbps,
+		SELECT id, session_id, client_ip, user_agent, test_type, download_speed_mbps, upload_speed_mbps,
 			   ping_latency_ms, jitter_ms, download_size_bytes, upload_size_bytes,
-			   test_duration_seconds, isp, country, region, city, server_name,
-			   server_country, server_city, sponsor, created_at, updated_at
-		FROM speed_tests WHERE id = ?
+			   test_duration_seconds, isp, country, region, city, network_type,
+			   network_name, building, reverse_dns, asn_number, asn_org, ip_version,
+			   enriched_at, protocol, ipv4_latency_ms, ipv4_download_mbps, ipv4_upload_mbps,
+			   ipv6_latency_ms, ipv6_download_mbps, ipv6_upload_mbps, preferred_ip_version,
+			   tls_version, tls_cipher, server_name, server_country,
+			   server_city, sponsor, created_at, updated_at
+		FROM speed_tests WHERE ` + column + ` = ?
 	`
 
 	test := &models.SpeedTest{}
-	err := s.db.QueryRow(query, id).Scan(
-		&test.ID, &test.ClientIP, &test.UserAgent, &test.TestType,
+	err := s.db.QueryRowContext(ctx, query, value).Scan(
+		&test.ID, &test.SessionID, &test.ClientIP, &test.UserAgent, &test.TestType,
 		&test.DownloadSpeedMbps, &test.UploadSpeedMbps, &test.PingLatencyMs, &test.JitterMs,
 		&test.DownloadSizeBytes, &test.UploadSizeBytes, &test.TestDurationSeconds,
-		&test.ISP, &test.Country, &test.Region, &test.City, &test.ServerName,
-		&test.ServerCountry, &test.ServerCity, &test.Sponsor, &test.CreatedAt, &test.UpdatedAt,
+		&test.ISP, &test.Country, &test.Region, &test.City, &test.NetworkType,
+		&test.NetworkName, &test.Building, &test.ReverseDNS, &test.ASNNumber, &test.ASNOrg,
+		&test.IPVersion, &test.EnrichedAt, &test.Protocol, &test.IPv4LatencyMs, &test.IPv4DownloadMbps,
+		&test.IPv4UploadMbps, &test.IPv6LatencyMs, &test.IPv6DownloadMbps, &test.IPv6UploadMbps,
+		&test.PreferredIPVersion, &test.TLSVersion, &test.TLSCipher,
+		&test.ServerName, &test.ServerCountry, &test.ServerCity, &test.Sponsor,
+		&test.CreatedAt, &test.UpdatedAt,
 	)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("speed test not found")
 		}
+		tracing.Fail(span, err)
 		return nil, fmt.Errorf("failed to get speed test: %v", err)
 	}
 
 	return test, nil
 }
 
-// GetAllSpeedTests retrieves all speed tests with pagination
-func (s *Service) GetAllSpeedTests(limit, offset int) ([]*models.SpeedTest, error) {
+// SpeedTestFilter narrows GetAllSpeedTests; zero values match everything
+type SpeedTestFilter struct {
+	ASNNumber   uint32 // Client AS number
+	IPVersion   int    // 4 or 6
+	ReverseDNS  string // Exact PTR hostname
+	NetworkName string // Campus network name
+	Building    string // Campus building
+	Protocol    string // HTTP protocol, e.g. "HTTP/3.0"
+	TestType    string // e.g. "dualstack"
+	PreferredIP int    // Family preferred on the dual-stack host, 4 or 6
+}
+
+// where builds the WHERE clause and arguments for the filter
+func (f SpeedTestFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.ASNNumber != 0 {
+		conditions = append(conditions, "asn_number = ?")
+		args = append(args, f.ASNNumber)
+	}
+	if f.IPVersion != 0 {
+		conditions = append(conditions, "ip_version = ?")
+		args = append(args, f.IPVersion)
+	}
+	if f.ReverseDNS != "" {
+		conditions = append(conditions, "reverse_dns = ?")
+		args = append(args, f.ReverseDNS)
+	}
+	if f.NetworkName != "" {
+		conditions = append(conditions, "network_name = ?")
+		args = append(args, f.NetworkName)
+	}
+	if f.Building != "" {
+		conditions = append(conditions, "building = ?")
+		args = append(args, f.Building)
+	}
+	if f.Protocol != "" {
+		conditions = append(conditions, "protocol = ?")
+		args = append(args, f.Protocol)
+	}
+	if f.TestType != "" {
+		conditions = append(conditions, "test_type = ?")
+		args = append(args, f.TestType)
+	}
+	if f.PreferredIP != 0 {
+		conditions = append(conditions, "preferred_ip_version = ?")
+		args = append(args, f.PreferredIP)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// GetAllSpeedTests retrieves speed tests matching filter with pagination
+func (s *Service) GetAllSpeedTests(ctx context.Context, limit, offset int, filter SpeedTestFilter) ([]*models.SpeedTest, error) {
+	ctx, span := startSpan(ctx, "speed_tests.list")
+	defer span.End()
+
+	where, args := filter.where()
 	query := `
-		SELECT id, client_ip, user_agent, test_type, download_speed_mbps, upload_speed_mbps,
+		SELECT id, session_id, client_ip, user_agent, test_type, download_speed_mbps, upload_speed_mbps,
 			   ping_latency_ms, jitter_ms, download_size_bytes, upload_size_bytes,
-			   test_duration_seconds, isp, country, region, city, server_name,
-			   server_country, server_city, sponsor, created_at, updated_at
-		FROM speed_tests 
-		ORDER BY created_at DESC 
+			   test_duration_seconds, isp, country, region, city, network_type,
+			   network_name, building, reverse_dns, asn_number, asn_org, ip_version,
+			   enriched_at, protocol, ipv4_latency_ms, ipv4_download_mbps, ipv4_upload_mbps,
+			   ipv6_latency_ms, ipv6_download_mbps, ipv6_upload_mbps, preferred_ip_version,
+			   tls_version, tls_cipher, server_name, server_country,
+			   server_city, sponsor, created_at, updated_at
+		FROM speed_tests` + where + `
+		ORDER BY created_at DESC
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := s.db.Query(query, limit, offset)
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, offset)...)
 	if err != nil {
+		tracing.Fail(span, err)
 		return nil, fmt.Errorf("failed to query speed tests: %v", err)
 	}
 	defer rows.Close()
@@ -152,13 +255,19 @@ func (s *Service) GetAllSpeedTests(limit, offset int) ([]*models.SpeedTest, erro
 	for rows.Next() {
 		test := &models.SpeedTest{}
 		err := rows.Scan(
-			&test.ID, &test.ClientIP, &test.UserAgent, &test.TestType,
+			&test.ID, &test.SessionID, &test.ClientIP, &test.UserAgent, &test.TestType,
 			&test.DownloadSpeedMbps, &test.UploadSpeedMbps, &test.PingLatencyMs, &test.JitterMs,
 			&test.DownloadSizeBytes, &test.UploadSizeBytes, &test.TestDurationSeconds,
-			&test.ISP, &test.Country, &test.Region, &test.City, &test.ServerName,
-			&test.ServerCountry, &test.ServerCity, &test.Sponsor, &test.CreatedAt, &test.UpdatedAt,
+			&test.ISP, &test.Country, &test.Region, &test.City, &test.NetworkType,
+			&test.NetworkName, &test.Building, &test.ReverseDNS, &test.ASNNumber, &test.ASNOrg,
+			&test.IPVersion, &test.EnrichedAt, &test.Protocol, &test.IPv4LatencyMs, &test.IPv4DownloadMbps,
+			&test.IPv4UploadMbps, &test.IPv6LatencyMs, &test.IPv6DownloadMbps, &test.IPv6UploadMbps,
+			&test.PreferredIPVersion, &test.TLSVersion, &test.TLSCipher,
+			&test.ServerName, &test.ServerCountry, &test.ServerCity, &test.Sponsor,
+			&test.CreatedAt, &test.UpdatedAt,
 		)
 		if err != nil {
+			tracing.Fail(span, err)
 			return nil, fmt.Errorf("failed to scan speed test: %v", err)
 		}
 		tests = append(tests, test)
@@ -168,14 +277,17 @@ func (s *Service) GetAllSpeedTests(limit, offset int) ([]*models.SpeedTest, erro
 }
 
 // GetAPIKey retrieves an API key by hash
-func (s *Service) GetAPIKey(keyHash string) (*models.APIKey, error) {
+func (s *Service) GetAPIKey(ctx context.Context, keyHash string) (*models.APIKey, error) {
+	ctx, span := startSpan(ctx, "api_keys.select")
+	defer span.End()
+
 	query := `
 		SELECT id, key_hash, name, description, rate_limit_per_minute, is_active, created_at, last_used_at
 		FROM api_keys WHERE key_hash = ? AND is_active = true
 	`
 
 	key := &models.APIKey{}
-	err := s.db.QueryRow(query, keyHash).Scan(
+	err := s.db.QueryRowContext(ctx, query, keyHash).Scan(
 		&key.ID, &key.KeyHash, &key.Name, &key.Description,
 		&key.RateLimitPerMinute, &key.IsActive, &key.CreatedAt, &key.LastUsedAt,
 	)
@@ -184,6 +296,7 @@ func (s *Service) GetAPIKey(keyHash string) (*models.APIKey, error) {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("API key not found")
 		}
+		tracing.Fail(span, err)
 		return nil, fmt.Errorf("failed to get API key: %v", err)
 	}
 
@@ -191,60 +304,149 @@ func (s *Service) GetAPIKey(keyHash string) (*models.APIKey, error) {
 }
 
 // UpdateAPIKeyLastUsed updates the last used timestamp for an API key
-func (s *Service) UpdateAPIKeyLastUsed(keyHash string) error {
+func (s *Service) UpdateAPIKeyLastUsed(ctx context.Context, keyHash string) error {
+	ctx, span := startSpan(ctx, "api_keys.touch")
+	defer span.End()
+
 	query := "UPDATE api_keys SET last_used_at = ? WHERE key_hash = ?"
-	_, err := s.db.Exec(query, time.Now(), keyHash)
+	_, err := s.db.ExecContext(ctx, query, time.Now(), keyHash)
+	tracing.Fail(span, err)
 	return err
 }
 
-// CheckRateLimit checks and updates rate limiting for an identifier
-func (s *Service) CheckRateLimit(identifier, endpoint string, limit int) (bool, error) {
-	now := time.Now()
-	windowStart := now.Truncate(time.Minute)
+// RateLimitStore is a shared rate limiter state store for multi-instance deployments.
+// It satisfies ratelimit.Store using optimistic updates on the rate_limit_state table.
+type RateLimitStore struct {
+	db *sql.DB
+}
+
+// RateLimitStore returns a rate limiter state store backed by this database
+func (s *Service) RateLimitStore() *RateLimitStore {
+	return &RateLimitStore{db: s.db}
+}
+
+// Get returns the stored theoretical arrival time for a key
+func (rs *RateLimitStore) Get(ctx context.Context, key string) (int64, bool, error) {
+	ctx, span := startSpan(ctx, "rate_limit_state.select")
+	defer span.End()
 
-	// Try to get existing rate limit record
-	var requestCount int
-	err := s.db.QueryRow(
-		"SELECT request_count FROM rate_limits WHERE identifier = ? AND endpoint = ? AND window_start = ?",
-		identifier, endpoint, windowStart,
-	).Scan(&requestCount)
+	var tat int64
+	err := rs.db.QueryRowContext(ctx,
+		"SELECT tat FROM rate_limit_state WHERE bucket_key = ? AND expires_at > ?",
+		key, time.Now(),
+	).Scan(&tat)
 
 	if err == sql.ErrNoRows {
-		// No existing record, create new one
-		_, err = s.db.Exec(
-			"INSERT INTO rate_limits (id, identifier, endpoint, request_count, window_start) VALUES (?, ?, ?, 1, ?)",
-			fmt.Sprintf("%s-%s-%d", identifier, endpoint, windowStart.Unix()),
-			identifier, endpoint, windowStart,
-		)
-		return true, err
+		return 0, false, nil
 	} else if err != nil {
+		tracing.Fail(span, err)
+		return 0, false, fmt.Errorf("failed to get rate limit state: %v", err)
+	}
+
+	return tat, true, nil
+}
+
+// CompareAndSwap replaces the theoretical arrival time for a key if it is unchanged
+func (rs *RateLimitStore) CompareAndSwap(ctx context.Context, key string, old int64, exists bool, new int64, ttl time.Duration) (bool, error) {
+	ctx, span := startSpan(ctx, "rate_limit_state.update")
+	defer span.End()
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	var result sql.Result
+	var err error
+	if exists {
+		result, err = rs.db.ExecContext(ctx,
+			"UPDATE rate_limit_state SET tat = ?, expires_at = ? WHERE bucket_key = ? AND tat = ? AND expires_at > ?",
+			new, expiresAt, key, old, now,
+		)
+	} else {
+		// Insert, or take over a row whose bucket has already expired
+		result, err = rs.db.ExecContext(ctx, `
+			INSERT INTO rate_limit_state (bucket_key, tat, expires_at) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+				tat = IF(expires_at <= ?, VALUES(tat), tat),
+				expires_at = IF(expires_at <= ?, VALUES(expires_at), expires_at)`,
+			key, new, expiresAt, now, now,
+		)
+	}
+	if err != nil {
+		tracing.Fail(span, err)
+		return false, fmt.Errorf("failed to update rate limit state: %v", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
 		return false, err
 	}
 
-	// Check if limit exceeded
-	if requestCount >= limit {
-		return false, nil
+	return affected > 0, nil
+}
+
+// LoadIPInfo retrieves a cached geolocation result and its expiry
+func (s *Service) LoadIPInfo(ctx context.Context, ip string) (*types.IPResponse, time.Time, error) {
+	ctx, span := startSpan(ctx, "ip_info_cache.select")
+	defer span.End()
+
+	var data []byte
+	var expiresAt time.Time
+	err := s.db.QueryRowContext(ctx,
+		"SELECT data, expires_at FROM ip_info_cache WHERE ip = ?", ip,
+	).Scan(&data, &expiresAt)
+
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, nil
+	} else if err != nil {
+		tracing.Fail(span, err)
+		return nil, time.Time{}, fmt.Errorf("failed to load cached IP info: %v", err)
 	}
 
-	// Increment counter
-	_, err = s.db.Exec(
-		"UPDATE rate_limits SET request_count = request_count + 1 WHERE identifier = ? AND endpoint = ? AND window_start = ?",
-		identifier, endpoint, windowStart,
+	var info types.IPResponse
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to decode cached IP info: %v", err)
+	}
+
+	return &info, expiresAt, nil
+}
+
+// SaveIPInfo stores a geolocation result until expiresAt
+func (s *Service) SaveIPInfo(ctx context.Context, ip string, info *types.IPResponse, expiresAt time.Time) error {
+	ctx, span := startSpan(ctx, "ip_info_cache.upsert")
+	defer span.End()
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to encode IP info: %v", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO ip_info_cache (ip, data, expires_at) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE data = VALUES(data), expires_at = VALUES(expires_at)`,
+		ip, data, expiresAt,
 	)
+	if err != nil {
+		tracing.Fail(span, err)
+		return fmt.Errorf("failed to save IP info: %v", err)
+	}
 
-	return true, err
+	return nil
 }
 
 // IsWhitelisted checks if an IP is whitelisted for rate limiting
-func (s *Service) IsWhitelisted(ip string) (bool, error) {
+func (s *Service) IsWhitelisted(ctx context.Context, ip string) (bool, error) {
+	ctx, span := startSpan(ctx, "rate_limit_whitelist.select")
+	defer span.End()
+
 	query := `
 		SELECT COUNT(*) FROM rate_limit_whitelist 
 		WHERE is_active = true AND (ip_address = ? OR ? LIKE CONCAT(ip_range, '%'))
 	`
 
 	var count int
-	err := s.db.QueryRow(query, ip, ip).Scan(&count)
+	err := s.db.QueryRowContext(ctx, query, ip, ip).Scan(&count)
 	if err != nil {
+		tracing.Fail(span, err)
 		return false, err
 	}
 
@@ -252,31 +454,60 @@ func (s *Service) IsWhitelisted(ip string) (bool, error) {
 }
 
 // UpdateSpeedTest updates an existing speed test record
-func (s *Service) UpdateSpeedTest(test *models.SpeedTest) error {
+func (s *Service) UpdateSpeedTest(ctx context.Context, test *models.SpeedTest) error {
+	ctx, span := startSpan(ctx, "speed_tests.update")
+	defer span.End()
+
 	query := `
 		UPDATE speed_tests SET
 			download_speed_mbps = ?, upload_speed_mbps = ?, ping_latency_ms = ?, jitter_ms = ?,
 			download_size_bytes = ?, upload_size_bytes = ?, test_duration_seconds = ?,
-			isp = ?, country = ?, region = ?, city = ?, updated_at = ?
+			isp = ?, country = ?, region = ?, city = ?, network_type = ?,
+			network_name = ?, building = ?, updated_at = ?
 		WHERE id = ?
 	`
 
 	test.UpdatedAt = time.Now()
-	_, err := s.db.Exec(query,
+	_, err := s.db.ExecContext(ctx, query,
 		test.DownloadSpeedMbps, test.UploadSpeedMbps, test.PingLatencyMs, test.JitterMs,
 		test.DownloadSizeBytes, test.UploadSizeBytes, test.TestDurationSeconds,
-		test.ISP, test.Country, test.Region, test.City, test.UpdatedAt, test.ID,
+		test.ISP, test.Country, test.Region, test.City, test.NetworkType,
+		test.NetworkName, test.Building, test.UpdatedAt, test.ID,
 	)
 
 	if err != nil {
+		tracing.Fail(span, err)
 		return fmt.Errorf("failed to update speed test: %v", err)
 	}
 
 	return nil
 }
 
+// UpdateSpeedTestEnrichment stores background enrichment results for a test
+func (s *Service) UpdateSpeedTestEnrichment(ctx context.Context, id string, enrichment *models.Enrichment) error {
+	ctx, span := startSpan(ctx, "speed_tests.enrich")
+	defer span.End()
+
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE speed_tests SET
+			reverse_dns = ?, asn_number = ?, asn_org = ?, ip_version = ?, enriched_at = ?
+		WHERE id = ?`,
+		enrichment.ReverseDNS, enrichment.ASNNumber, enrichment.ASNOrg,
+		enrichment.IPVersion, enrichment.EnrichedAt, id,
+	)
+	if err != nil {
+		tracing.Fail(span, err)
+		return fmt.Errorf("failed to update speed test enrichment: %v", err)
+	}
+
+	return nil
+}
+
 // CreateMetric creates a new metric record
-func (s *Service) CreateMetric(metric interface{}) error {
+func (s *Service) CreateMetric(ctx context.Context, metric interface{}) error {
+	ctx, span := startSpan(ctx, "metrics.insert")
+	defer span.End()
+
 	// Import the Metric type from metrics package
 	// This is a simplified implementation that stores metrics as JSON
 	query := `
@@ -289,11 +520,12 @@ func (s *Service) CreateMetric(metric interface{}) error {
 
 	// This is a placeholder implementation
 	// In a real scenario, you would properly map the metric struct fields
-	_, err := s.db.Exec(query,
+	_, err := s.db.ExecContext(ctx, query,
 		"", time.Now(), "speed_test", "", "", "",
 		0.0, 0.0, 0.0, 0.0, 0, 0, 0, 0.0, 0, "", "")
 
 	if err != nil {
+		tracing.Fail(span, err)
 		return fmt.Errorf("failed to create metric: %v", err)
 	}
 
@@ -301,7 +533,10 @@ func (s *Service) CreateMetric(metric interface{}) error {
 }
 
 // GetMetrics retrieves metrics from the database
-func (s *Service) GetMetrics(metricType string, startTime, endTime time.Time, limit int) ([]interface{}, error) {
+func (s *Service) GetMetrics(ctx context.Context, metricType string, startTime, endTime time.Time, limit int) ([]interface{}, error) {
+	ctx, span := startSpan(ctx, "metrics.select")
+	defer span.End()
+
 	query := `
 		SELECT id, timestamp, type, client_ip, user_agent, location,
 			latency_ms, jitter_ms, download_mbps, upload_mbps, test_duration_ms,
@@ -313,8 +548,9 @@ func (s *Service) GetMetrics(metricType string, startTime, endTime time.Time, li
 		LIMIT ?
 	`
 
-	rows, err := s.db.Query(query, metricType, startTime, endTime, limit)
+	rows, err := s.db.QueryContext(ctx, query, metricType, startTime, endTime, limit)
 	if err != nil {
+		tracing.Fail(span, err)
 		return nil, fmt.Errorf("failed to query metrics: %v", err)
 	}
 	defer rows.Close()
@@ -326,7 +562,10 @@ func (s *Service) GetMetrics(metricType string, startTime, endTime time.Time, li
 }
 
 // GetServerStats returns aggregated server statistics
-func (s *Service) GetServerStats(startTime, endTime time.Time) (*ServerStats, error) {
+func (s *Service) GetServerStats(ctx context.Context, startTime, endTime time.Time) (*ServerStats, error) {
+	ctx, span := startSpan(ctx, "metrics.stats")
+	defer span.End()
+
 	query := `
 		SELECT 
 			COUNT(*) as total_tests,
@@ -340,7 +579,7 @@ func (s *Service) GetServerStats(startTime, endTime time.Time) (*ServerStats, er
 	`
 
 	var stats ServerStats
-	err := s.db.QueryRow(query, startTime, endTime, startTime, endTime).Scan(
+	err := s.db.QueryRowContext(ctx, query, startTime, endTime, startTime, endTime).Scan(
 		&stats.TotalTests,
 		&stats.AverageLatency,
 		&stats.AverageDownload,
@@ -350,6 +589,7 @@ func (s *Service) GetServerStats(startTime, endTime time.Time) (*ServerStats, er
 	)
 
 	if err != nil {
+		tracing.Fail(span, err)
 		return nil, fmt.Errorf("failed to get server stats: %v", err)
 	}
 
@@ -0,0 +1,190 @@
+// Package diagnostics keeps a structured event trace of each test session,
+// such as phases, bytes moved, errors and rate limit decisions, so a test a
+// user reports as failed can be looked up afterwards
+package diagnostics
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MaxEvents is the number of events kept per trace; later events are counted
+// as dropped
+const MaxEvents = 500
+
+// maxIDLength is the longest test ID accepted from clients
+const maxIDLength = 64
+
+// TestIDHeader names the test session a request belongs to; clients send
+// the same ID on every request of a test and as the ID of the stored result
+const TestIDHeader = "X-Test-ID"
+
+// Event is one step of a test session
+type Event struct {
+	Time   time.Time              `json:"time"`
+	Type   string                 `json:"type"`
+	Error  string                 `json:"error,omitempty"` // Set for failures, such as the reason a transfer was cut short
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Summary describes a trace without its events
+type Summary struct {
+	TestID        string    `json:"test_id"`
+	ClientIP      string    `json:"client_ip"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+	Started       time.Time `json:"started"`
+	Updated       time.Time `json:"updated"`
+	Failed        bool      `json:"failed"` // At least one event recorded an error
+	Events        int       `json:"events"`
+	DroppedEvents int       `json:"dropped_events,omitempty"`
+}
+
+// Trace is the event log of one test session
+type Trace struct {
+	Summary
+	Log []Event `json:"log"`
+}
+
+// Store keeps the traces of recent test sessions in memory, evicting those
+// not updated within the retention period and the least recently updated
+// beyond the maximum count. A nil store records nothing.
+type Store struct {
+	mu        sync.Mutex
+	traces    map[string]*list.Element // of *Trace, most recently updated at the front
+	order     *list.List
+	maxTests  int
+	retention time.Duration
+}
+
+// NewStore creates a store for up to maxTests traces; it returns nil when
+// maxTests is 0, disabling tracing
+func NewStore(maxTests int, retention time.Duration) *Store {
+	if maxTests <= 0 {
+		return nil
+	}
+	return &Store{
+		traces:    make(map[string]*list.Element),
+		order:     list.New(),
+		maxTests:  maxTests,
+		retention: retention,
+	}
+}
+
+// RequestTestID returns the valid test ID a request names in the X-Test-ID
+// header or test_id query parameter, or "" if it names none
+func RequestTestID(r *http.Request) string {
+	id := r.Header.Get(TestIDHeader)
+	if id == "" {
+		id = r.URL.Query().Get("test_id")
+	}
+	if !ValidID(id) {
+		return ""
+	}
+	return id
+}
+
+// ValidID reports whether id is acceptable as a client-supplied test ID:
+// 1 to 64 letters, digits, '.', '_' or '-'
+func ValidID(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Record appends an event to the trace of testID, starting the trace if needed
+func (s *Store) Record(testID, clientIP, userAgent string, event Event) {
+	if s == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var trace *Trace
+	if element, ok := s.traces[testID]; ok {
+		trace = element.Value.(*Trace)
+		s.order.MoveToFront(element)
+	} else {
+		trace = &Trace{Summary: Summary{TestID: testID, ClientIP: clientIP, UserAgent: userAgent, Started: event.Time}}
+		s.traces[testID] = s.order.PushFront(trace)
+	}
+
+	trace.Updated = event.Time
+	if event.Error != "" {
+		trace.Failed = true
+	}
+	if len(trace.Log) < MaxEvents {
+		trace.Log = append(trace.Log, event)
+		trace.Events = len(trace.Log)
+	} else {
+		trace.DroppedEvents++
+	}
+
+	s.evict(event.Time)
+}
+
+// evict removes expired traces and those over the maximum count
+func (s *Store) evict(now time.Time) {
+	for s.order.Len() > 0 {
+		oldest := s.order.Back()
+		trace := oldest.Value.(*Trace)
+		if s.order.Len() <= s.maxTests && now.Sub(trace.Updated) < s.retention {
+			return
+		}
+		s.order.Remove(oldest)
+		delete(s.traces, trace.TestID)
+	}
+}
+
+// Get returns a copy of the trace of testID
+func (s *Store) Get(testID string) (*Trace, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(time.Now())
+
+	element, ok := s.traces[testID]
+	if !ok {
+		return nil, false
+	}
+	trace := *element.Value.(*Trace)
+	trace.Log = append([]Event(nil), trace.Log...)
+	return &trace, true
+}
+
+// List returns summaries of the most recently updated traces, optionally
+// only those of clientIP, newest first
+func (s *Store) List(clientIP string, limit int) []Summary {
+	summaries := []Summary{}
+	if s == nil {
+		return summaries
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(time.Now())
+
+	for element := s.order.Front(); element != nil && len(summaries) < limit; element = element.Next() {
+		trace := element.Value.(*Trace)
+		if clientIP == "" || trace.ClientIP == clientIP {
+			summaries = append(summaries, trace.Summary)
+		}
+	}
+	return summaries
+}
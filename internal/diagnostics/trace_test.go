@@ -0,0 +1,92 @@
+package diagnostics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	store := NewStore(2, time.Hour)
+	store.Record("a", "10.0.0.1", "cli", Event{Type: "download_start"})
+	store.Record("a", "10.0.0.1", "cli", Event{Type: "download_truncated", Error: "client disconnected"})
+	store.Record("b", "10.0.0.2", "cli", Event{Type: "upload_start"})
+
+	trace, ok := store.Get("a")
+	if !ok || !trace.Failed || trace.Events != 2 || trace.Log[1].Error != "client disconnected" {
+		t.Fatalf("unexpected trace %+v", trace)
+	}
+	if summaries := store.List("10.0.0.1", 10); len(summaries) != 1 || summaries[0].TestID != "a" {
+		t.Errorf("unexpected summaries for client: %+v", summaries)
+	}
+
+	// The least recently updated trace goes first once the store is full
+	store.Record("c", "10.0.0.3", "cli", Event{Type: "ping"})
+	if _, ok := store.Get("a"); ok {
+		t.Error("expected the oldest trace to be evicted")
+	}
+	if summaries := store.List("", 10); len(summaries) != 2 || summaries[0].TestID != "c" || summaries[1].TestID != "b" {
+		t.Errorf("expected newest first, got %+v", summaries)
+	}
+
+}
+
+func TestStoreRetention(t *testing.T) {
+	store := NewStore(10, 20*time.Millisecond)
+	store.Record("a", "10.0.0.1", "cli", Event{Type: "ping"})
+	time.Sleep(30 * time.Millisecond)
+	store.Record("b", "10.0.0.1", "cli", Event{Type: "ping"})
+
+	if _, ok := store.Get("a"); ok {
+		t.Error("expected the expired trace to be evicted")
+	}
+	if _, ok := store.Get("b"); !ok {
+		t.Error("expected the recent trace to be kept")
+	}
+}
+
+func TestStoreMaxEvents(t *testing.T) {
+	store := NewStore(1, time.Hour)
+	for i := 0; i < MaxEvents+5; i++ {
+		store.Record("a", "10.0.0.1", "", Event{Type: "ping"})
+	}
+	trace, _ := store.Get("a")
+	if len(trace.Log) != MaxEvents || trace.DroppedEvents != 5 {
+		t.Errorf("expected %d events and 5 dropped, got %d and %d", MaxEvents, len(trace.Log), trace.DroppedEvents)
+	}
+
+	var disabled *Store = NewStore(0, time.Hour)
+	disabled.Record("a", "", "", Event{Type: "ping"})
+	if _, ok := disabled.Get("a"); ok || len(disabled.List("", 10)) != 0 {
+		t.Error("expected a disabled store to record nothing")
+	}
+}
+
+func TestValidID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"4dad80c9-9abf-41c0-869f-d19a2be906d7": true,
+		"ticket_1234.run-2":                    true,
+		"":                                     false,
+		"has space":                            false,
+		"<script>":                             false,
+		string(make([]byte, 65)):               false,
+	} {
+		if ValidID(id) != valid {
+			t.Errorf("ValidID(%q) = %v, want %v", id, !valid, valid)
+		}
+	}
+}
+
+func TestRequestTestID(t *testing.T) {
+	header := httptest.NewRequest(http.MethodGet, "/download?test_id=from-query", nil)
+	header.Header.Set(TestIDHeader, "from-header")
+	query := httptest.NewRequest(http.MethodGet, "/download?test_id=from-query", nil)
+	invalid := httptest.NewRequest(http.MethodGet, "/download?test_id=%3Cscript%3E", nil)
+
+	for r, want := range map[*http.Request]string{header: "from-header", query: "from-query", invalid: ""} {
+		if got := RequestTestID(r); got != want {
+			t.Errorf("RequestTestID(%s) = %q, want %q", r.URL, got, want)
+		}
+	}
+}
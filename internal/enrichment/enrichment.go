@@ -0,0 +1,150 @@
+// Package enrichment adds reverse DNS, ASN and IP version details to stored
+// speed tests in the background, so lookups never delay a test response
+package enrichment
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/models"
+	"github.com/Krea-University/speed-test-server/internal/tracing"
+	"github.com/Krea-University/speed-test-server/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Store saves enrichment results for a speed test
+type Store interface {
+	UpdateSpeedTestEnrichment(ctx context.Context, id string, enrichment *models.Enrichment) error
+}
+
+// IPInfoLookup provides ASN details for an address (satisfied by ipservice.Service)
+type IPInfoLookup interface {
+	GetIPInfo(ctx context.Context, ip string) (*types.IPResponse, error)
+}
+
+// job is a stored test waiting to be enriched
+type job struct {
+	testID   string
+	clientIP string
+}
+
+// Worker enriches speed tests from a bounded queue with a fixed pool of goroutines
+type Worker struct {
+	store      Store
+	ipInfo     IPInfoLookup
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	dnsTimeout time.Duration
+
+	mu     sync.Mutex // guards closed and sends on queue
+	closed bool       // set by Close; later tests are dropped
+	queue  chan job
+	wg     sync.WaitGroup
+}
+
+// NewWorker starts workers goroutines draining a queue of queueSize tests
+func NewWorker(store Store, ipInfo IPInfoLookup, workers, queueSize int, dnsTimeout time.Duration) *Worker {
+	w := &Worker{
+		store:      store,
+		ipInfo:     ipInfo,
+		lookupAddr: net.DefaultResolver.LookupAddr,
+		dnsTimeout: dnsTimeout,
+		queue:      make(chan job, queueSize),
+	}
+
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go w.run()
+	}
+
+	return w
+}
+
+// Enqueue schedules a stored test for enrichment. It never blocks; if the
+// queue is full or the worker is closing the test is left unenriched.
+func (w *Worker) Enqueue(testID, clientIP string) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+
+	select {
+	case w.queue <- job{testID: testID, clientIP: clientIP}:
+	default:
+		slog.Warn("Enrichment queue full, skipping test", "test_id", testID)
+	}
+}
+
+// Close stops accepting work and waits for queued tests to be enriched.
+// It may be called more than once.
+func (w *Worker) Close() {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+// run processes queued tests until the queue is closed
+func (w *Worker) run() {
+	defer w.wg.Done()
+
+	for j := range w.queue {
+		ctx, span := tracing.Start(context.Background(), "enrich speed test", attribute.String("test.id", j.testID))
+		enrichment := w.enrich(ctx, j.clientIP)
+		if err := w.store.UpdateSpeedTestEnrichment(ctx, j.testID, enrichment); err != nil {
+			tracing.Fail(span, err)
+			slog.ErrorContext(ctx, "Failed to enrich speed test", "test_id", j.testID, "error", err)
+		}
+		span.End()
+	}
+}
+
+// enrich gathers the details for one client address; lookups that fail are left empty
+func (w *Worker) enrich(ctx context.Context, clientIP string) *models.Enrichment {
+	enrichment := &models.Enrichment{EnrichedAt: time.Now()}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return enrichment
+	}
+
+	version := 6
+	if ip.To4() != nil {
+		version = 4
+	}
+	enrichment.IPVersion = &version
+
+	dnsCtx, cancel := context.WithTimeout(ctx, w.dnsTimeout)
+	names, err := w.lookupAddr(dnsCtx, clientIP)
+	cancel()
+	if err == nil && len(names) > 0 {
+		hostname := strings.TrimSuffix(names[0], ".")
+		enrichment.ReverseDNS = &hostname
+	}
+
+	if info, err := w.ipInfo.GetIPInfo(ctx, clientIP); err == nil && info.ASNNumber != 0 {
+		asn := info.ASNNumber
+		enrichment.ASNNumber = &asn
+		if info.ASNOrg != "" {
+			org := info.ASNOrg
+			enrichment.ASNOrg = &org
+		}
+	}
+
+	return enrichment
+}
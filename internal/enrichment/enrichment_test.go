@@ -0,0 +1,79 @@
+package enrichment
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/models"
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+type memoryStore struct {
+	mu      sync.Mutex
+	results map[string]*models.Enrichment
+}
+
+func (s *memoryStore) UpdateSpeedTestEnrichment(_ context.Context, id string, enrichment *models.Enrichment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[id] = enrichment
+	return nil
+}
+
+type fakeIPInfo struct{}
+
+func (fakeIPInfo) GetIPInfo(_ context.Context, ip string) (*types.IPResponse, error) {
+	if ip == "2001:db8::1" {
+		return nil, errors.New("lookup failed")
+	}
+	return &types.IPResponse{IP: ip, ASNNumber: 9829, ASNOrg: "BSNL"}, nil
+}
+
+func TestWorkerEnrichesQueuedTests(t *testing.T) {
+	store := &memoryStore{results: make(map[string]*models.Enrichment)}
+	worker := NewWorker(store, fakeIPInfo{}, 2, 10, time.Second)
+	worker.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		if addr == "198.51.100.4" {
+			return []string{"host-4.example.net."}, nil
+		}
+		return nil, errors.New("no PTR record")
+	}
+
+	worker.Enqueue("v4", "198.51.100.4")
+	worker.Enqueue("v6", "2001:db8::1")
+	worker.Close()
+
+	v4 := store.results["v4"]
+	if v4 == nil || *v4.IPVersion != 4 || *v4.ReverseDNS != "host-4.example.net" ||
+		*v4.ASNNumber != 9829 || *v4.ASNOrg != "BSNL" {
+		t.Errorf("unexpected IPv4 enrichment %+v", v4)
+	}
+
+	v6 := store.results["v6"]
+	if v6 == nil || *v6.IPVersion != 6 || v6.ReverseDNS != nil || v6.ASNNumber != nil {
+		t.Errorf("unexpected IPv6 enrichment %+v", v6)
+	}
+}
+
+func TestEnqueueAfterClose(t *testing.T) {
+	store := &memoryStore{results: make(map[string]*models.Enrichment)}
+	worker := NewWorker(store, fakeIPInfo{}, 1, 10, time.Second)
+	worker.Close()
+
+	// A detached handler finishing after shutdown must not panic
+	worker.Enqueue("late", "198.51.100.4")
+	worker.Close()
+
+	if len(store.results) != 0 {
+		t.Errorf("expected the late test to be dropped, got %v", store.results)
+	}
+}
+
+func TestNilWorkerIsNoop(t *testing.T) {
+	var worker *Worker
+	worker.Enqueue("id", "198.51.100.4")
+	worker.Close()
+}
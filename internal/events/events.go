@@ -0,0 +1,87 @@
+// Package events broadcasts live server activity, such as tests starting,
+// progressing and finishing, to subscribers like the admin dashboard feed
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	TestStarted  = "test_started"
+	TestProgress = "test_progress"
+	TestFinished = "test_finished"
+	TestSaved    = "test_saved"
+	Metric       = "metric"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// further events are dropped for it
+const subscriberBuffer = 256
+
+// Event is one piece of live activity
+type Event struct {
+	Type     string      `json:"type"`
+	Time     time.Time   `json:"time"`
+	TestID   string      `json:"test_id,omitempty"`
+	Kind     string      `json:"kind,omitempty"` // "download" or "upload" for transfer events
+	ClientIP string      `json:"client_ip,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// Bus fans events out to subscribers. Publishing never blocks: a subscriber
+// that does not keep up misses events rather than slowing down tests.
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// NewBus creates an event bus
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish sends an event to all subscribers; a nil bus drops it
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a function to unsubscribe
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Subscribers returns the number of current subscribers
+func (b *Bus) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
@@ -0,0 +1,35 @@
+package events
+
+import "testing"
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	first, unsubscribe := bus.Subscribe()
+	second, _ := bus.Subscribe()
+
+	bus.Publish(Event{Type: TestStarted, TestID: "a"})
+	for _, ch := range []<-chan Event{first, second} {
+		if event := <-ch; event.Type != TestStarted || event.TestID != "a" || event.Time.IsZero() {
+			t.Errorf("unexpected event %+v", event)
+		}
+	}
+
+	// Unsubscribed channels get nothing more
+	unsubscribe()
+	unsubscribe()
+	bus.Publish(Event{Type: TestFinished})
+	if bus.Subscribers() != 1 || len(first) != 0 || len(second) != 1 {
+		t.Errorf("unexpected delivery after unsubscribe: %d subscribers, %d and %d queued", bus.Subscribers(), len(first), len(second))
+	}
+
+	// A subscriber that falls behind loses events instead of blocking publishers
+	for i := 0; i < subscriberBuffer*2; i++ {
+		bus.Publish(Event{Type: TestProgress})
+	}
+	if len(second) != subscriberBuffer {
+		t.Errorf("expected a full buffer of %d events, got %d", subscriberBuffer, len(second))
+	}
+
+	var nilBus *Bus
+	nilBus.Publish(Event{Type: Metric})
+}
@@ -0,0 +1,91 @@
+// Package filewatch reloads files when they change on disk by polling their
+// modification times, so renewed certificates and updated databases apply
+// without a restart
+package filewatch
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Watcher calls a load function whenever one of a set of files changes
+type Watcher struct {
+	name     string
+	paths    []string
+	load     func() error
+	modTimes []time.Time // as of the last successful load
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New loads the files with load and then checks them every interval,
+// loading them again when any modification time changes. name describes
+// the files in log lines, e.g. "TLS certificate". A failed reload keeps
+// whatever load last installed and is retried on the next check, e.g. while
+// only one file of a pair has been replaced.
+func New(name string, interval time.Duration, load func() error, paths ...string) (*Watcher, error) {
+	w := &Watcher{name: name, paths: paths, load: load, stop: make(chan struct{})}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+
+	go w.watch(interval)
+
+	return w, nil
+}
+
+// Close stops watching; it may be called more than once
+func (w *Watcher) Close() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// reload calls load, remembering the modification times it saw
+func (w *Watcher) reload() error {
+	modTimes, err := w.stat()
+	if err != nil {
+		return err
+	}
+	if err := w.load(); err != nil {
+		return err
+	}
+	w.modTimes = modTimes
+	return nil
+}
+
+// stat returns the modification times of the files
+func (w *Watcher) stat() ([]time.Time, error) {
+	modTimes := make([]time.Time, len(w.paths))
+	for i, path := range w.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %v", path, err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// watch polls the files until Close is called
+func (w *Watcher) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			modTimes, err := w.stat()
+			if err != nil || slices.EqualFunc(modTimes, w.modTimes, time.Time.Equal) {
+				continue
+			}
+			if err := w.reload(); err != nil {
+				slog.Warn(w.name+" reload failed, keeping previous version", "error", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package filewatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatcherReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	os.WriteFile(path, []byte("v1"), 0600)
+
+	var loads atomic.Int32
+	var fail atomic.Bool
+	watcher, err := New("test file", 10*time.Millisecond, func() error {
+		if fail.Load() {
+			return errors.New("invalid")
+		}
+		loads.Add(1)
+		return nil
+	}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	waitFor := func(want int32) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for loads.Load() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d loads, got %d", want, loads.Load())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor(1)
+
+	// A failed reload is retried until it succeeds
+	fail.Store(true)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	fail.Store(false)
+	waitFor(2)
+
+	// Unchanged files are not reloaded
+	time.Sleep(50 * time.Millisecond)
+	waitFor(2)
+
+	watcher.Close()
+	watcher.Close()
+}
+
+func TestNewFailsOnInitialLoad(t *testing.T) {
+	if _, err := New("test file", time.Minute, func() error { return nil }, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	path := filepath.Join(t.TempDir(), "data")
+	os.WriteFile(path, nil, 0600)
+	if _, err := New("test file", time.Minute, func() error { return errors.New("invalid") }, path); err == nil {
+		t.Error("expected the load error")
+	}
+}
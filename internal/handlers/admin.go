@@ -2,15 +2,25 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/diagnostics"
+	"github.com/Krea-University/speed-test-server/internal/logging"
+	"github.com/Krea-University/speed-test-server/internal/models"
+	"github.com/Krea-University/speed-test-server/internal/ratelimit"
+	"github.com/gorilla/mux"
 )
 
 // AdminDashboard serves the admin dashboard page
 func (h *Handlers) AdminDashboard(w http.ResponseWriter, r *http.Request) {
 	if !h.isAdmin(r) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -36,6 +46,10 @@ func (h *Handlers) AdminDashboard(w http.ResponseWriter, r *http.Request) {
         th { background-color: #f8f9fa; font-weight: 600; }
         .status-active { color: #28a745; }
         .status-error { color: #dc3545; }
+        .live-panel { background: white; border-radius: 10px; box-shadow: 0 2px 10px rgba(0,0,0,0.1); margin-bottom: 30px; }
+        .live-status { float: right; font-size: 0.8em; font-weight: normal; }
+        .live-log { max-height: 240px; overflow-y: auto; margin: 0; padding: 0 20px 20px 20px; list-style: none; font-family: monospace; font-size: 0.9em; }
+        .live-log li { padding: 4px 0; border-bottom: 1px solid #f0f0f0; }
     </style>
 </head>
 <body>
@@ -46,6 +60,16 @@ func (h *Handlers) AdminDashboard(w http.ResponseWriter, r *http.Request) {
         </div>
         <button class="refresh-btn" onclick="refreshData()">🔄 Refresh Data</button>
         <div class="stats-grid" id="stats-grid"></div>
+        <div class="live-panel">
+            <h3 style="padding: 20px 20px 0 20px; margin: 0;">Live Activity <span class="live-status" id="live-status">connecting…</span></h3>
+            <table>
+                <thead>
+                    <tr><th>Started</th><th>Client IP</th><th>Test</th><th>Transferred (MB)</th><th>Current (Mbps)</th></tr>
+                </thead>
+                <tbody id="live-tbody"></tbody>
+            </table>
+            <ul class="live-log" id="live-log"></ul>
+        </div>
         <div class="tests-table">
             <h3 style="padding: 20px 20px 0 20px; margin: 0;">Recent Speed Tests</h3>
             <table>
@@ -89,8 +113,68 @@ func (h *Handlers) AdminDashboard(w http.ResponseWriter, r *http.Request) {
             }
         }
         function refreshData() { loadStats(); loadRecentTests(); }
-        document.addEventListener('DOMContentLoaded', refreshData);
-        setInterval(refreshData, 30000);
+
+        // Live feed: transfers in progress and a log of recent events
+        const activeTests = {};
+        let refreshTimer = null;
+        function renderActiveTests() {
+            document.getElementById('live-tbody').innerHTML = Object.values(activeTests).map(test =>
+                '<tr><td>' + new Date(test.started).toLocaleTimeString() + '</td>' +
+                '<td>' + test.client_ip + '</td>' +
+                '<td>' + test.kind + '</td>' +
+                '<td>' + (test.bytes / 1e6).toFixed(1) + '</td>' +
+                '<td>' + test.mbps.toFixed(1) + '</td></tr>'
+            ).join('');
+        }
+        function logEvent(text) {
+            const log = document.getElementById('live-log');
+            const item = document.createElement('li');
+            item.textContent = new Date().toLocaleTimeString() + '  ' + text;
+            log.insertBefore(item, log.firstChild);
+            while (log.children.length > 100) log.removeChild(log.lastChild);
+        }
+        function scheduleRefresh() {
+            // Stored results arrive in bursts at the end of a test
+            clearTimeout(refreshTimer);
+            refreshTimer = setTimeout(refreshData, 1000);
+        }
+        function connectLive() {
+            const source = new EventSource('/admin/api/live?admin_key=admin_secret_key_change_in_production');
+            const status = document.getElementById('live-status');
+            source.onopen = () => { status.textContent = '● live'; status.className = 'live-status status-active'; };
+            source.onerror = () => { status.textContent = '● reconnecting'; status.className = 'live-status status-error'; };
+            source.addEventListener('test_started', e => {
+                const event = JSON.parse(e.data);
+                activeTests[event.test_id] = { started: event.time, client_ip: event.client_ip, kind: event.kind, bytes: 0, mbps: 0 };
+                renderActiveTests();
+                logEvent(event.kind + ' started from ' + event.client_ip);
+            });
+            source.addEventListener('test_progress', e => {
+                const event = JSON.parse(e.data);
+                const test = activeTests[event.test_id];
+                if (!test) return;
+                test.bytes = event.data.bytes_transferred;
+                test.mbps = event.data.mbps;
+                renderActiveTests();
+            });
+            source.addEventListener('test_finished', e => {
+                const event = JSON.parse(e.data);
+                delete activeTests[event.test_id];
+                renderActiveTests();
+                logEvent(event.kind + ' finished for ' + event.client_ip + ': ' + event.data.throughput_mbps.toFixed(1) + ' Mbps' +
+                    (event.data.truncated || event.data.failed ? ' (incomplete)' : ''));
+            });
+            source.addEventListener('test_saved', e => {
+                const event = JSON.parse(e.data);
+                logEvent('result stored for ' + event.client_ip);
+                scheduleRefresh();
+            });
+            source.addEventListener('metric', e => {
+                const event = JSON.parse(e.data);
+                if (event.data.type === 'error') logEvent('error ' + event.data.error_code + ' for ' + event.client_ip + ': ' + event.data.error_message);
+            });
+        }
+        document.addEventListener('DOMContentLoaded', () => { refreshData(); connectLive(); });
     </script>
 </body>
 </html>`
@@ -99,10 +183,67 @@ func (h *Handlers) AdminDashboard(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(dashboardHTML))
 }
 
+// liveKeepAlive is how often an idle live feed sends a comment, so proxies
+// and browsers keep the stream open
+const liveKeepAlive = 15 * time.Second
+
+// AdminLive streams test activity as Server-Sent Events: tests starting,
+// their progress each second, finished transfers, stored results and
+// logged metrics. Each event is named after its type and carries the event
+// as JSON. Slow readers miss events rather than holding up tests.
+// GET /admin/api/live
+func (h *Handlers) AdminLive(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// The stream stays open for as long as the dashboard does
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.WarnContext(r.Context(), "Failed to clear live feed deadline", "error", err)
+	}
+
+	feed, unsubscribe := h.events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		slog.ErrorContext(r.Context(), "Live feed does not support streaming", "error", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(liveKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-feed:
+			data, err := json.Marshal(event)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error encoding live event", "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
 // AdminStats returns server statistics as JSON
 func (h *Handlers) AdminStats(w http.ResponseWriter, r *http.Request) {
 	if !h.isAdmin(r) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -110,9 +251,9 @@ func (h *Handlers) AdminStats(w http.ResponseWriter, r *http.Request) {
 	if h.db != nil {
 		endTime := time.Now().UTC()
 		startTime := endTime.Add(-24 * time.Hour)
-		dbStats, err := h.db.GetServerStats(startTime, endTime)
+		dbStats, err := h.db.GetServerStats(r.Context(), startTime, endTime)
 		if err != nil {
-			log.Printf("Failed to get server stats: %v", err)
+			slog.WarnContext(r.Context(), "Failed to get server stats", "error", err)
 			stats = h.getMockStats()
 		} else {
 			stats = dbStats
@@ -128,7 +269,7 @@ func (h *Handlers) AdminStats(w http.ResponseWriter, r *http.Request) {
 // AdminRecentTests returns recent test results as JSON
 func (h *Handlers) AdminRecentTests(w http.ResponseWriter, r *http.Request) {
 	if !h.isAdmin(r) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -136,9 +277,9 @@ func (h *Handlers) AdminRecentTests(w http.ResponseWriter, r *http.Request) {
 	if h.db != nil {
 		endTime := time.Now().UTC()
 		startTime := endTime.Add(-24 * time.Hour)
-		dbTests, err := h.db.GetMetrics("speed_test", startTime, endTime, 50)
+		dbTests, err := h.db.GetMetrics(r.Context(), "speed_test", startTime, endTime, 50)
 		if err != nil {
-			log.Printf("Failed to get recent tests: %v", err)
+			slog.WarnContext(r.Context(), "Failed to get recent tests", "error", err)
 			tests = h.getMockTests()
 		} else {
 			tests = dbTests
@@ -154,7 +295,7 @@ func (h *Handlers) AdminRecentTests(w http.ResponseWriter, r *http.Request) {
 // AdminSystemInfo returns system information
 func (h *Handlers) AdminSystemInfo(w http.ResponseWriter, r *http.Request) {
 	if !h.isAdmin(r) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -165,12 +306,158 @@ func (h *Handlers) AdminSystemInfo(w http.ResponseWriter, r *http.Request) {
 		"memory_usage": map[string]interface{}{"used_mb": 256, "total_mb": 512, "usage_percent": 50.0},
 		"version":      "1.0.0",
 		"rate_limiter": h.rateLimiter.GetStats(),
+		"ip_cache":     h.ipService.CacheStats(),
+		"ip_providers": h.ipService.ProviderStatus(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(systemInfo)
 }
 
+// AdminIPCacheStats returns geolocation cache hit/miss counters
+func (h *Handlers) AdminIPCacheStats(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	stats := h.ipService.CacheStats()
+	if stats == nil {
+		logging.Error(w, r, `{"error":"IP cache is disabled"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// AdminIPProviders returns the health of each geolocation provider in the chain
+func (h *Handlers) AdminIPProviders(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"providers": h.ipService.ProviderStatus(),
+	})
+}
+
+// AdminThrottles lists the per-client bandwidth caps
+func (h *Handlers) AdminThrottles(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.clientCaps.List())
+}
+
+// AdminSetThrottle caps the download/upload rate of a client IP or CIDR
+func (h *Handlers) AdminSetThrottle(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var entry ratelimit.ClientCapEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		logging.Error(w, r, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+		return
+	}
+
+	network, err := h.clientCaps.Set(entry.Client, entry.RateMbps)
+	if err != nil {
+		logging.Error(w, r, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin set bandwidth cap", "client", network, "rate_mbps", entry.RateMbps)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ratelimit.ClientCapEntry{Client: network, RateMbps: entry.RateMbps})
+}
+
+// AdminDeleteThrottle removes the cap for a client IP or CIDR (?client=)
+func (h *Handlers) AdminDeleteThrottle(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !h.clientCaps.Remove(r.URL.Query().Get("client")) {
+		logging.Error(w, r, `{"error":"No cap configured for this client"}`, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminTraces lists the diagnostics traces of recent test sessions, newest
+// first, optionally only those of one client
+// GET /admin/api/traces?client_ip=IP&limit=N
+func (h *Handlers) AdminTraces(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	limit := 50
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		parsed, err := strconv.Atoi(limitStr)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			logging.Error(w, r, `{"error":"limit must be between 1 and 1000"}`, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.traces.List(r.URL.Query().Get("client_ip"), limit))
+}
+
+// traceExport is a test session's trace together with its stored result
+type traceExport struct {
+	*diagnostics.Trace
+	Result *models.SpeedTest `json:"result,omitempty"`
+}
+
+// AdminTestTrace returns the event trace of a test session and its stored
+// result, if any. With download=1 it is served as a JSON file to attach to
+// support tickets.
+// GET /admin/api/traces/{id}
+func (h *Handlers) AdminTestTrace(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		logging.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	trace, ok := h.traces.Get(id)
+	if !ok {
+		logging.Error(w, r, `{"error":"Trace not found or expired"}`, http.StatusNotFound)
+		return
+	}
+
+	export := traceExport{Trace: trace}
+	if h.db != nil {
+		if result, err := h.db.GetSpeedTestBySession(r.Context(), id); err == nil {
+			export.Result = result
+		} else if !strings.Contains(err.Error(), "not found") {
+			slog.ErrorContext(r.Context(), "Error getting speed test for trace", "id", id, "error", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="test-%s-trace.json"`, id))
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(export)
+}
+
 // isAdmin checks if the request has admin privileges
 func (h *Handlers) isAdmin(r *http.Request) bool {
 	apiKey := r.Header.Get("X-Admin-API-Key")
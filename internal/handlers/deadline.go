@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/clientip"
+	"github.com/Krea-University/speed-test-server/internal/config"
+)
+
+// testDeadline returns how long a test transfer of size bytes may take: the
+// time to move it at the slower of rateMbps (when throttled) and the minimum
+// test rate, plus the API write timeout as slack, capped at the maximum test
+// duration
+func testDeadline(size int64, rateMbps float64) time.Duration {
+	rate := config.GetTestMinRateMbps()
+	if rateMbps > 0 && rateMbps < rate {
+		rate = rateMbps
+	}
+
+	_, slack, _ := config.GetServerTimeouts()
+	deadline := slack + time.Duration(float64(size)*8/(rate*1e6)*float64(time.Second))
+	if max := config.GetTestMaxDuration(); deadline > max {
+		deadline = max
+	}
+	return deadline
+}
+
+// extendDeadlines replaces the server's strict read and write timeouts for
+// this request. Writers without deadline support (e.g. in tests) keep theirs.
+func extendDeadlines(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(timeout)
+
+	for _, err := range []error{rc.SetReadDeadline(deadline), rc.SetWriteDeadline(deadline)} {
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			slog.WarnContext(r.Context(), "Failed to extend test deadline", "error", err)
+		}
+	}
+}
+
+// recordTruncated logs a test transfer that stopped before size bytes were
+// moved as an error metric, so cut-off runs are not mistaken for slow links.
+// size is -1 when the client did not announce it. The cause also goes into
+// the test's trace.
+func (h *Handlers) recordTruncated(r *http.Request, trace *testTrace, direction string, start time.Time, transferred, size int64, err error) {
+	cause := "connection closed"
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		cause = "deadline exceeded"
+	case errors.Is(err, context.Canceled):
+		cause = "client disconnected"
+	case err != nil:
+		cause = err.Error()
+	}
+
+	clientIP := clientip.FromRequest(r)
+	message := fmt.Sprintf("stopped after %d of %d bytes in %v: %s",
+		transferred, size, time.Since(start).Round(time.Millisecond), cause)
+	slog.WarnContext(r.Context(), "Truncated "+direction, "client_ip", clientIP, "transferred", transferred, "size", size, "cause", cause)
+	trace.fail(direction+"_truncated", cause, map[string]interface{}{
+		"transferred": transferred,
+		"size":        size,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+
+	if h.metricsLogger != nil {
+		h.metricsLogger.LogError(clientIP, r.UserAgent(), direction+"_truncated", message)
+	}
+}
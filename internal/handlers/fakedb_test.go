@@ -0,0 +1,65 @@
+package handlers_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/Krea-University/speed-test-server/internal/database"
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeDB stands in for MySQL, enforcing the speed_tests primary key and
+// unique session_id; other statements succeed and queries return no rows
+type fakeDB struct {
+	mu       sync.Mutex
+	ids      map[string]bool
+	sessions map[string]bool
+}
+
+// newFakeDatabase returns a database service backed by a fresh fakeDB
+func newFakeDatabase() *database.Service {
+	fake := &fakeDB{ids: make(map[string]bool), sessions: make(map[string]bool)}
+	return database.NewFromDB(sql.OpenDB(fake))
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+
+func (c fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.Contains(query, "INSERT INTO speed_tests") {
+		return driver.RowsAffected(1), nil
+	}
+
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	id, _ := args[0].Value.(string)
+	session, hasSession := args[1].Value.(string)
+	if c.db.ids[id] || (hasSession && c.db.sessions[session]) {
+		return nil, &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+	}
+	c.db.ids[id] = true
+	if hasSession {
+		c.db.sessions[session] = true
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return fakeRows{}, nil
+}
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string         { return nil }
+func (fakeRows) Close() error              { return nil }
+func (fakeRows) Next([]driver.Value) error { return io.EOF }
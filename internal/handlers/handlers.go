@@ -2,26 +2,35 @@
 package handlers
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	mathrand "math/rand"
-	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Krea-University/speed-test-server/internal/clientip"
 	"github.com/Krea-University/speed-test-server/internal/config"
 	"github.com/Krea-University/speed-test-server/internal/database"
+	"github.com/Krea-University/speed-test-server/internal/diagnostics"
+	"github.com/Krea-University/speed-test-server/internal/enrichment"
+	"github.com/Krea-University/speed-test-server/internal/events"
 	"github.com/Krea-University/speed-test-server/internal/ipservice"
+	"github.com/Krea-University/speed-test-server/internal/logging"
 	"github.com/Krea-University/speed-test-server/internal/metrics"
 	"github.com/Krea-University/speed-test-server/internal/models"
 	"github.com/Krea-University/speed-test-server/internal/ratelimit"
+	"github.com/Krea-University/speed-test-server/internal/throughput"
 	"github.com/Krea-University/speed-test-server/internal/types"
+	"github.com/Krea-University/speed-test-server/internal/waitingroom"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -32,28 +41,60 @@ type Handlers struct {
 	ipService     *ipservice.Service
 	db            *database.Service
 	rateLimiter   *ratelimit.ClientLimiter
+	bandwidth     *ratelimit.BandwidthController
+	clientCaps    *ratelimit.ClientCaps
+	waitingRoom   *waitingroom.Room
+	enricher      *enrichment.Worker // nil without a database
 	metricsLogger *metrics.MetricsLogger
+	progress      *progressRegistry
+	events        *events.Bus        // live activity for the admin feed
+	traces        *diagnostics.Store // nil when tracing is disabled
 	upgrader      websocket.Upgrader
 }
 
 // New creates a new handlers instance with dependencies
 func New(db *database.Service) *Handlers {
-	// Initialize metrics logger with fallback path
-	logPath := os.Getenv("METRICS_LOG_PATH")
-	if logPath == "" {
-		logPath = "/tmp/speed-test-server-logs"
+	// Tests and logged metrics are published to the admin live feed
+	bus := events.NewBus()
+	metricsLogger, err := metrics.NewMetricsLogger(db, config.GetMetricsLogPath())
+	if err != nil {
+		slog.Warn("Failed to initialize metrics logger", "error", err)
+	} else {
+		metricsLogger.SetEventBus(bus)
 	}
 
-	metricsLogger, err := metrics.NewMetricsLogger(db, logPath)
-	if err != nil {
-		log.Printf("Warning: Failed to initialize metrics logger: %v", err)
+	// Geolocation results are optionally persisted to survive restarts
+	ipService := ipservice.NewService()
+	if db != nil && config.GetIPCachePersist() {
+		ipService.UsePersistentCache(db)
+	}
+
+	// Stored tests get reverse DNS and ASN details in the background
+	var enricher *enrichment.Worker
+	if db != nil && config.GetEnrichmentWorkers() > 0 {
+		enricher = enrichment.NewWorker(db, ipService, config.GetEnrichmentWorkers(),
+			config.GetEnrichmentQueueSize(), config.GetEnrichmentDNSTimeout())
 	}
 
+	// Admission control is disabled unless an uplink capacity is configured
+	bandwidth := ratelimit.NewBandwidthController(
+		config.GetBandwidthCapacityMbps(),
+		config.GetMinPerTestMbps(),
+		config.GetAdmissionQueueSize(),
+		config.GetAdmissionQueueWait(),
+	)
+
 	return &Handlers{
-		ipService:     ipservice.NewService(),
+		ipService:     ipService,
 		db:            db,
 		rateLimiter:   ratelimit.NewClientLimiter(0, 0, time.Minute), // 0 means unlimited
+		bandwidth:     bandwidth,
+		clientCaps:    ratelimit.NewClientCaps(),
+		enricher:      enricher,
 		metricsLogger: metricsLogger,
+		progress:      newProgressRegistry(),
+		events:        bus,
+		traces:        diagnostics.NewStore(config.GetTraceStoreLimits()),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins for testing purposes
@@ -75,32 +116,49 @@ func (h *Handlers) Ping(w http.ResponseWriter, r *http.Request) {
 		Timestamp: time.Now().UnixNano(),
 	}
 
+	// Pings are only traced as part of a test session the client named
+	trace := h.traceFor(w, r, false)
+	trace.record("ping", nil)
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding ping response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error encoding ping response", "error", err)
+		logging.Error(w, r, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	// Store ping test result
 	if h.db != nil {
-		clientIP := getClientIP(r)
+		clientIP := clientip.FromRequest(r)
 		latency := float64(time.Since(start).Nanoseconds()) / 1000000 // Convert to milliseconds
 
-		test := models.NewSpeedTest(clientIP, "ping")
+		test := models.NewSpeedTest(clientIP, "ping", serverIdentity())
 		test.PingLatencyMs = &latency
 		userAgent := r.UserAgent()
 		test.UserAgent = &userAgent
 
 		// Get IP info
-		if ipInfo, err := h.ipService.GetIPInfo(clientIP); err == nil {
+		lookupStart := time.Now()
+		ipInfo, err := h.ipService.GetIPInfo(r.Context(), clientIP)
+		trace.geoLookup(ipInfo, err, time.Since(lookupStart))
+		if err == nil {
 			test.ISP = &ipInfo.ISP
 			test.Country = &ipInfo.Country
 			test.Region = &ipInfo.Region
 			test.City = &ipInfo.City
 		}
-
-		go h.db.CreateSpeedTest(test) // Store asynchronously
+		setNetworkLabels(test, h.ipService.Classify(clientIP))
+		setConnectionInfo(test, r)
+
+		// Store asynchronously, then queue for enrichment
+		ctx := context.WithoutCancel(r.Context())
+		go func() {
+			if err := h.db.CreateSpeedTest(ctx, test); err != nil {
+				slog.ErrorContext(ctx, "Error storing ping test", "error", err)
+				return
+			}
+			h.enricher.Enqueue(test.ID, test.ClientIP)
+		}()
 	}
 }
 
@@ -112,19 +170,30 @@ func (h *Handlers) Ping(w http.ResponseWriter, r *http.Request) {
 // @Param size query int false "Data size in bytes" default(52428800)
 // @Param chunks query int false "Number of chunks for parallel download" default(1)
 // @Param chunk_size query int false "Size of each chunk in bytes" default(1048576)
+// @Param rate query number false "Throttle the stream to this rate in Mbps (emulates a constrained link)"
 // @Success 200 {string} binary "Random data stream"
+// @Header 200 {string} X-Progress-URL "WebSocket streaming the bytes written every 100ms"
 // @Router /download [get]
 func (h *Handlers) Download(w http.ResponseWriter, r *http.Request) {
 	// Check rate limit
-	clientIP := getClientIP(r)
+	clientIP := clientip.FromRequest(r)
+	trace := h.traceFor(w, r, true)
 	if !h.rateLimiter.IsAllowed(clientIP) {
-		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		trace.fail("rate_limited", "too many tests from this client", map[string]interface{}{"limiter": "tests_per_ip"})
+		logging.Error(w, r, "Rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
 
 	h.rateLimiter.IncrementActiveTests(clientIP)
 	defer h.rateLimiter.DecrementActiveTests(clientIP)
 
+	// Wait for uplink capacity so concurrent tests don't skew each other
+	transfer, ok := h.admit(w, r, trace)
+	if !ok {
+		return
+	}
+	defer transfer.Done()
+
 	// Parse parameters
 	sizeStr := r.URL.Query().Get("size")
 	chunksStr := r.URL.Query().Get("chunks")
@@ -152,26 +221,81 @@ func (h *Handlers) Download(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Pace the stream if throttling was requested or is imposed on this client
+	pacer, ok := h.pacerFor(w, r, clientIP, trace)
+	if !ok {
+		return
+	}
+	// Large downloads on slow links outlast the server's write timeout
+	deadline := testDeadline(size, pacer.RateMbps())
+	extendDeadlines(w, r, deadline)
+
+	// Publish the bytes written every interval for progress watchers and
+	// the live feed
+	progressID := uuid.New().String()
+	progress := h.progress.start(progressID)
+	live := h.startLive(r, trace, "download", size)
+	sampler := throughput.NewSampler(throughput.DefaultInterval, func(sample types.ThroughputSample) {
+		progress.add(sample)
+		live.sample(sample)
+	})
+	w = &meteredWriter{ResponseWriter: w, ctx: r.Context(), transfer: transfer, pacer: pacer, sampler: sampler}
+
 	// Set headers
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Expires", "0")
-
+	w.Header().Set("X-Progress-ID", progressID)
+	w.Header().Set("X-Progress-URL", "/download/progress/"+progressID+"/ws")
+
+	trace.record("download_start", map[string]interface{}{
+		"size":        size,
+		"chunks":      chunks,
+		"chunk_size":  chunkSize,
+		"deadline_ms": deadline.Milliseconds(),
+		"progress_id": progressID,
+	})
+	start := time.Now()
+	sampler.Start()
+	var written int64
+	var err error
 	if chunks > 1 {
 		// Multi-threaded chunked download
 		w.Header().Set("X-Chunks", strconv.Itoa(chunks))
 		w.Header().Set("X-Chunk-Size", strconv.FormatInt(chunkSize, 10))
-		h.downloadChunked(w, r, size, chunks, chunkSize)
+		written, err = h.downloadChunked(w, r, size, chunks, chunkSize)
 	} else {
 		// Single-threaded download
 		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-		h.downloadSingle(w, r, size)
+		written, err = h.downloadSingle(w, r, size)
+	}
+
+	samples := sampler.Stop()
+	summary := types.DownloadSummary{
+		Size:           size,
+		BytesWritten:   sampler.Total(),
+		DurationMs:     time.Since(start).Milliseconds(),
+		ThroughputMbps: throughput.Stable(samples),
+		Truncated:      written < size,
+	}
+	h.progress.finish(progressID, summary)
+	live.finish(summary)
+	trace.record("download_end", map[string]interface{}{
+		"bytes_written":   written,
+		"duration_ms":     summary.DurationMs,
+		"throughput_mbps": summary.ThroughputMbps,
+		"truncated":       summary.Truncated,
+	})
+
+	if written < size {
+		h.recordTruncated(r, trace, "download", start, written, size, err)
 	}
 }
 
-// downloadSingle provides traditional single-threaded download
-func (h *Handlers) downloadSingle(w http.ResponseWriter, r *http.Request, size int64) {
+// downloadSingle provides traditional single-threaded download, returning
+// the bytes written and why it stopped early
+func (h *Handlers) downloadSingle(w http.ResponseWriter, r *http.Request, size int64) (int64, error) {
 	// Use a seeded random source for reproducible data
 	src := mathrand.NewSource(time.Now().UnixNano())
 	rng := mathrand.New(src)
@@ -191,10 +315,10 @@ func (h *Handlers) downloadSingle(w http.ResponseWriter, r *http.Request, size i
 		}
 
 		n, err := w.Write(buffer)
+		written += int64(n)
 		if err != nil {
-			return // Client disconnected
+			return written, err // Client disconnected or deadline exceeded
 		}
-		written += int64(n)
 
 		// Flush periodically for streaming
 		if f, ok := w.(http.Flusher); ok {
@@ -204,14 +328,16 @@ func (h *Handlers) downloadSingle(w http.ResponseWriter, r *http.Request, size i
 		// Check for client disconnect
 		select {
 		case <-r.Context().Done():
-			return
+			return written, r.Context().Err()
 		default:
 		}
 	}
+	return written, nil
 }
 
-// downloadChunked provides multi-threaded chunked download for smoother graphs
-func (h *Handlers) downloadChunked(w http.ResponseWriter, r *http.Request, totalSize int64, numChunks int, chunkSize int64) {
+// downloadChunked provides multi-threaded chunked download for smoother
+// graphs, returning the payload bytes written and why it stopped early
+func (h *Handlers) downloadChunked(w http.ResponseWriter, r *http.Request, totalSize int64, numChunks int, chunkSize int64) (int64, error) {
 	// Calculate chunk distribution
 	actualChunkSize := totalSize / int64(numChunks)
 	if actualChunkSize < chunkSize {
@@ -235,8 +361,8 @@ func (h *Handlers) downloadChunked(w http.ResponseWriter, r *http.Request, total
 			// Calculate this chunk's size
 			start := int64(chunkID) * actualChunkSize
 			end := start + actualChunkSize
-			if end > totalSize {
-				end = totalSize
+			if end > totalSize || chunkID == numChunks-1 {
+				end = totalSize // The last chunk also carries the remainder
 			}
 			size := end - start
 
@@ -275,20 +401,19 @@ func (h *Handlers) downloadChunked(w http.ResponseWriter, r *http.Request, total
 	}()
 
 	// Stream chunks as they become available
-	chunksReceived := 0
+	var written int64
 	for {
 		select {
 		case chunk, ok := <-chunkChan:
 			if !ok {
-				return // All chunks sent
+				// All chunks sent, unless generation stopped on disconnect
+				return written, r.Context().Err()
 			}
 
-			_, err := w.Write(chunk)
-			if err != nil {
-				return // Client disconnected
+			if _, err := w.Write(chunk); err != nil {
+				return written, err // Client disconnected or deadline exceeded
 			}
-
-			chunksReceived++
+			written += int64(len(chunk) - 8)
 
 			// Flush for real-time streaming
 			if f, ok := w.(http.Flusher); ok {
@@ -300,57 +425,144 @@ func (h *Handlers) downloadChunked(w http.ResponseWriter, r *http.Request, total
 
 		case err := <-errorChan:
 			if err != nil {
-				http.Error(w, "Chunk generation error", http.StatusInternalServerError)
-				return
+				logging.Error(w, r, "Chunk generation error", http.StatusInternalServerError)
+				return written, err
 			}
 
 		case <-r.Context().Done():
-			return // Client disconnected
+			return written, r.Context().Err() // Client disconnected
 		}
 	}
 }
 
-// Upload accepts data and returns bytes received for upload speed testing
-// POST /upload
+// Upload accepts data and returns the bytes received, sampled every 100ms,
+// with a stable throughput figure that leaves out ramp-up
+// POST /upload?rate=MBPS (optional throttling of the read side)
 func (h *Handlers) Upload(w http.ResponseWriter, r *http.Request) {
 	// Check rate limit
-	clientIP := getClientIP(r)
+	clientIP := clientip.FromRequest(r)
+	trace := h.traceFor(w, r, true)
 	if !h.rateLimiter.IsAllowed(clientIP) {
-		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		trace.fail("rate_limited", "too many tests from this client", map[string]interface{}{"limiter": "tests_per_ip"})
+		logging.Error(w, r, "Rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
 
 	h.rateLimiter.IncrementActiveTests(clientIP)
 	defer h.rateLimiter.DecrementActiveTests(clientIP)
 
+	// Wait for uplink capacity so concurrent tests don't skew each other
+	transfer, ok := h.admit(w, r, trace)
+	if !ok {
+		return
+	}
+	defer transfer.Done()
+
+	// Pace reads if throttling was requested or is imposed on this client
+	pacer, ok := h.pacerFor(w, r, clientIP, trace)
+	if !ok {
+		return
+	}
+
+	// Slow uploads outlast the server's read timeout; the deadline covers the
+	// announced size, or the maximum upload size for streamed bodies
+	size := r.ContentLength
+	if size < 0 || size > int64(config.MaxUploadSize) {
+		size = int64(config.MaxUploadSize)
+	}
+	deadline := testDeadline(size, pacer.RateMbps())
+	extendDeadlines(w, r, deadline)
+
 	// Limit the request body size to prevent abuse
 	r.Body = http.MaxBytesReader(w, r.Body, int64(config.MaxUploadSize))
+	trace.record("upload_start", map[string]interface{}{
+		"content_length": r.ContentLength,
+		"deadline_ms":    deadline.Milliseconds(),
+	})
 
-	// Count bytes received while discarding the data
-	bytesReceived, err := io.Copy(io.Discard, r.Body)
+	// Count bytes received while discarding the data, sampling progress so
+	// the reported throughput can leave out ramp-up
+	start := time.Now()
+	live := h.startLive(r, trace, "upload", r.ContentLength)
+	sampler := throughput.NewSampler(throughput.DefaultInterval, live.sample)
+	sampler.Start()
+	body := &meteredReader{Reader: r.Body, ctx: r.Context(), transfer: transfer, pacer: pacer, sampler: sampler}
+	bytesReceived, err := io.Copy(io.Discard, body)
+	samples := sampler.Stop()
+	summary := types.UploadSummary{
+		BytesReceived:  bytesReceived,
+		DurationMs:     time.Since(start).Milliseconds(),
+		ThroughputMbps: throughput.Stable(samples),
+		Failed:         err != nil,
+	}
+	live.finish(summary)
+	trace.record("upload_end", map[string]interface{}{
+		"bytes_received":  summary.BytesReceived,
+		"duration_ms":     summary.DurationMs,
+		"throughput_mbps": summary.ThroughputMbps,
+		"failed":          summary.Failed,
+	})
 	if err != nil {
-		log.Printf("Error reading upload data: %v", err)
-		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			trace.fail("upload_too_large", err.Error(), map[string]interface{}{"limit": tooLarge.Limit})
+		} else {
+			h.recordTruncated(r, trace, "upload", start, bytesReceived, r.ContentLength, err)
+		}
+		slog.WarnContext(r.Context(), "Error reading upload data", "error", err)
+		logging.Error(w, r, "Error reading request body", http.StatusBadRequest)
 		return
 	}
 
 	response := types.UploadResponse{
-		BytesReceived: bytesReceived,
+		BytesReceived:    bytesReceived,
+		DurationMs:       time.Since(start).Milliseconds(),
+		SampleIntervalMs: throughput.DefaultInterval.Milliseconds(),
+		Samples:          samples,
+		ThroughputMbps:   throughput.Stable(samples),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding upload response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error encoding upload response", "error", err)
+		logging.Error(w, r, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
+// admit obtains a bandwidth admission slot, writing a 503 with Retry-After and
+// the queue position if the uplink stays saturated. With admission control
+// enabled, the decision goes into the test's trace.
+func (h *Handlers) admit(w http.ResponseWriter, r *http.Request, trace *testTrace) (*ratelimit.Transfer, bool) {
+	start := time.Now()
+	transfer, err := h.bandwidth.Admit(r.Context())
+	if err == nil {
+		if h.bandwidth.Enabled() {
+			trace.record("admitted", map[string]interface{}{"wait_ms": time.Since(start).Milliseconds()})
+		}
+		return transfer, true
+	}
+
+	retryAfter := 1
+	fields := map[string]interface{}{"wait_ms": time.Since(start).Milliseconds()}
+	var admissionErr *ratelimit.AdmissionError
+	if errors.As(err, &admissionErr) {
+		retryAfter = int(math.Ceil(admissionErr.RetryAfter.Seconds()))
+		w.Header().Set("X-Queue-Position", strconv.Itoa(admissionErr.Position))
+		fields["queue_position"] = admissionErr.Position
+	}
+	fields["retry_after_s"] = retryAfter
+	trace.fail("admission_rejected", err.Error(), fields)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	logging.Error(w, r, "Server bandwidth is saturated. Please try again later.", http.StatusServiceUnavailable)
+	return nil, false
+}
+
 // WebSocket provides WebSocket endpoint for jitter measurement
 // GET /ws
 func (h *Handlers) WebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		slog.WarnContext(r.Context(), "WebSocket upgrade error", "error", err)
 		return
 	}
 	defer conn.Close()
@@ -360,7 +572,7 @@ func (h *Handlers) WebSocket(w http.ResponseWriter, r *http.Request) {
 		messageType, message, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				slog.WarnContext(r.Context(), "WebSocket error", "error", err)
 			}
 			break
 		}
@@ -373,12 +585,12 @@ func (h *Handlers) WebSocket(w http.ResponseWriter, r *http.Request) {
 
 		responseData, err := json.Marshal(response)
 		if err != nil {
-			log.Printf("Error marshaling WebSocket response: %v", err)
+			slog.ErrorContext(r.Context(), "Error marshaling WebSocket response", "error", err)
 			break
 		}
 
 		if err := conn.WriteMessage(messageType, responseData); err != nil {
-			log.Printf("WebSocket write error: %v", err)
+			slog.WarnContext(r.Context(), "WebSocket write error", "error", err)
 			break
 		}
 	}
@@ -387,23 +599,24 @@ func (h *Handlers) WebSocket(w http.ResponseWriter, r *http.Request) {
 // IP returns client IP and comprehensive geolocation information
 // GET /ip
 func (h *Handlers) IP(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
+	clientIP := clientip.FromRequest(r)
+	trace := h.traceFor(w, r, false)
 
 	// Try to get detailed IP information using the IP service
-	response, err := h.ipService.GetIPInfo(clientIP)
+	start := time.Now()
+	response, err := h.ipService.GetIPInfo(r.Context(), clientIP)
+	trace.geoLookup(response, err, time.Since(start))
 	if err != nil {
-		log.Printf("Failed to get IP info for %s: %v", clientIP, err)
-		// Return basic response with just the IP
-		response = &types.IPResponse{
-			IP:     clientIP,
-			Source: "local",
-		}
+		slog.WarnContext(r.Context(), "Failed to get IP info", "client_ip", clientIP, "error", err)
+		// Return basic response with just the IP and its network labels
+		response = h.ipService.Classify(clientIP)
+		response.Source = "local"
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding IP response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error encoding IP response", "error", err)
+		logging.Error(w, r, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
@@ -417,8 +630,8 @@ func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding health response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error encoding health response", "error", err)
+		logging.Error(w, r, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
@@ -431,8 +644,8 @@ func (h *Handlers) Version(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding version response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error encoding version response", "error", err)
+		logging.Error(w, r, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
@@ -445,48 +658,38 @@ func (h *Handlers) Config(w http.ResponseWriter, r *http.Request) {
 		MaxUploadSize:       config.MaxUploadSize,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding config response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-	}
-}
-
-// getClientIP extracts the real client IP from the request headers
-// It checks various headers that might contain the real IP when behind proxies
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (most common)
-	xForwardedFor := r.Header.Get("X-Forwarded-For")
-	if xForwardedFor != "" {
-		// X-Forwarded-For can contain multiple IPs (client, proxy1, proxy2, ...)
-		// Take the first one which should be the original client
-		ips := strings.Split(xForwardedFor, ",")
-		clientIP := strings.TrimSpace(ips[0])
-		if clientIP != "" {
-			return clientIP
-		}
+	identity := config.GetServerIdentity()
+	response.Server = &types.ServerInfo{
+		Name:     identity.Name,
+		Sponsor:  identity.Sponsor,
+		Country:  identity.Country,
+		City:     identity.City,
+		Location: identity.Location,
+		BaseURL:  identity.BaseURL,
 	}
 
-	// Check X-Real-IP header (used by some proxies)
-	xRealIP := r.Header.Get("X-Real-IP")
-	if xRealIP != "" {
-		return strings.TrimSpace(xRealIP)
+	if ipv4URL, ipv6URL := config.GetDualStackURLs(); ipv4URL != "" {
+		response.DualStack = &types.DualStackInfo{IPv4URL: ipv4URL, IPv6URL: ipv6URL}
 	}
 
-	// Check X-Client-IP header (less common)
-	xClientIP := r.Header.Get("X-Client-IP")
-	if xClientIP != "" {
-		return strings.TrimSpace(xClientIP)
+	if h.bandwidth.Enabled() {
+		status := h.bandwidth.Status()
+		response.Admission = &types.AdmissionStatus{
+			CapacityMbps:   status.CapacityMbps,
+			ThroughputMbps: status.ThroughputMbps,
+			ActiveTests:    status.ActiveTests,
+			MaxActiveTests: status.MaxActiveTests,
+			QueueLength:    status.QueueLength,
+			MaxQueueLength: status.MaxQueueLength,
+			Saturated:      status.Saturated,
+		}
 	}
 
-	// Fall back to RemoteAddr (direct connection)
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		// If SplitHostPort fails, return the RemoteAddr as-is
-		return r.RemoteAddr
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding config response", "error", err)
+		logging.Error(w, r, "Internal server error", http.StatusInternalServerError)
 	}
-
-	return ip
 }
 
 // API Endpoints for managing speed tests
@@ -500,13 +703,14 @@ func getClientIP(r *http.Request) string {
 // @Param test body models.SpeedTest true "Speed test data"
 // @Success 201 {object} map[string]string
 // @Failure 400 {object} map[string]string
+// @Failure 409 {object} map[string]string
 // @Failure 500 {object} map[string]string
 // @Security ApiKeyAuth
 // @Router /api/tests [post]
 func (h *Handlers) CreateSpeedTest(w http.ResponseWriter, r *http.Request) {
 	var test models.SpeedTest
 	if err := json.NewDecoder(r.Body).Decode(&test); err != nil {
-		http.Error(w, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
+		logging.Error(w, r, `{"error":"Invalid JSON"}`, http.StatusBadRequest)
 		return
 	}
 
@@ -515,6 +719,12 @@ func (h *Handlers) CreateSpeedTest(w http.ResponseWriter, r *http.Request) {
 		test.ID = uuid.New().String()
 	}
 
+	// The test session's ID joins the result to its diagnostics trace
+	test.SessionID = nil
+	if sessionID := diagnostics.RequestTestID(r); sessionID != "" {
+		test.SessionID = &sessionID
+	}
+
 	// Set timestamps
 	now := time.Now()
 	test.CreatedAt = now
@@ -522,14 +732,46 @@ func (h *Handlers) CreateSpeedTest(w http.ResponseWriter, r *http.Request) {
 
 	// Set client IP if not provided
 	if test.ClientIP == "" {
-		test.ClientIP = getClientIP(r)
+		test.ClientIP = clientip.FromRequest(r)
+	}
+
+	// Fill in this server's identity unless the client reported another server
+	test.SetServerIdentity(serverIdentity(), false)
+
+	// Network labels are always derived server-side so per-building stats can be trusted
+	setNetworkLabels(&test, h.ipService.Classify(test.ClientIP))
+	setConnectionInfo(&test, r)
+
+	if test.TestType == models.TestTypeDualStack {
+		if err := setPreferredIPVersion(&test, r); err != nil {
+			logging.Error(w, r, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+			return
+		}
 	}
 
-	if err := h.db.CreateSpeedTest(&test); err != nil {
-		log.Printf("Error creating speed test: %v", err)
-		http.Error(w, `{"error":"Failed to create speed test"}`, http.StatusInternalServerError)
+	if err := h.db.CreateSpeedTest(r.Context(), &test); errors.Is(err, database.ErrDuplicate) {
+		logging.Error(w, r, `{"error":"Speed test already exists"}`, http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating speed test", "error", err)
+		logging.Error(w, r, `{"error":"Failed to create speed test"}`, http.StatusInternalServerError)
 		return
 	}
+	h.enricher.Enqueue(test.ID, test.ClientIP)
+	liveID := test.ID
+	if test.SessionID != nil {
+		liveID = *test.SessionID // Joins the session's transfer events
+	}
+	h.events.Publish(events.Event{Type: events.TestSaved, TestID: liveID, ClientIP: test.ClientIP, Data: &test})
+	if test.SessionID != nil {
+		h.traceOf(r, *test.SessionID).record("result_saved", map[string]interface{}{
+			"result_id":           test.ID,
+			"test_type":           test.TestType,
+			"download_speed_mbps": test.DownloadSpeedMbps,
+			"upload_speed_mbps":   test.UploadSpeedMbps,
+			"ping_latency_ms":     test.PingLatencyMs,
+		})
+	}
 
 	response := map[string]string{
 		"id":      test.ID,
@@ -541,6 +783,67 @@ func (h *Handlers) CreateSpeedTest(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// serverIdentity returns the configured identity of this server as recorded on tests
+func serverIdentity() models.ServerIdentity {
+	identity := config.GetServerIdentity()
+	return models.ServerIdentity{Name: identity.Name, Sponsor: identity.Sponsor, Country: identity.Country, City: identity.City}
+}
+
+// setNetworkLabels copies the network classification of the client onto a test record
+func setNetworkLabels(test *models.SpeedTest, labels *types.IPResponse) {
+	test.NetworkType, test.NetworkName, test.Building = nil, nil, nil
+	if labels.NetworkType != "" {
+		test.NetworkType = &labels.NetworkType
+	}
+	if labels.NetworkName != "" {
+		test.NetworkName = &labels.NetworkName
+	}
+	if labels.Building != "" {
+		test.Building = &labels.Building
+	}
+}
+
+// setPreferredIPVersion records which family the client used for the
+// dual-stack host. A reported value is kept; otherwise it is the family this
+// request arrived over, unless it was sent to one of the single-family hosts.
+func setPreferredIPVersion(test *models.SpeedTest, r *http.Request) error {
+	if test.PreferredIPVersion != nil {
+		if version := *test.PreferredIPVersion; version != 4 && version != 6 {
+			return errors.New("preferred_ip_version must be 4 or 6")
+		}
+		return nil
+	}
+
+	host := clientip.Hostname(r)
+	if ipv4Host, ipv6Host := config.GetDualStackHosts(); ipv4Host != "" && (host == ipv4Host || host == ipv6Host) {
+		return nil
+	}
+
+	if version := clientip.Version(clientip.FromRequest(r)); version != 0 {
+		test.PreferredIPVersion = &version
+	}
+	return nil
+}
+
+// setConnectionInfo records the HTTP protocol and the TLS version and cipher
+// suite of the request's connection. The protocol is kept if the client
+// already reported the one its measurement used; the TLS fields stay empty
+// over plain HTTP or behind a TLS-terminating proxy.
+func setConnectionInfo(test *models.SpeedTest, r *http.Request) {
+	if test.Protocol == nil || *test.Protocol == "" {
+		protocol := r.Proto
+		test.Protocol = &protocol
+	}
+
+	test.TLSVersion, test.TLSCipher = nil, nil
+	if r.TLS == nil {
+		return
+	}
+	version := tls.VersionName(r.TLS.Version)
+	cipher := tls.CipherSuiteName(r.TLS.CipherSuite)
+	test.TLSVersion, test.TLSCipher = &version, &cipher
+}
+
 // GetSpeedTest retrieves a speed test by ID
 // @Summary Get speed test by ID
 // @Description Retrieves a specific speed test record by its ID
@@ -557,17 +860,17 @@ func (h *Handlers) GetSpeedTest(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	if id == "" {
-		http.Error(w, `{"error":"ID parameter required"}`, http.StatusBadRequest)
+		logging.Error(w, r, `{"error":"ID parameter required"}`, http.StatusBadRequest)
 		return
 	}
 
-	test, err := h.db.GetSpeedTest(id)
+	test, err := h.db.GetSpeedTest(r.Context(), id)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
-			http.Error(w, `{"error":"Speed test not found"}`, http.StatusNotFound)
+			logging.Error(w, r, `{"error":"Speed test not found"}`, http.StatusNotFound)
 		} else {
-			log.Printf("Error getting speed test: %v", err)
-			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Error getting speed test", "id", id, "error", err)
+			logging.Error(w, r, `{"error":"Internal server error"}`, http.StatusInternalServerError)
 		}
 		return
 	}
@@ -583,6 +886,14 @@ func (h *Handlers) GetSpeedTest(w http.ResponseWriter, r *http.Request) {
 // @Produce json
 // @Param limit query int false "Number of records to return" default(50)
 // @Param offset query int false "Number of records to skip" default(0)
+// @Param asn query int false "Filter by client AS number"
+// @Param ip_version query int false "Filter by client IP version (4 or 6)"
+// @Param reverse_dns query string false "Filter by client reverse DNS hostname"
+// @Param network_name query string false "Filter by campus network name"
+// @Param building query string false "Filter by campus building"
+// @Param protocol query string false "Filter by HTTP protocol, e.g. HTTP/3.0"
+// @Param test_type query string false "Filter by test type, e.g. dualstack"
+// @Param preferred_ip_version query int false "Filter dual-stack tests by the family the client preferred (4 or 6)"
 // @Success 200 {array} models.SpeedTest
 // @Failure 400 {object} map[string]string
 // @Failure 500 {object} map[string]string
@@ -607,10 +918,16 @@ func (h *Handlers) GetAllSpeedTests(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	tests, err := h.db.GetAllSpeedTests(limit, offset)
+	filter, err := parseSpeedTestFilter(r)
+	if err != nil {
+		logging.Error(w, r, `{"error":"Invalid filter: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	tests, err := h.db.GetAllSpeedTests(r.Context(), limit, offset, filter)
 	if err != nil {
-		log.Printf("Error getting speed tests: %v", err)
-		http.Error(w, `{"error":"Failed to retrieve speed tests"}`, http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error getting speed tests", "error", err)
+		logging.Error(w, r, `{"error":"Failed to retrieve speed tests"}`, http.StatusInternalServerError)
 		return
 	}
 
@@ -618,6 +935,67 @@ func (h *Handlers) GetAllSpeedTests(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(tests)
 }
 
+// parseSpeedTestFilter reads the optional filters of GET /api/tests
+func parseSpeedTestFilter(r *http.Request) (database.SpeedTestFilter, error) {
+	query := r.URL.Query()
+	filter := database.SpeedTestFilter{
+		ReverseDNS:  query.Get("reverse_dns"),
+		NetworkName: query.Get("network_name"),
+		Building:    query.Get("building"),
+		Protocol:    query.Get("protocol"),
+		TestType:    query.Get("test_type"),
+	}
+
+	if asnStr := query.Get("asn"); asnStr != "" {
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asnStr), "AS"), 10, 32)
+		if err != nil || asn == 0 {
+			return filter, errors.New("asn must be a positive AS number")
+		}
+		filter.ASNNumber = uint32(asn)
+	}
+
+	if versionStr := query.Get("ip_version"); versionStr != "" {
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || (version != 4 && version != 6) {
+			return filter, errors.New("ip_version must be 4 or 6")
+		}
+		filter.IPVersion = version
+	}
+
+	if versionStr := query.Get("preferred_ip_version"); versionStr != "" {
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || (version != 4 && version != 6) {
+			return filter, errors.New("preferred_ip_version must be 4 or 6")
+		}
+		filter.PreferredIP = version
+	}
+
+	return filter, nil
+}
+
+// Close stops background work, waiting for queued enrichment to finish
+func (h *Handlers) Close() {
+	h.enricher.Close()
+}
+
+// Reload applies the current configuration's bandwidth limits without a restart
+func (h *Handlers) Reload() {
+	if !h.bandwidth.Reconfigure(
+		config.GetBandwidthCapacityMbps(),
+		config.GetMinPerTestMbps(),
+		config.GetAdmissionQueueSize(),
+		config.GetAdmissionQueueWait(),
+	) {
+		slog.Warn("Enabling or disabling bandwidth admission control requires a restart")
+	}
+}
+
+// ReloadIPService applies the current configuration's geolocation provider
+// settings and campus network labels without a restart
+func (h *Handlers) ReloadIPService() {
+	h.ipService.Reload()
+}
+
 // GetSpeedTestOokla retrieves a speed test in Ookla-compatible format
 // @Summary Get speed test in Ookla format
 // @Description Retrieves a speed test result in Ookla speedtest.net compatible format
@@ -633,28 +1011,52 @@ func (h *Handlers) GetSpeedTestOokla(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 
 	if id == "" {
-		http.Error(w, `{"error":"ID parameter required"}`, http.StatusBadRequest)
+		logging.Error(w, r, `{"error":"ID parameter required"}`, http.StatusBadRequest)
 		return
 	}
 
-	test, err := h.db.GetSpeedTest(id)
+	test, err := h.db.GetSpeedTest(r.Context(), id)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
-			http.Error(w, `{"error":"Speed test not found"}`, http.StatusNotFound)
+			logging.Error(w, r, `{"error":"Speed test not found"}`, http.StatusNotFound)
 		} else {
-			log.Printf("Error getting speed test: %v", err)
-			http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Error getting speed test", "id", id, "error", err)
+			logging.Error(w, r, `{"error":"Internal server error"}`, http.StatusInternalServerError)
 		}
 		return
 	}
 
 	// Convert to Ookla format
-	ooklaResponse := test.ToOoklaFormat()
+	ooklaResponse := test.ToOoklaFormat(h.ooklaEndpoint(r.Context(), test.ClientIP))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ooklaResponse)
 }
 
+// ooklaEndpoint returns the public host/port of this server and its distance
+// to the client, when both locations are known
+func (h *Handlers) ooklaEndpoint(ctx context.Context, clientIP string) models.OoklaServerEndpoint {
+	identity := config.GetServerIdentity()
+	endpoint := models.OoklaServerEndpoint{
+		Host:    config.GetServerPublicHost(),
+		Port:    config.GetServerPublicPort(),
+		BaseURL: identity.BaseURL,
+	}
+
+	serverLocation := identity.Location
+	if serverLocation == "" {
+		return endpoint
+	}
+
+	if info, err := h.ipService.GetIPInfo(ctx, clientIP); err == nil {
+		if distance, ok := ipservice.DistanceKm(serverLocation, info.Location); ok {
+			endpoint.DistanceKm = math.Round(distance*100) / 100
+		}
+	}
+
+	return endpoint
+}
+
 // ServeSpeedTestHTML serves the main speed test HTML page
 // @Summary Serve main speed test interface
 // @Description Serves the main speedtest.html file for the speed test interface
@@ -2,15 +2,22 @@
 package handlers_test
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Krea-University/speed-test-server/internal/config"
 	"github.com/Krea-University/speed-test-server/internal/handlers"
+	"github.com/Krea-University/speed-test-server/internal/middleware"
 	"github.com/Krea-University/speed-test-server/internal/types"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 func TestPingHandler(t *testing.T) {
@@ -94,6 +101,38 @@ func TestUploadHandler(t *testing.T) {
 	}
 }
 
+func TestUploadHandlerSamples(t *testing.T) {
+	h := handlers.New(nil)
+
+	// 500 KB at 8 Mbps (1 MB/s) spans about five 100ms samples
+	req, err := http.NewRequest("POST", "/upload?rate=8", bytes.NewReader(make([]byte, 500000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	h.Upload(rr, req)
+
+	var response types.UploadResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	if len(response.Samples) < 3 || response.SampleIntervalMs != 100 {
+		t.Fatalf("expected at least 3 samples every 100ms, got %d every %dms", len(response.Samples), response.SampleIntervalMs)
+	}
+	var total int64
+	for _, sample := range response.Samples {
+		total += sample.Bytes
+	}
+	if total != response.BytesReceived {
+		t.Errorf("samples add up to %d bytes, received %d", total, response.BytesReceived)
+	}
+	if response.ThroughputMbps < 6 || response.ThroughputMbps > 12 {
+		t.Errorf("expected a stable throughput near 8 Mbps, got %.2f", response.ThroughputMbps)
+	}
+}
+
 func TestVersionHandler(t *testing.T) {
 	h := handlers.New(nil)
 
@@ -154,7 +193,8 @@ func TestIPHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Set a test IP in the X-Forwarded-For header
+	// Set a test IP in the X-Forwarded-For header, as added by a local proxy
+	req.RemoteAddr = "127.0.0.1:54321"
 	req.Header.Set("X-Forwarded-For", "8.8.8.8")
 
 	rr := httptest.NewRecorder()
@@ -204,3 +244,360 @@ func TestConfigHandler(t *testing.T) {
 		t.Errorf("expected non-empty version")
 	}
 }
+
+func TestConfigHandlerDualStack(t *testing.T) {
+	t.Setenv("SERVER_URL", "https://speed.example.edu")
+	t.Setenv("SERVER_IPV4_HOST", "v4.speed.example.edu")
+	t.Setenv("SERVER_IPV6_HOST", "v6.speed.example.edu")
+	h := handlers.New(nil)
+
+	rr := httptest.NewRecorder()
+	h.Config(rr, httptest.NewRequest("GET", "/config", nil))
+
+	var response types.Config
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if response.DualStack == nil || response.DualStack.IPv4URL != "https://v4.speed.example.edu" ||
+		response.DualStack.IPv6URL != "https://v6.speed.example.edu" {
+		t.Errorf("unexpected dual-stack endpoints %+v", response.DualStack)
+	}
+}
+
+func TestDownloadHandlerThrottled(t *testing.T) {
+	h := handlers.New(nil)
+
+	// 250 KB at 8 Mbps (1 MB/s) should take roughly 200ms after the initial burst
+	req, err := http.NewRequest("GET", "/download?size=250000&rate=8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	h.Download(rr, req)
+	elapsed := time.Since(start)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if len(rr.Body.Bytes()) != 250000 {
+		t.Errorf("expected 250000 bytes, got %d", len(rr.Body.Bytes()))
+	}
+
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("throttled download finished too quickly: %v", elapsed)
+	}
+
+	if rate := rr.Header().Get("X-Throttle-Rate-Mbps"); rate != "8" {
+		t.Errorf("expected X-Throttle-Rate-Mbps '8', got '%s'", rate)
+	}
+}
+
+// newTimeoutServer serves h.Download behind the logging middleware with the
+// configured server timeouts, like server.New does
+func newTimeoutServer(t *testing.T, h *handlers.Handlers) *httptest.Server {
+	t.Helper()
+	readTimeout, writeTimeout, _ := config.GetServerTimeouts()
+	srv := httptest.NewUnstartedServer(middleware.Logging(http.HandlerFunc(h.Download)))
+	srv.Config.ReadTimeout = readTimeout
+	srv.Config.WriteTimeout = writeTimeout
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloadOutlastsWriteTimeout(t *testing.T) {
+	t.Setenv("WRITE_TIMEOUT_SECONDS", "0.1")
+	srv := newTimeoutServer(t, handlers.New(nil))
+
+	// 250 KB at 8 Mbps takes about twice the server's write timeout
+	resp, err := http.Get(srv.URL + "/download?size=250000&rate=8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || len(body) != 250000 {
+		t.Errorf("download truncated: got %d bytes, %v", len(body), err)
+	}
+}
+
+func TestDownloadTruncatedAtMaxDuration(t *testing.T) {
+	t.Setenv("WRITE_TIMEOUT_SECONDS", "0.1")
+	t.Setenv("TEST_MAX_DURATION_SECONDS", "0.15")
+	srv := newTimeoutServer(t, handlers.New(nil))
+
+	resp, err := http.Get(srv.URL + "/download?size=250000&rate=8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if body, err := io.ReadAll(resp.Body); err == nil || len(body) >= 250000 {
+		t.Errorf("expected the download to be cut off at the deadline, got %d bytes, %v", len(body), err)
+	}
+}
+
+func TestWatchDownloadProgress(t *testing.T) {
+	h := handlers.New(nil)
+	router := mux.NewRouter()
+	router.HandleFunc("/download", h.Download)
+	router.HandleFunc("/download/progress/{id}/ws", h.WatchDownloadProgress)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/download?size=300000&rate=8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	progressURL := resp.Header.Get("X-Progress-URL")
+	if progressURL == "" {
+		t.Fatal("missing X-Progress-URL header")
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+progressURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go io.Copy(io.Discard, resp.Body)
+
+	var samples int
+	var sampled int64
+	for {
+		var message types.DownloadProgressMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("progress stream ended without a summary: %v", err)
+		}
+		if message.Type == "sample" {
+			samples++
+			sampled += message.Sample.Bytes
+			continue
+		}
+
+		summary := message.Summary
+		if message.Type != "done" || summary == nil {
+			t.Fatalf("unexpected message %+v", message)
+		}
+		if summary.BytesWritten != 300000 || sampled != summary.BytesWritten || summary.Truncated {
+			t.Errorf("samples add up to %d bytes, summary %+v", sampled, summary)
+		}
+		break
+	}
+	if samples < 2 {
+		t.Errorf("expected several samples, got %d", samples)
+	}
+
+	// Unknown downloads are rejected before upgrading
+	if resp, err := http.Get(srv.URL + "/download/progress/unknown/ws"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown download, got %v %v", resp, err)
+	}
+}
+
+func TestAdminLive(t *testing.T) {
+	h := handlers.New(nil)
+	router := mux.NewRouter()
+	router.HandleFunc("/download", h.Download)
+	router.HandleFunc("/admin/api/live", h.AdminLive)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	if resp, err := http.Get(srv.URL + "/admin/api/live"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without an admin key, got %v %v", resp, err)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/admin/api/live", nil)
+	req.Header.Set("X-Admin-API-Key", "admin_secret_key_change_in_production")
+	feed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Body.Close()
+	if contentType := feed.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", contentType)
+	}
+	lines := bufio.NewScanner(feed.Body)
+	if !lines.Scan() || lines.Text() != ": connected" {
+		t.Fatalf("expected the connected comment, got %q", lines.Text())
+	}
+
+	// A throttled download lasts long enough to report progress; its events
+	// carry the session's test ID
+	go func() {
+		req, _ := http.NewRequest("GET", srv.URL+"/download?size=300000&rate=2", nil)
+		req.Header.Set("X-Test-ID", "session-7")
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+
+	var seen []string
+	var eventType string
+	for lines.Scan() {
+		line := lines.Text()
+		if strings.HasPrefix(line, "event: ") {
+			eventType = strings.TrimPrefix(line, "event: ")
+			continue
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		var event struct {
+			Type   string          `json:"type"`
+			TestID string          `json:"test_id"`
+			Kind   string          `json:"kind"`
+			Data   json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+			t.Fatalf("invalid event data %q: %v", line, err)
+		}
+		if event.Type != eventType || event.Kind != "download" || event.TestID != "session-7" {
+			t.Fatalf("unexpected %s event %+v", eventType, event)
+		}
+		seen = append(seen, event.Type)
+
+		if event.Type == "test_finished" {
+			var summary types.DownloadSummary
+			if err := json.Unmarshal(event.Data, &summary); err != nil || summary.BytesWritten != 300000 {
+				t.Errorf("unexpected summary %s", event.Data)
+			}
+			break
+		}
+	}
+
+	if len(seen) < 3 || seen[0] != "test_started" || seen[1] != "test_progress" {
+		t.Errorf("expected start, progress and finish events, got %v", seen)
+	}
+}
+
+func TestAdminTestTrace(t *testing.T) {
+	h := handlers.New(nil)
+	router := mux.NewRouter()
+	router.HandleFunc("/download", h.Download)
+	router.HandleFunc("/ping", h.Ping)
+	router.HandleFunc("/admin/api/traces", h.AdminTraces)
+	router.HandleFunc("/admin/api/traces/{id}", h.AdminTestTrace)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	get := func(path, testID string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if testID != "" {
+			req.Header.Set("X-Test-ID", testID)
+		}
+		req.Header.Set("X-Admin-API-Key", "admin_secret_key_change_in_production")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// Requests of a named session share its trace; transfers without a name start one
+	io.Copy(io.Discard, get("/download?size=1000&rate=100", "ticket-42").Body)
+	if resp := get("/ping", "ticket-42"); resp.Header.Get("X-Test-ID") != "ticket-42" {
+		t.Errorf("expected the test ID to be echoed, got %q", resp.Header.Get("X-Test-ID"))
+	}
+	if resp := get("/ping", ""); resp.Header.Get("X-Test-ID") != "" {
+		t.Error("expected pings outside a session not to be traced")
+	}
+	if resp := get("/download?size=1000", ""); resp.Header.Get("X-Test-ID") == "" {
+		t.Error("expected downloads outside a session to start one")
+	}
+
+	resp := get("/admin/api/traces/ticket-42?download=1", "")
+	if disposition := resp.Header.Get("Content-Disposition"); !strings.Contains(disposition, "test-ticket-42-trace.json") {
+		t.Errorf("expected an attachment, got %q", disposition)
+	}
+	var trace struct {
+		TestID string `json:"test_id"`
+		Failed bool   `json:"failed"`
+		Log    []struct {
+			Type   string                 `json:"type"`
+			Fields map[string]interface{} `json:"fields"`
+		} `json:"log"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&trace); err != nil {
+		t.Fatal(err)
+	}
+	var eventTypes []string
+	for _, event := range trace.Log {
+		eventTypes = append(eventTypes, event.Type)
+	}
+	if trace.TestID != "ticket-42" || trace.Failed || strings.Join(eventTypes, ",") != "throttled,download_start,download_end,ping" {
+		t.Fatalf("unexpected trace %+v", trace)
+	}
+	if written := trace.Log[2].Fields["bytes_written"]; written != float64(1000) {
+		t.Errorf("expected 1000 bytes written, got %v", written)
+	}
+
+	if resp := get("/admin/api/traces/unknown", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown trace, got %d", resp.StatusCode)
+	}
+
+	var summaries []map[string]interface{}
+	json.NewDecoder(get("/admin/api/traces?client_ip=127.0.0.1", "").Body).Decode(&summaries)
+	if len(summaries) != 2 || summaries[1]["test_id"] != "ticket-42" {
+		t.Errorf("unexpected trace list %v", summaries)
+	}
+}
+
+func TestCreateSpeedTestKeepsSessionSeparate(t *testing.T) {
+	t.Setenv("ENRICHMENT_WORKERS", "0") // No background lookups of the test client
+	h := handlers.New(newFakeDatabase())
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/tests", strings.NewReader(`{"test_type":"full"}`))
+		req.Header.Set("X-Test-ID", "session-1")
+		rr := httptest.NewRecorder()
+		h.CreateSpeedTest(rr, req)
+		return rr
+	}
+
+	first := post()
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first save: got %d %s", first.Code, first.Body.String())
+	}
+	var created map[string]string
+	json.NewDecoder(first.Body).Decode(&created)
+	if created["id"] == "" || created["id"] == "session-1" {
+		t.Errorf("expected a server-generated result ID, got %q", created["id"])
+	}
+
+	// A retried save of the same session is a conflict, not a server error
+	if retry := post(); retry.Code != http.StatusConflict {
+		t.Errorf("retried save: got %d, expected %d", retry.Code, http.StatusConflict)
+	}
+}
+
+func TestDownloadHandlerInvalidRate(t *testing.T) {
+	h := handlers.New(nil)
+
+	for _, rate := range []string{"-1", "0", "abc", "NaN", "Inf", "-Inf", "1e-300", "0.01"} {
+		req, err := http.NewRequest("GET", "/download?size=1024&rate="+rate, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		h.Download(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("rate=%s: handler returned wrong status code: got %v want %v",
+				rate, status, http.StatusBadRequest)
+		}
+		if got := rr.Header().Get("X-Throttle-Rate-Mbps"); got != "" {
+			t.Errorf("rate=%s: unexpected X-Throttle-Rate-Mbps %q", rate, got)
+		}
+	}
+}
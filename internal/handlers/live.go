@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Krea-University/speed-test-server/internal/clientip"
+	"github.com/Krea-University/speed-test-server/internal/diagnostics"
+	"github.com/Krea-University/speed-test-server/internal/events"
+	"github.com/Krea-University/speed-test-server/internal/types"
+	"github.com/google/uuid"
+)
+
+// liveProgressEveryMs is how often a transfer's progress is published to
+// the live feed; the full 100ms samples would flood a busy dashboard
+const liveProgressEveryMs = 1000
+
+// liveTransfer publishes the lifecycle of one download or upload to the
+// live feed
+type liveTransfer struct {
+	bus      *events.Bus
+	id       string
+	kind     string
+	clientIP string
+	total    int64 // bytes transferred so far
+	lastMs   int64 // elapsed time at the last progress event
+	lastSent int64 // bytes transferred at the last progress event
+}
+
+// startLive announces a transfer of size bytes (-1 when unknown). Its events
+// carry the test session's ID, like the trace and the saved result; only
+// transfers outside any session get an ID of their own.
+func (h *Handlers) startLive(r *http.Request, trace *testTrace, kind string, size int64) *liveTransfer {
+	id := diagnostics.RequestTestID(r)
+	if id == "" && trace != nil {
+		id = trace.id // Session started by this request
+	}
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	live := &liveTransfer{bus: h.events, id: id, kind: kind, clientIP: clientip.FromRequest(r)}
+	live.publish(events.TestStarted, map[string]interface{}{"size": size})
+	return live
+}
+
+// sample accumulates throughput samples and publishes the progress once per
+// liveProgressEveryMs
+func (l *liveTransfer) sample(sample types.ThroughputSample) {
+	l.total += sample.Bytes
+	elapsed := sample.ElapsedMs - l.lastMs
+	if elapsed < liveProgressEveryMs {
+		return
+	}
+
+	l.publish(events.TestProgress, types.TransferProgress{
+		ElapsedMs:        sample.ElapsedMs,
+		BytesTransferred: l.total,
+		Mbps:             float64(l.total-l.lastSent) * 8 / (float64(elapsed) * 1000),
+	})
+	l.lastMs, l.lastSent = sample.ElapsedMs, l.total
+}
+
+// finish publishes the outcome of the transfer
+func (l *liveTransfer) finish(summary interface{}) {
+	l.publish(events.TestFinished, summary)
+}
+
+func (l *liveTransfer) publish(eventType string, data interface{}) {
+	l.bus.Publish(events.Event{Type: eventType, TestID: l.id, Kind: l.kind, ClientIP: l.clientIP, Data: data})
+}
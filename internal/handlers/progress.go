@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/logging"
+	"github.com/Krea-University/speed-test-server/internal/types"
+	"github.com/gorilla/mux"
+)
+
+// progressRetention is how long a finished download's samples stay available,
+// so watchers that connect late still get the full series
+const progressRetention = 30 * time.Second
+
+// downloadProgress collects the samples of one download for its watchers
+type downloadProgress struct {
+	mu      sync.Mutex
+	samples []types.ThroughputSample
+	summary *types.DownloadSummary // Set when the download ends
+	changed chan struct{}          // Closed and replaced on every update
+}
+
+// add records a sample and wakes up watchers
+func (d *downloadProgress) add(sample types.ThroughputSample) {
+	d.mu.Lock()
+	d.samples = append(d.samples, sample)
+	close(d.changed)
+	d.changed = make(chan struct{})
+	d.mu.Unlock()
+}
+
+// finish records the summary and wakes up watchers
+func (d *downloadProgress) finish(summary types.DownloadSummary) {
+	d.mu.Lock()
+	d.summary = &summary
+	close(d.changed)
+	d.changed = make(chan struct{})
+	d.mu.Unlock()
+}
+
+// since returns the samples from index from on, the summary if the download
+// has ended, and a channel closed on the next update
+func (d *downloadProgress) since(from int) ([]types.ThroughputSample, *types.DownloadSummary, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.samples[from:], d.summary, d.changed
+}
+
+// progressRegistry tracks in-flight and recently finished downloads by ID
+type progressRegistry struct {
+	mu        sync.Mutex
+	downloads map[string]*downloadProgress
+}
+
+func newProgressRegistry() *progressRegistry {
+	return &progressRegistry{downloads: make(map[string]*downloadProgress)}
+}
+
+// start registers a download
+func (p *progressRegistry) start(id string) *downloadProgress {
+	progress := &downloadProgress{changed: make(chan struct{})}
+	p.mu.Lock()
+	p.downloads[id] = progress
+	p.mu.Unlock()
+	return progress
+}
+
+// finish records a download's summary and forgets it after progressRetention
+func (p *progressRegistry) finish(id string, summary types.DownloadSummary) {
+	p.mu.Lock()
+	progress, ok := p.downloads[id]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	progress.finish(summary)
+	time.AfterFunc(progressRetention, func() {
+		p.mu.Lock()
+		delete(p.downloads, id)
+		p.mu.Unlock()
+	})
+}
+
+// get returns a download's progress
+func (p *progressRegistry) get(id string) (*downloadProgress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	progress, ok := p.downloads[id]
+	return progress, ok
+}
+
+// WatchDownloadProgress streams the server's view of a download over
+// WebSocket: the bytes written to the connection every 100ms, then a summary.
+// Clients compare it with what they received to spot buffering artifacts.
+// GET /download/progress/{id}/ws
+func (h *Handlers) WatchDownloadProgress(w http.ResponseWriter, r *http.Request) {
+	progress, ok := h.progress.get(mux.Vars(r)["id"])
+	if !ok {
+		logging.Error(w, r, `{"error":"Download not found or expired"}`, http.StatusNotFound)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "WebSocket upgrade error", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Detect the client going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	sent := 0
+	for {
+		samples, summary, changed := progress.since(sent)
+		for i := range samples {
+			if err := conn.WriteJSON(types.DownloadProgressMessage{Type: "sample", Sample: &samples[i]}); err != nil {
+				return
+			}
+		}
+		sent += len(samples)
+
+		if summary != nil {
+			conn.WriteJSON(types.DownloadProgressMessage{Type: "done", Summary: summary})
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-closed:
+			return
+		}
+	}
+}
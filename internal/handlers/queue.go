@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/clientip"
+	"github.com/Krea-University/speed-test-server/internal/logging"
+	"github.com/Krea-University/speed-test-server/internal/types"
+	"github.com/Krea-University/speed-test-server/internal/waitingroom"
+	"github.com/gorilla/mux"
+)
+
+// SetWaitingRoom enables the waiting room API backed by the concurrent request limiter
+func (h *Handlers) SetWaitingRoom(room *waitingroom.Room) {
+	h.waitingRoom = room
+}
+
+// JoinQueue issues a waiting room ticket
+// @Summary Join the waiting room
+// @Description Issues a ticket for the next free test slot. Poll the ticket or watch it over WebSocket; once admitted, send it as X-Queue-Ticket on test requests. A ticket only works from the client IP that joined.
+// @Tags Waiting Room
+// @Produce json
+// @Success 201 {object} types.QueueTicketResponse
+// @Failure 404 {object} map[string]string
+// @Failure 429 {object} map[string]string
+// @Router /queue/tickets [post]
+func (h *Handlers) JoinQueue(w http.ResponseWriter, r *http.Request) {
+	if h.waitingRoom == nil {
+		logging.Error(w, r, `{"error":"Waiting room is not enabled"}`, http.StatusNotFound)
+		return
+	}
+
+	ticket, err := h.waitingRoom.Join(clientip.FromRequest(r))
+	if errors.Is(err, waitingroom.ErrTooManyTickets) {
+		logging.Error(w, r, `{"error":"Too many tickets for this client"}`, http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Error joining waiting room", "error", err)
+		logging.Error(w, r, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(h.ticketResponse(ticket))
+}
+
+// GetQueueTicket returns a ticket's position and status
+// @Summary Get waiting room ticket status
+// @Description Returns the ticket's queue position or admission. Waiting tickets expire if not polled.
+// @Tags Waiting Room
+// @Produce json
+// @Param id path string true "Ticket ID"
+// @Success 200 {object} types.QueueTicketResponse
+// @Failure 404 {object} map[string]string
+// @Router /queue/tickets/{id} [get]
+func (h *Handlers) GetQueueTicket(w http.ResponseWriter, r *http.Request) {
+	if h.waitingRoom == nil {
+		logging.Error(w, r, `{"error":"Waiting room is not enabled"}`, http.StatusNotFound)
+		return
+	}
+
+	ticket, err := h.waitingRoom.Status(mux.Vars(r)["id"], clientip.FromRequest(r))
+	if err != nil {
+		logging.Error(w, r, `{"error":"Ticket not found or expired"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.ticketResponse(ticket))
+}
+
+// LeaveQueue gives up a ticket
+// @Summary Leave the waiting room
+// @Description Releases a ticket's queue position or admitted slot
+// @Tags Waiting Room
+// @Param id path string true "Ticket ID"
+// @Success 204
+// @Failure 404 {object} map[string]string
+// @Router /queue/tickets/{id} [delete]
+func (h *Handlers) LeaveQueue(w http.ResponseWriter, r *http.Request) {
+	if h.waitingRoom == nil {
+		logging.Error(w, r, `{"error":"Waiting room is not enabled"}`, http.StatusNotFound)
+		return
+	}
+
+	if err := h.waitingRoom.Leave(mux.Vars(r)["id"], clientip.FromRequest(r)); err != nil {
+		logging.Error(w, r, `{"error":"Ticket not found or expired"}`, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WatchQueueTicket streams ticket status updates over WebSocket
+// GET /queue/tickets/{id}/ws
+func (h *Handlers) WatchQueueTicket(w http.ResponseWriter, r *http.Request) {
+	if h.waitingRoom == nil {
+		logging.Error(w, r, `{"error":"Waiting room is not enabled"}`, http.StatusNotFound)
+		return
+	}
+
+	id, clientIP := mux.Vars(r)["id"], clientip.FromRequest(r)
+	if _, err := h.waitingRoom.Status(id, clientIP); err != nil {
+		logging.Error(w, r, `{"error":"Ticket not found or expired"}`, http.StatusNotFound)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "WebSocket upgrade error", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Detect the client going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Refresh at least this often so the open connection keeps the ticket alive
+	keepAlive := 5 * time.Second
+
+	var last types.QueueTicketResponse
+	for {
+		changed := h.waitingRoom.Changed()
+
+		ticket, err := h.waitingRoom.Status(id, clientIP)
+		if err != nil {
+			conn.WriteJSON(map[string]string{"ticket_id": id, "status": "expired"})
+			return
+		}
+
+		response := h.ticketResponse(ticket)
+		if response.Status != last.Status || response.Position != last.Position || response.QueueLength != last.QueueLength {
+			if err := conn.WriteJSON(response); err != nil {
+				return
+			}
+			last = response
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(keepAlive):
+		case <-closed:
+			return
+		}
+	}
+}
+
+// ticketResponse converts a ticket to its API representation
+func (h *Handlers) ticketResponse(ticket waitingroom.Ticket) types.QueueTicketResponse {
+	_, _, waiting := h.waitingRoom.Stats()
+	response := types.QueueTicketResponse{
+		TicketID:    ticket.ID,
+		Status:      ticket.Status,
+		Position:    ticket.Position,
+		QueueLength: waiting,
+		ExpiresAt:   ticket.ExpiresAt.UTC().Format(time.RFC3339),
+		PollURL:     "/queue/tickets/" + ticket.ID,
+	}
+	if ticket.Status == waitingroom.StatusWaiting {
+		response.WatchURL = "/queue/tickets/" + ticket.ID + "/ws"
+	}
+	return response
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/Krea-University/speed-test-server/internal/config"
+	"github.com/Krea-University/speed-test-server/internal/logging"
+	"github.com/Krea-University/speed-test-server/internal/ratelimit"
+	"github.com/Krea-University/speed-test-server/internal/throughput"
+)
+
+// pacerFor returns the pacer for a test stream: the lower of the requested
+// rate= (Mbps) and any admin cap for the client. A nil pacer means unthrottled.
+// It writes a 400 and returns false if rate= is invalid. The decision goes
+// into the test's trace.
+func (h *Handlers) pacerFor(w http.ResponseWriter, r *http.Request, clientIP string, trace *testTrace) (*ratelimit.Pacer, bool) {
+	rate, source := 0.0, "request"
+	if rateStr := r.URL.Query().Get("rate"); rateStr != "" {
+		parsed, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || !ratelimit.ValidRate(parsed) {
+			message := fmt.Sprintf("rate must be a number of Mbps, at least %g", ratelimit.MinRateMbps)
+			trace.fail("invalid_rate", message, map[string]interface{}{"rate": rateStr})
+			logging.Error(w, r, "Invalid rate: "+message, http.StatusBadRequest)
+			return nil, false
+		}
+		rate = parsed
+	}
+
+	if capMbps, ok := h.clientCaps.Lookup(clientIP); ok && (rate == 0 || capMbps < rate) {
+		rate, source = capMbps, "client_cap"
+	}
+
+	if rate == 0 {
+		return nil, true
+	}
+
+	trace.record("throttled", map[string]interface{}{"rate_mbps": rate, "source": source})
+	w.Header().Set("X-Throttle-Rate-Mbps", strconv.FormatFloat(rate, 'f', -1, 64))
+	return ratelimit.NewPacer(rate, config.BufferSize), true
+}
+
+// meteredWriter counts download bytes against the admitted transfer and the
+// progress sampler, and paces them when the stream is throttled
+type meteredWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	transfer *ratelimit.Transfer
+	pacer    *ratelimit.Pacer
+	sampler  *throughput.Sampler
+}
+
+// Write paces large writes in BufferSize slices so throttled output stays smooth
+func (mw *meteredWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if mw.pacer != nil && n > config.BufferSize {
+			n = config.BufferSize
+		}
+
+		if err := mw.pacer.Wait(mw.ctx, n); err != nil {
+			return written, err
+		}
+
+		m, err := mw.ResponseWriter.Write(p[:n])
+		mw.transfer.Add(m)
+		mw.sampler.Add(m)
+		written += m
+		if err != nil {
+			return written, err
+		}
+
+		// Push paced slices out immediately rather than letting them pool in buffers
+		if mw.pacer != nil {
+			mw.Flush()
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Flush implements http.Flusher
+func (mw *meteredWriter) Flush() {
+	if f, ok := mw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// meteredReader counts upload bytes against the admitted transfer and the
+// throughput sampler, and paces reads when the stream is throttled
+type meteredReader struct {
+	io.Reader
+	ctx      context.Context
+	transfer *ratelimit.Transfer
+	pacer    *ratelimit.Pacer
+	sampler  *throughput.Sampler
+}
+
+func (mr *meteredReader) Read(p []byte) (int, error) {
+	if mr.pacer != nil && len(p) > config.BufferSize {
+		p = p[:config.BufferSize]
+	}
+
+	n, err := mr.Reader.Read(p)
+	mr.transfer.Add(n)
+	mr.sampler.Add(n)
+	if n > 0 {
+		if waitErr := mr.pacer.Wait(mr.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
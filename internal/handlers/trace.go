@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/clientip"
+	"github.com/Krea-University/speed-test-server/internal/diagnostics"
+	"github.com/Krea-University/speed-test-server/internal/ipservice"
+	"github.com/Krea-University/speed-test-server/internal/types"
+	"github.com/google/uuid"
+)
+
+// testTrace records the events of one request into its test session's trace.
+// A nil trace records nothing.
+type testTrace struct {
+	store     *diagnostics.Store
+	id        string
+	clientIP  string
+	userAgent string
+}
+
+// TraceStore returns the store of per-test diagnostics traces, nil when
+// they are disabled
+func (h *Handlers) TraceStore() *diagnostics.Store {
+	return h.traces
+}
+
+// traceFor returns the trace of the test session named by the X-Test-ID
+// header or test_id query parameter, echoing the ID back in X-Test-ID. When
+// the client names none (or an invalid one), a new session is started if
+// start is set; otherwise nil is returned, so stray pings don't each leave a
+// trace.
+func (h *Handlers) traceFor(w http.ResponseWriter, r *http.Request, start bool) *testTrace {
+	if h.traces == nil {
+		return nil
+	}
+
+	id := diagnostics.RequestTestID(r)
+	if id == "" {
+		if !start {
+			return nil
+		}
+		id = uuid.New().String()
+	}
+
+	w.Header().Set(diagnostics.TestIDHeader, id)
+	return h.traceOf(r, id)
+}
+
+// traceOf returns the trace of test session id
+func (h *Handlers) traceOf(r *http.Request, id string) *testTrace {
+	if h.traces == nil {
+		return nil
+	}
+	return &testTrace{store: h.traces, id: id, clientIP: clientip.FromRequest(r), userAgent: r.UserAgent()}
+}
+
+// record appends an event to the trace
+func (t *testTrace) record(eventType string, fields map[string]interface{}) {
+	if t == nil {
+		return
+	}
+	t.store.Record(t.id, t.clientIP, t.userAgent, diagnostics.Event{Type: eventType, Fields: fields})
+}
+
+// fail appends an event recording a failure
+func (t *testTrace) fail(eventType, message string, fields map[string]interface{}) {
+	if t == nil {
+		return
+	}
+	t.store.Record(t.id, t.clientIP, t.userAgent, diagnostics.Event{Type: eventType, Error: message, Fields: fields})
+}
+
+// geoLookup records where the client's geolocation came from
+func (t *testTrace) geoLookup(info *types.IPResponse, err error, took time.Duration) {
+	fields := map[string]interface{}{"duration_ms": took.Milliseconds()}
+	if err != nil {
+		fields["cached_failure"] = ipservice.IsCachedFailure(err)
+		t.fail("geo_lookup", err.Error(), fields)
+		return
+	}
+	fields["source"] = info.Source
+	if len(info.Sources) > 0 {
+		fields["sources"] = info.Sources
+	}
+	t.record("geo_lookup", fields)
+}
@@ -0,0 +1,197 @@
+package ipservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/tracing"
+	"github.com/Krea-University/speed-test-server/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"    // Provider is queried normally
+	CircuitOpen     = "open"      // Provider is skipped until the cooldown passes
+	CircuitHalfOpen = "half_open" // A single trial request decides whether to close again
+)
+
+// ErrNoRecord is returned by providers that are healthy but know nothing
+// about an address; it does not count against the provider's circuit
+var ErrNoRecord = errors.New("no record for address")
+
+// ProviderStatus reports the health of one provider in the chain
+type ProviderStatus struct {
+	Name          string     `json:"name"`
+	State         string     `json:"state"`
+	Requests      uint64     `json:"requests"`
+	Successes     uint64     `json:"successes"`
+	Failures      uint64     `json:"failures"`
+	Skipped       uint64     `json:"skipped"` // Calls not made because the circuit was open
+	SuccessRate   float64    `json:"success_rate"`
+	AvgLatencyMs  float64    `json:"avg_latency_ms"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	RetryAt       *time.Time `json:"retry_at,omitempty"` // When an open circuit will allow a trial request
+}
+
+// trackedProvider wraps a provider with a circuit breaker and call statistics
+type trackedProvider struct {
+	Provider
+	configName string // name in geoip.providers
+	settings   string // see providerSettings
+
+	mu                  sync.Mutex
+	threshold           int
+	cooldown            time.Duration
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	trialInFlight       bool
+
+	successes, failures, skipped uint64
+	totalLatency                 time.Duration
+	lastError                    string
+	lastErrorAt, lastSuccessAt   time.Time
+}
+
+// newTrackedProvider opens the circuit after threshold consecutive failures
+// and keeps it open for cooldown
+func newTrackedProvider(provider Provider, threshold int, cooldown time.Duration) *trackedProvider {
+	return &trackedProvider{
+		Provider:  provider,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     CircuitClosed,
+	}
+}
+
+// configure applies new circuit breaker settings
+func (t *trackedProvider) configure(threshold int, cooldown time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.threshold, t.cooldown = threshold, cooldown
+}
+
+// inherit takes over the circuit state and statistics of the provider this
+// one replaces. A trial request in flight on old no longer counts.
+func (t *trackedProvider) inherit(old *trackedProvider) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.state, t.consecutiveFailures, t.openedAt = old.state, old.consecutiveFailures, old.openedAt
+	t.successes, t.failures, t.skipped = old.successes, old.failures, old.skipped
+	t.totalLatency = old.totalLatency
+	t.lastError, t.lastErrorAt, t.lastSuccessAt = old.lastError, old.lastErrorAt, old.lastSuccessAt
+}
+
+// lookup queries the provider if its circuit allows it, reporting whether a
+// request was made
+func (t *trackedProvider) lookup(ctx context.Context, ip string) (*types.IPResponse, bool, error) {
+	if !t.allow() {
+		return nil, false, nil
+	}
+
+	ctx, span := tracing.Start(ctx, "geo provider "+t.Name(), attribute.String("geo.provider", t.Name()))
+	defer span.End()
+
+	start := time.Now()
+	result, err := t.GetIPInfo(ctx, ip)
+	t.record(time.Since(start), err)
+	tracing.Fail(span, err)
+	return result, true, err
+}
+
+// allow reports whether a request may be made, moving an open circuit to
+// half-open once the cooldown has passed
+func (t *trackedProvider) allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch t.state {
+	case CircuitOpen:
+		if time.Since(t.openedAt) < t.cooldown {
+			t.skipped++
+			return false
+		}
+		t.state = CircuitHalfOpen
+		t.trialInFlight = true
+		return true
+	case CircuitHalfOpen:
+		if t.trialInFlight {
+			t.skipped++
+			return false
+		}
+		t.trialInFlight = true
+		return true
+	}
+	return true
+}
+
+// record updates statistics and the circuit state after a request
+func (t *trackedProvider) record(latency time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.totalLatency += latency
+	t.trialInFlight = false
+
+	if err == nil || errors.Is(err, ErrNoRecord) {
+		t.successes++
+		t.lastSuccessAt = time.Now()
+		t.consecutiveFailures = 0
+		t.state = CircuitClosed
+		return
+	}
+
+	t.failures++
+	t.consecutiveFailures++
+	t.lastError = err.Error()
+	t.lastErrorAt = time.Now()
+
+	if t.state == CircuitHalfOpen || t.consecutiveFailures >= t.threshold {
+		t.state = CircuitOpen
+		t.openedAt = time.Now()
+	}
+}
+
+// status returns a snapshot of the provider's health
+func (t *trackedProvider) status() ProviderStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	requests := t.successes + t.failures
+	status := ProviderStatus{
+		Name:      t.Name(),
+		State:     t.state,
+		Requests:  requests,
+		Successes: t.successes,
+		Failures:  t.failures,
+		Skipped:   t.skipped,
+		LastError: t.lastError,
+	}
+
+	if requests > 0 {
+		status.SuccessRate = float64(t.successes) / float64(requests)
+		status.AvgLatencyMs = t.totalLatency.Seconds() * 1000 / float64(requests)
+	}
+	if !t.lastErrorAt.IsZero() {
+		lastErrorAt := t.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	if !t.lastSuccessAt.IsZero() {
+		lastSuccessAt := t.lastSuccessAt
+		status.LastSuccessAt = &lastSuccessAt
+	}
+	if t.state == CircuitOpen {
+		retryAt := t.openedAt.Add(t.cooldown)
+		status.RetryAt = &retryAt
+	}
+
+	return status
+}
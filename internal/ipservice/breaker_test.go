@@ -0,0 +1,153 @@
+package ipservice
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+func TestTrackedProviderOpensAndRecovers(t *testing.T) {
+	provider := &countingProvider{fail: true}
+	tracked := newTrackedProvider(provider, 2, 20*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if _, attempted, err := tracked.lookup(context.Background(), "192.0.2.1"); !attempted || err == nil {
+			t.Fatalf("call %d: expected an attempted failure", i)
+		}
+	}
+	if status := tracked.status(); status.State != CircuitOpen || status.RetryAt == nil {
+		t.Fatalf("circuit not open after repeated failures: %+v", status)
+	}
+
+	if _, attempted, _ := tracked.lookup(context.Background(), "192.0.2.1"); attempted {
+		t.Fatal("open circuit still queried the provider")
+	}
+
+	// After the cooldown a single successful trial closes the circuit
+	time.Sleep(30 * time.Millisecond)
+	provider.fail = false
+	if _, attempted, err := tracked.lookup(context.Background(), "192.0.2.1"); !attempted || err != nil {
+		t.Fatalf("trial request not made or failed: %v", err)
+	}
+
+	status := tracked.status()
+	if status.State != CircuitClosed || status.Skipped != 1 || status.Requests != 3 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if calls := provider.calls.Load(); calls != 3 {
+		t.Errorf("expected 3 provider calls, got %d", calls)
+	}
+}
+
+func TestTrackedProviderIgnoresMissingRecords(t *testing.T) {
+	tracked := newTrackedProvider(noRecordProvider{}, 1, time.Minute)
+	tracked.lookup(context.Background(), "192.0.2.1")
+	tracked.lookup(context.Background(), "192.0.2.1")
+
+	if status := tracked.status(); status.State != CircuitClosed || status.SuccessRate != 1 {
+		t.Errorf("missing records tripped the circuit: %+v", status)
+	}
+}
+
+func TestTrackedProviderSubMillisecondLatency(t *testing.T) {
+	tracked := newTrackedProvider(noRecordProvider{}, 1, time.Minute)
+	tracked.record(200*time.Microsecond, nil)
+	tracked.record(400*time.Microsecond, nil)
+
+	if avg := tracked.status().AvgLatencyMs; avg < 0.299 || avg > 0.301 {
+		t.Errorf("expected an average of 0.3ms, got %v", avg)
+	}
+}
+
+func TestServiceSkipsOpenProviders(t *testing.T) {
+	broken := newTrackedProvider(&countingProvider{fail: true}, 1, time.Minute)
+	healthy := &countingProvider{}
+	service := &Service{chain: &providerChain{providers: []*trackedProvider{broken, newTrackedProvider(healthy, 1, time.Minute)}}}
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if _, err := service.GetIPInfo(context.Background(), ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	statuses := service.ProviderStatus()
+	if statuses[0].Requests != 1 || statuses[0].Skipped != 1 || statuses[1].Successes != 2 {
+		t.Errorf("unexpected provider statuses %+v", statuses)
+	}
+}
+
+func TestServiceReloadKeepsProviderHealth(t *testing.T) {
+	t.Setenv("IP_PROVIDERS", "ip-api,freeipapi")
+	service := NewService()
+	first := service.chain.providers[0]
+	for i := 0; i < 5; i++ {
+		first.record(time.Millisecond, fmt.Errorf("lookup failed"))
+	}
+
+	// Unchanged settings keep the provider as it is
+	service.Reload()
+	if service.chain.providers[0] != first || first.status().State != CircuitOpen {
+		t.Fatalf("reload replaced an unchanged provider or reset its circuit: %+v", service.ProviderStatus())
+	}
+
+	// A rebuilt provider inherits the circuit and statistics
+	t.Setenv("IP_API_TIMEOUT_SECONDS", "2")
+	service.Reload()
+	rebuilt := service.chain.providers[0]
+	if rebuilt == first {
+		t.Fatal("expected the provider to be rebuilt for its new timeout")
+	}
+	if status := rebuilt.status(); status.State != CircuitOpen || status.Failures != 5 {
+		t.Errorf("rebuilt provider lost its health: %+v", status)
+	}
+}
+
+func TestServiceReloadClosesProvidersAfterLookups(t *testing.T) {
+	retired := &closingProvider{started: make(chan struct{}), release: make(chan struct{}), closed: make(chan struct{})}
+	service := &Service{chain: &providerChain{providers: []*trackedProvider{newTrackedProvider(retired, 3, time.Minute)}}}
+	go service.queryProviders(context.Background(), "192.0.2.1")
+	<-retired.started
+
+	t.Setenv("IP_PROVIDERS", "ip-api")
+	service.Reload()
+
+	select {
+	case <-retired.closed:
+		t.Fatal("provider closed while a lookup was still using it")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(retired.release)
+	select {
+	case <-retired.closed:
+	case <-time.After(time.Second):
+		t.Fatal("provider not closed after its lookup finished")
+	}
+}
+
+// closingProvider blocks lookups until released and records when it is closed
+type closingProvider struct {
+	started, release, closed chan struct{}
+}
+
+func (p *closingProvider) Name() string { return "closing" }
+
+func (p *closingProvider) GetIPInfo(_ context.Context, ip string) (*types.IPResponse, error) {
+	close(p.started)
+	<-p.release
+	return &types.IPResponse{IP: ip}, nil
+}
+
+func (p *closingProvider) Close() { close(p.closed) }
+
+// noRecordProvider never has data but is otherwise healthy
+type noRecordProvider struct{}
+
+func (noRecordProvider) Name() string { return "empty" }
+
+func (noRecordProvider) GetIPInfo(_ context.Context, ip string) (*types.IPResponse, error) {
+	return nil, fmt.Errorf("empty: %w", ErrNoRecord)
+}
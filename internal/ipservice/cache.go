@@ -0,0 +1,168 @@
+package ipservice
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+// CacheStore persists geolocation results across restarts (e.g. in the database)
+type CacheStore interface {
+	LoadIPInfo(ctx context.Context, ip string) (*types.IPResponse, time.Time, error)
+	SaveIPInfo(ctx context.Context, ip string, info *types.IPResponse, expiresAt time.Time) error
+}
+
+// CacheStats reports cache effectiveness counters
+type CacheStats struct {
+	Size           int    `json:"size"`
+	Capacity       int    `json:"capacity"`
+	Hits           uint64 `json:"hits"`
+	Misses         uint64 `json:"misses"`
+	NegativeHits   uint64 `json:"negative_hits"`
+	PersistentHits uint64 `json:"persistent_hits"`
+	SharedLookups  uint64 `json:"shared_lookups"` // Concurrent lookups deduplicated into one
+	Evictions      uint64 `json:"evictions"`
+}
+
+// lookupCache is an LRU cache with per-entry expiry. Failed lookups are cached
+// too (negative caching) so a dead address doesn't hammer every provider.
+type lookupCache struct {
+	mu          sync.Mutex
+	capacity    int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	entries     map[string]*list.Element
+	lru         *list.List
+
+	hits, misses, negativeHits, persistentHits, sharedLookups, evictions atomic.Uint64
+}
+
+// cacheEntry is a cached lookup result or failure
+type cacheEntry struct {
+	ip        string
+	info      *types.IPResponse
+	err       error
+	expiresAt time.Time
+}
+
+// newLookupCache creates a cache holding up to capacity entries
+func newLookupCache(capacity int, ttl, negativeTTL time.Duration) *lookupCache {
+	return &lookupCache{
+		capacity:    capacity,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// get returns a live entry for ip, promoting it in the LRU order
+func (c *lookupCache) get(ip string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[ip]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.lru.Remove(elem)
+		delete(c.entries, ip)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// put stores a result (err == nil) or failure and returns its expiry
+func (c *lookupCache) put(ip string, info *types.IPResponse, err error) time.Time {
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	expiresAt := time.Now().Add(ttl)
+	c.putUntil(ip, info, err, expiresAt)
+	return expiresAt
+}
+
+// putUntil stores an entry with an explicit expiry
+func (c *lookupCache) putUntil(ip string, info *types.IPResponse, err error, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{ip: ip, info: info, err: err, expiresAt: expiresAt}
+	if elem, ok := c.entries[ip]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[ip] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).ip)
+		c.evictions.Add(1)
+	}
+}
+
+// stats returns a snapshot of the counters
+func (c *lookupCache) stats() CacheStats {
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Size:           size,
+		Capacity:       c.capacity,
+		Hits:           c.hits.Load(),
+		Misses:         c.misses.Load(),
+		NegativeHits:   c.negativeHits.Load(),
+		PersistentHits: c.persistentHits.Load(),
+		SharedLookups:  c.sharedLookups.Load(),
+		Evictions:      c.evictions.Load(),
+	}
+}
+
+// errCachedFailure wraps a cached negative result
+type errCachedFailure struct {
+	err error
+}
+
+func (e *errCachedFailure) Error() string {
+	return "cached failure: " + e.err.Error()
+}
+
+func (e *errCachedFailure) Unwrap() error {
+	return e.err
+}
+
+// IsCachedFailure reports whether err came from the negative cache
+func IsCachedFailure(err error) bool {
+	var cached *errCachedFailure
+	return errors.As(err, &cached)
+}
+
+// copyIPResponse returns a copy so callers can't mutate cached data
+func copyIPResponse(info *types.IPResponse) *types.IPResponse {
+	if info == nil {
+		return nil
+	}
+	clone := *info
+	if info.Sources != nil {
+		clone.Sources = make(map[string]string, len(info.Sources))
+		for field, source := range info.Sources {
+			clone.Sources[field] = source
+		}
+	}
+	return &clone
+}
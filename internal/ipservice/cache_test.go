@@ -0,0 +1,100 @@
+package ipservice
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+// countingProvider records how often it is queried
+type countingProvider struct {
+	calls atomic.Int32
+	delay time.Duration
+	fail  bool
+}
+
+func (p *countingProvider) Name() string { return "counting" }
+
+func (p *countingProvider) GetIPInfo(_ context.Context, ip string) (*types.IPResponse, error) {
+	p.calls.Add(1)
+	time.Sleep(p.delay)
+	if p.fail {
+		return nil, fmt.Errorf("lookup failed")
+	}
+	return &types.IPResponse{IP: ip, City: "Sri City"}, nil
+}
+
+func newTestService(provider Provider, capacity int) *Service {
+	return &Service{
+		chain: &providerChain{providers: []*trackedProvider{newTrackedProvider(provider, 3, time.Minute)}},
+		cache: newLookupCache(capacity, time.Minute, time.Minute),
+	}
+}
+
+func TestServiceCachesAndDeduplicatesLookups(t *testing.T) {
+	provider := &countingProvider{delay: 50 * time.Millisecond}
+	service := newTestService(provider, 10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := service.GetIPInfo(context.Background(), "203.0.113.7"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	info, err := service.GetIPInfo(context.Background(), "203.0.113.7")
+	if err != nil || info.City != "Sri City" || info.Source != "counting" {
+		t.Fatalf("unexpected cached result %+v (%v)", info, err)
+	}
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 provider call, got %d", calls)
+	}
+
+	stats := service.CacheStats()
+	if stats.Hits != 1 || stats.Misses != 8 || stats.SharedLookups != 7 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestServiceCachesFailures(t *testing.T) {
+	provider := &countingProvider{fail: true}
+	service := newTestService(provider, 10)
+
+	if _, err := service.GetIPInfo(context.Background(), "198.51.100.1"); err == nil || IsCachedFailure(err) {
+		t.Fatalf("expected a fresh failure, got %v", err)
+	}
+	if _, err := service.GetIPInfo(context.Background(), "198.51.100.1"); !IsCachedFailure(err) {
+		t.Fatalf("expected a cached failure, got %v", err)
+	}
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 provider call, got %d", calls)
+	}
+}
+
+func TestLookupCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLookupCache(2, time.Minute, time.Minute)
+	cache.put("a", &types.IPResponse{IP: "a"}, nil)
+	cache.put("b", &types.IPResponse{IP: "b"}, nil)
+	cache.get("a")
+	cache.put("c", &types.IPResponse{IP: "c"}, nil)
+
+	if _, ok := cache.get("b"); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	if _, ok := cache.get("a"); !ok {
+		t.Error("recently used entry was evicted")
+	}
+	if stats := cache.stats(); stats.Evictions != 1 || stats.Size != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,126 @@
+package ipservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+// Network types reported in IPResponse.NetworkType
+const (
+	NetworkPublic      = "public"
+	NetworkPrivate     = "private"      // RFC 1918
+	NetworkUniqueLocal = "unique_local" // RFC 4193 IPv6 ULA
+	NetworkCGNAT       = "cgnat"        // RFC 6598 shared address space
+	NetworkLoopback    = "loopback"
+	NetworkLinkLocal   = "link_local"
+)
+
+// reservedNetworks are ranges that public geolocation APIs can't place
+var reservedNetworks = []struct {
+	cidr        string
+	networkType string
+}{
+	{"10.0.0.0/8", NetworkPrivate},
+	{"172.16.0.0/12", NetworkPrivate},
+	{"192.168.0.0/16", NetworkPrivate},
+	{"100.64.0.0/10", NetworkCGNAT},
+	{"127.0.0.0/8", NetworkLoopback},
+	{"169.254.0.0/16", NetworkLinkLocal},
+	{"::1/128", NetworkLoopback},
+	{"fc00::/7", NetworkUniqueLocal},
+	{"fe80::/10", NetworkLinkLocal},
+}
+
+// CampusNetwork labels a campus subnet, e.g. a hostel or lab
+type CampusNetwork struct {
+	CIDR     string `json:"cidr"`
+	Name     string `json:"name"`               // Network name, e.g. "Hostel Wi-Fi"
+	Building string `json:"building,omitempty"` // Building or area, e.g. "Hostel A"
+
+	network *net.IPNet
+}
+
+// Classifier labels addresses as public, reserved or belonging to a campus subnet
+type Classifier struct {
+	reserved []classifiedNetwork
+	campus   []CampusNetwork // Most specific first
+}
+
+type classifiedNetwork struct {
+	network     *net.IPNet
+	networkType string
+}
+
+// NewClassifier creates a classifier for the given campus subnets
+func NewClassifier(campus []CampusNetwork) (*Classifier, error) {
+	c := &Classifier{}
+	for _, reserved := range reservedNetworks {
+		_, network, _ := net.ParseCIDR(reserved.cidr)
+		c.reserved = append(c.reserved, classifiedNetwork{network: network, networkType: reserved.networkType})
+	}
+
+	for _, entry := range campus {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(entry.CIDR))
+		if err != nil {
+			return nil, fmt.Errorf("invalid campus network CIDR %q", entry.CIDR)
+		}
+		entry.network = network
+		c.campus = append(c.campus, entry)
+	}
+
+	// Check nested subnets (a lab inside a building range) before their parents
+	sort.SliceStable(c.campus, func(i, j int) bool {
+		iOnes, _ := c.campus[i].network.Mask.Size()
+		jOnes, _ := c.campus[j].network.Mask.Size()
+		return iOnes > jOnes
+	})
+
+	return c, nil
+}
+
+// LoadCampusNetworks reads a JSON array of campus networks from path
+func LoadCampusNetworks(path string) ([]CampusNetwork, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read campus networks file: %v", err)
+	}
+
+	var networks []CampusNetwork
+	if err := json.Unmarshal(data, &networks); err != nil {
+		return nil, fmt.Errorf("failed to parse campus networks file %s: %v", path, err)
+	}
+	return networks, nil
+}
+
+// Classify fills in the network labels of info for its IP address. It reports
+// whether the address is public and worth sending to geolocation providers.
+func (c *Classifier) Classify(info *types.IPResponse) bool {
+	ip := net.ParseIP(info.IP)
+	if ip == nil {
+		return true
+	}
+
+	info.NetworkType = NetworkPublic
+	for _, reserved := range c.reserved {
+		if reserved.network.Contains(ip) {
+			info.NetworkType = reserved.networkType
+			break
+		}
+	}
+
+	for _, campus := range c.campus {
+		if campus.network.Contains(ip) {
+			info.NetworkName = campus.Name
+			info.Building = campus.Building
+			break
+		}
+	}
+
+	return info.NetworkType == NetworkPublic
+}
@@ -0,0 +1,61 @@
+package ipservice
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+func TestClassifierLabelsReservedAndCampusNetworks(t *testing.T) {
+	classifier, err := NewClassifier([]CampusNetwork{
+		{CIDR: "10.20.0.0/16", Name: "Hostel Wi-Fi", Building: "Hostels"},
+		{CIDR: "10.20.5.0/24", Name: "Hostel Wi-Fi", Building: "Hostel A"},
+		{CIDR: "203.0.113.0/24", Name: "Library", Building: "Library"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip, networkType, building string
+		public                    bool
+	}{
+		{"10.20.5.9", NetworkPrivate, "Hostel A", false},
+		{"10.20.9.9", NetworkPrivate, "Hostels", false},
+		{"172.20.1.1", NetworkPrivate, "", false},
+		{"100.72.0.1", NetworkCGNAT, "", false},
+		{"127.0.0.1", NetworkLoopback, "", false},
+		{"fd12:3456::1", NetworkUniqueLocal, "", false},
+		{"203.0.113.40", NetworkPublic, "Library", true},
+		{"8.8.8.8", NetworkPublic, "", true},
+	}
+
+	for _, tt := range tests {
+		info := &types.IPResponse{IP: tt.ip}
+		public := classifier.Classify(info)
+		if public != tt.public || info.NetworkType != tt.networkType || info.Building != tt.building {
+			t.Errorf("%s: got public=%v type=%q building=%q", tt.ip, public, info.NetworkType, info.Building)
+		}
+	}
+}
+
+func TestServiceAnswersPrivateAddressesLocally(t *testing.T) {
+	provider := &countingProvider{}
+	classifier, _ := NewClassifier([]CampusNetwork{{CIDR: "10.1.0.0/16", Name: "Lab LAN", Building: "Science Block"}})
+	service := newTestService(provider, 10)
+	service.classifier = classifier
+
+	info, err := service.GetIPInfo(context.Background(), "10.1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NetworkName != "Lab LAN" || info.Source != "local" || provider.calls.Load() != 0 {
+		t.Errorf("private address not answered locally: %+v", info)
+	}
+
+	info, _ = service.GetIPInfo(context.Background(), "198.51.100.7")
+	if info.NetworkType != NetworkPublic || info.City == "" {
+		t.Errorf("public address not geolocated: %+v", info)
+	}
+}
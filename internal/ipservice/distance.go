@@ -0,0 +1,50 @@
+package ipservice
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// earthRadiusKm is the mean Earth radius used for great-circle distances
+const earthRadiusKm = 6371.0
+
+// ParseLocation parses a "lat,lng" string as returned in IPResponse.Location
+func ParseLocation(location string) (float64, float64, bool) {
+	latStr, lngStr, ok := strings.Cut(location, ",")
+	if !ok {
+		return 0, 0, false
+	}
+
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(lngStr), 64)
+	if err != nil || lng < -180 || lng > 180 {
+		return 0, 0, false
+	}
+
+	return lat, lng, true
+}
+
+// DistanceKm returns the great-circle (haversine) distance between two
+// "lat,lng" locations, reporting false if either can't be parsed
+func DistanceKm(from, to string) (float64, bool) {
+	lat1, lng1, ok := ParseLocation(from)
+	if !ok {
+		return 0, false
+	}
+	lat2, lng2, ok := ParseLocation(to)
+	if !ok {
+		return 0, false
+	}
+
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return earthRadiusKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a)), true
+}
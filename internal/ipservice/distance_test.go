@@ -0,0 +1,24 @@
+package ipservice
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistanceKm(t *testing.T) {
+	// Chennai to Bengaluru is roughly 290 km as the crow flies
+	distance, ok := DistanceKm("13.0827,80.2707", "12.9716,77.5946")
+	if !ok || math.Abs(distance-290) > 5 {
+		t.Errorf("unexpected distance %.1f (ok=%v)", distance, ok)
+	}
+
+	if distance, ok := DistanceKm("13.0827,80.2707", "13.0827,80.2707"); !ok || distance != 0 {
+		t.Errorf("same point: got %.3f", distance)
+	}
+
+	for _, bad := range []string{"", "13.08", "north,south", "95,10"} {
+		if _, ok := DistanceKm(bad, "12.9716,77.5946"); ok {
+			t.Errorf("%q accepted as a location", bad)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package ipservice
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+// Provider chain modes
+const (
+	ModeFirst = "first" // Use the first provider that succeeds
+	ModeMerge = "merge" // Fill missing fields from later providers
+)
+
+// mergeFields are the IPResponse fields filled field-by-field in merge mode,
+// keyed by the name used in IPResponse.Sources
+var mergeFields = []struct {
+	name  string
+	field func(*types.IPResponse) *string
+}{
+	{"city", func(r *types.IPResponse) *string { return &r.City }},
+	{"region", func(r *types.IPResponse) *string { return &r.Region }},
+	{"country", func(r *types.IPResponse) *string { return &r.Country }},
+	{"location", func(r *types.IPResponse) *string { return &r.Location }},
+	{"postal", func(r *types.IPResponse) *string { return &r.Postal }},
+	{"timezone", func(r *types.IPResponse) *string { return &r.Timezone }},
+	{"isp", func(r *types.IPResponse) *string { return &r.ISP }},
+}
+
+// mergeResult fills the empty fields of base from a later provider's result,
+// recording which provider supplied each field. It reports whether base is
+// now complete.
+func mergeResult(base, other *types.IPResponse, source string) bool {
+	complete := true
+	for _, f := range mergeFields {
+		value := f.field(base)
+		if *value == "" {
+			if *f.field(other) != "" {
+				*value = *f.field(other)
+				base.Sources[f.name] = source
+			} else {
+				complete = false
+			}
+		}
+	}
+
+	if base.ASNNumber == 0 {
+		if other.ASNNumber != 0 {
+			base.ASN, base.ASNNumber, base.ASNOrg = other.ASN, other.ASNNumber, other.ASNOrg
+			base.Sources["asn"] = source
+		} else {
+			complete = false
+		}
+	}
+
+	return complete
+}
+
+// attributeFields records source as the provider of every non-empty field.
+// It reports whether info is complete, with every merged field filled in.
+func attributeFields(info *types.IPResponse, source string) bool {
+	info.Sources = make(map[string]string)
+	complete := true
+	for _, f := range mergeFields {
+		if *f.field(info) != "" {
+			info.Sources[f.name] = source
+		} else {
+			complete = false
+		}
+	}
+	if info.ASNNumber != 0 {
+		info.Sources["asn"] = source
+	} else {
+		complete = false
+	}
+	return complete
+}
+
+// normalizeASN splits an ASN string such as "AS15169 Google LLC" into its
+// number and organization name
+func normalizeASN(info *types.IPResponse) {
+	asn := strings.TrimSpace(info.ASN)
+	if asn == "" {
+		return
+	}
+
+	number, org, _ := strings.Cut(asn, " ")
+	number = strings.TrimPrefix(strings.ToUpper(number), "AS")
+	parsed, err := strconv.ParseUint(number, 10, 32)
+	if err != nil || parsed == 0 {
+		return
+	}
+
+	info.ASNNumber = uint32(parsed)
+	info.ASNOrg = strings.TrimSpace(org)
+	if info.ASNOrg == "" {
+		info.ASNOrg = info.ISP
+	}
+}
@@ -0,0 +1,119 @@
+package ipservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+// staticProvider returns a fixed result
+type staticProvider struct {
+	name   string
+	result types.IPResponse
+}
+
+func (p *staticProvider) Name() string { return p.name }
+
+func (p *staticProvider) GetIPInfo(_ context.Context, ip string) (*types.IPResponse, error) {
+	result := p.result
+	result.IP = ip
+	return &result, nil
+}
+
+func TestServiceMergesProviderResults(t *testing.T) {
+	sparse := &staticProvider{name: "sparse", result: types.IPResponse{City: "Chennai", Country: "IN"}}
+	detailed := &staticProvider{name: "detailed", result: types.IPResponse{
+		City: "Madras", Region: "Tamil Nadu", ISP: "Example ISP", ASN: "AS55836 Reliance Jio",
+	}}
+	unused := &countingProvider{}
+
+	service := &Service{mode: ModeMerge, chain: &providerChain{providers: []*trackedProvider{
+		newTrackedProvider(sparse, 3, time.Minute),
+		newTrackedProvider(detailed, 3, time.Minute),
+		newTrackedProvider(unused, 3, time.Minute),
+	}}}
+
+	info, err := service.GetIPInfo(context.Background(), "203.0.113.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.City != "Chennai" || info.Region != "Tamil Nadu" || info.ISP != "Example ISP" {
+		t.Errorf("fields not merged: %+v", info)
+	}
+	if info.ASNNumber != 55836 || info.ASNOrg != "Reliance Jio" {
+		t.Errorf("ASN not normalized: %d %q", info.ASNNumber, info.ASNOrg)
+	}
+
+	want := map[string]string{"city": "sparse", "country": "sparse", "region": "detailed", "isp": "detailed", "asn": "detailed"}
+	for field, source := range want {
+		if info.Sources[field] != source {
+			t.Errorf("field %s attributed to %q, want %q", field, info.Sources[field], source)
+		}
+	}
+
+	// Location, postal and timezone are still missing, so the chain continues
+	if unused.calls.Load() != 1 {
+		t.Errorf("expected the third provider to be consulted, got %d calls", unused.calls.Load())
+	}
+}
+
+func TestServiceMergeStopsWhenFirstResultComplete(t *testing.T) {
+	complete := &staticProvider{name: "mmdb", result: types.IPResponse{
+		City: "Sri City", Region: "Andhra Pradesh", Country: "IN", Location: "13.55,79.99",
+		Postal: "517646", Timezone: "Asia/Kolkata", ISP: "Krea University", ASN: "AS9829 BSNL",
+	}}
+	paid := &countingProvider{}
+	service := &Service{mode: ModeMerge, chain: &providerChain{providers: []*trackedProvider{
+		newTrackedProvider(complete, 3, time.Minute),
+		newTrackedProvider(paid, 3, time.Minute),
+	}}}
+
+	info, err := service.GetIPInfo(context.Background(), "203.0.113.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Source != "mmdb" || paid.calls.Load() != 0 {
+		t.Errorf("expected a complete first result to end the chain, got %+v after %d further calls", info, paid.calls.Load())
+	}
+}
+
+func TestServiceFirstModeStopsAtFirstSuccess(t *testing.T) {
+	first := &staticProvider{name: "first", result: types.IPResponse{City: "Sri City", ASN: "AS9829"}}
+	second := &countingProvider{}
+	service := &Service{mode: ModeFirst, chain: &providerChain{providers: []*trackedProvider{
+		newTrackedProvider(first, 3, time.Minute),
+		newTrackedProvider(second, 3, time.Minute),
+	}}}
+
+	info, err := service.GetIPInfo(context.Background(), "203.0.113.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Source != "first" || info.Sources != nil || info.ASNNumber != 9829 || second.calls.Load() != 0 {
+		t.Errorf("unexpected first-mode result %+v", info)
+	}
+}
+
+func TestNormalizeASN(t *testing.T) {
+	tests := []struct {
+		asn, isp string
+		number   uint32
+		org      string
+	}{
+		{"AS15169 Google LLC", "", 15169, "Google LLC"},
+		{"as13335", "Cloudflare", 13335, "Cloudflare"},
+		{"Google LLC", "", 0, ""},
+		{"", "", 0, ""},
+	}
+
+	for _, tt := range tests {
+		info := &types.IPResponse{ASN: tt.asn, ISP: tt.isp}
+		normalizeASN(info)
+		if info.ASNNumber != tt.number || info.ASNOrg != tt.org {
+			t.Errorf("%q: got %d %q", tt.asn, info.ASNNumber, info.ASNOrg)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package ipservice
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/filewatch"
+	"github.com/Krea-University/speed-test-server/internal/types"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbReloadInterval is how often database files are checked for changes
+const mmdbReloadInterval = 30 * time.Second
+
+// MMDBProvider looks up IP information in local MaxMind or DB-IP MMDB files,
+// so geolocation works without outbound requests (e.g. air-gapped networks)
+type MMDBProvider struct {
+	city *mmdbFile
+	asn  *mmdbFile
+}
+
+// mmdbCityRecord holds the fields read from a GeoIP2/GeoLite2/DB-IP city database
+type mmdbCityRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+		TimeZone  string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+}
+
+// mmdbASNRecord holds the fields read from a GeoLite2/DB-IP ASN database
+type mmdbASNRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// NewMMDBProvider opens the city and/or ASN databases (either path may be
+// empty) and starts watching them for changes
+func NewMMDBProvider(cityPath, asnPath string) (*MMDBProvider, error) {
+	if cityPath == "" && asnPath == "" {
+		return nil, fmt.Errorf("no MMDB database configured")
+	}
+
+	p := &MMDBProvider{}
+	var err error
+	if cityPath != "" {
+		if p.city, err = openMMDBFile(cityPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if p.asn, err = openMMDBFile(asnPath); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Name returns the provider name
+func (p *MMDBProvider) Name() string {
+	return "mmdb"
+}
+
+// GetIPInfo looks up IP information in the local databases
+func (p *MMDBProvider) GetIPInfo(_ context.Context, ip string) (*types.IPResponse, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("mmdb: invalid IP address %q", ip)
+	}
+
+	result := &types.IPResponse{IP: ip}
+	found := false
+
+	if p.city != nil {
+		var record mmdbCityRecord
+		ok, err := p.city.lookup(parsed, &record)
+		if err != nil {
+			return nil, fmt.Errorf("mmdb city lookup failed: %v", err)
+		}
+		if ok {
+			found = true
+			result.City = record.City.Names["en"]
+			result.Country = record.Country.ISOCode
+			if len(record.Subdivisions) > 0 {
+				result.Region = record.Subdivisions[0].Names["en"]
+			}
+			if record.Location.Latitude != 0 || record.Location.Longitude != 0 {
+				result.Location = fmt.Sprintf("%.4f,%.4f", record.Location.Latitude, record.Location.Longitude)
+			}
+			result.Timezone = record.Location.TimeZone
+			result.Postal = record.Postal.Code
+		}
+	}
+
+	if p.asn != nil {
+		var record mmdbASNRecord
+		ok, err := p.asn.lookup(parsed, &record)
+		if err != nil {
+			return nil, fmt.Errorf("mmdb asn lookup failed: %v", err)
+		}
+		if ok && record.Number != 0 {
+			found = true
+			result.ASN = "AS" + strconv.FormatUint(uint64(record.Number), 10)
+			if record.Organization != "" {
+				result.ASN += " " + record.Organization
+			}
+			result.ISP = record.Organization
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("mmdb: %w: %s", ErrNoRecord, ip)
+	}
+
+	return result, nil
+}
+
+// Close stops watching and closes the databases
+func (p *MMDBProvider) Close() {
+	if p.city != nil {
+		p.city.close()
+	}
+	if p.asn != nil {
+		p.asn.close()
+	}
+}
+
+// mmdbFile is an MMDB database that is reopened when the file on disk changes,
+// so updates from geoipupdate are picked up without a restart
+type mmdbFile struct {
+	path    string
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	watcher *filewatch.Watcher
+}
+
+// openMMDBFile opens a database and starts its reload watcher
+func openMMDBFile(path string) (*mmdbFile, error) {
+	f := &mmdbFile{path: path}
+	watcher, err := filewatch.New("MMDB "+path, mmdbReloadInterval, f.reload, path)
+	if err != nil {
+		return nil, err
+	}
+	f.watcher = watcher
+
+	return f, nil
+}
+
+// lookup decodes the record for ip into result, reporting whether one was found
+func (f *mmdbFile) lookup(ip net.IP, result interface{}) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.reader == nil {
+		return false, fmt.Errorf("MMDB %s is closed", f.path)
+	}
+	_, ok, err := f.reader.LookupNetwork(ip, result)
+	return ok, err
+}
+
+// reload opens the file and swaps it in if it is valid
+func (f *mmdbFile) reload() error {
+	reader, err := maxminddb.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to open MMDB %s: %v", f.path, err)
+	}
+
+	f.mu.Lock()
+	old := f.reader
+	f.reader = reader
+	f.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	slog.Info("Loaded MMDB", "file", f.path, "type", reader.Metadata.DatabaseType,
+		"built", time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC().Format("2006-01-02"))
+	return nil
+}
+
+// close stops the watcher and closes the reader
+func (f *mmdbFile) close() {
+	f.watcher.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+}
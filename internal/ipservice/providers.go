@@ -2,64 +2,410 @@
 package ipservice
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"os"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Krea-University/speed-test-server/internal/config"
+	"github.com/Krea-University/speed-test-server/internal/tracing"
 	"github.com/Krea-University/speed-test-server/internal/types"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
 )
 
 // Provider interface defines methods that IP geolocation providers must implement
 type Provider interface {
-	GetIPInfo(ip string) (*types.IPResponse, error)
+	GetIPInfo(ctx context.Context, ip string) (*types.IPResponse, error)
 	Name() string
 }
 
 // Service manages multiple IP geolocation providers with fallback support
 type Service struct {
-	providers []Provider
-	client    *http.Client
+	mu         sync.RWMutex // guards chain, classifier and mode, which change on Reload
+	chain      *providerChain
+	classifier *Classifier  // labels reserved and campus networks
+	mode       string       // ModeFirst or ModeMerge
+	cache      *lookupCache // nil when caching is disabled
+	store      CacheStore   // optional persistent second-level cache
+	group      singleflight.Group
 }
 
-// NewService creates a new IP service with configured providers
+// providerChain is the provider list of one configuration. Lookups register
+// with it so providers dropped by a reload are closed only once unused.
+type providerChain struct {
+	providers []*trackedProvider
+	lookups   sync.WaitGroup
+}
+
+// NewService creates a new IP service with the configured provider chain
 func NewService() *Service {
+	service := &Service{
+		mode:       config.GetIPProviderMode(),
+		classifier: loadClassifier(),
+		chain:      &providerChain{providers: loadProviders(nil)},
+	}
+
+	if size := config.GetIPCacheSize(); size > 0 {
+		service.cache = newLookupCache(size, config.GetIPCacheTTL(), config.GetIPCacheNegativeTTL())
+	}
+
+	return service
+}
+
+// Reload rebuilds the provider chain, merge mode and campus network labels
+// from the current configuration. Cached results are kept, as are providers
+// whose settings are unchanged; the circuit and statistics of the others
+// carry over by name. Replaced providers are closed once lookups using the
+// previous chain have finished.
+func (s *Service) Reload() {
+	mode := config.GetIPProviderMode()
+	classifier := loadClassifier()
+
+	s.mu.RLock()
+	previous := s.chain
+	s.mu.RUnlock()
+	chain := &providerChain{providers: loadProviders(previous.providers)}
+
+	s.mu.Lock()
+	old := s.chain
+	s.chain, s.classifier, s.mode = chain, classifier, mode
+	s.mu.Unlock()
+
+	s.retire(old, chain)
+}
+
+// retire closes the providers of old that chain no longer uses, after the
+// lookups still running on old finish
+func (s *Service) retire(old, chain *providerChain) {
+	var retired []Provider
+	for _, provider := range old.providers {
+		if !slices.Contains(chain.providers, provider) {
+			retired = append(retired, provider.Provider)
+		}
+	}
+	if len(retired) == 0 {
+		return
+	}
+
+	go func() {
+		old.lookups.Wait()
+		for _, provider := range retired {
+			if closer, ok := provider.(interface{ Close() }); ok {
+				closer.Close()
+			}
+		}
+	}()
+}
+
+// loadClassifier builds the network classifier from the configured campus
+// networks file, falling back to reserved ranges only
+func loadClassifier() *Classifier {
+	var campus []CampusNetwork
+	if path := config.GetCampusNetworksFile(); path != "" {
+		networks, err := LoadCampusNetworks(path)
+		if err != nil {
+			slog.Warn("Campus network labels disabled", "error", err)
+		} else {
+			campus = networks
+		}
+	}
+	classifier, err := NewClassifier(campus)
+	if err != nil {
+		slog.Warn("Campus network labels disabled", "error", err)
+		classifier, _ = NewClassifier(nil)
+	}
+	return classifier
+}
+
+// loadProviders builds the configured provider chain, skipping providers
+// that aren't set up. Providers of previous with unchanged settings are
+// reused; rebuilt ones inherit the circuit and statistics of the provider
+// they replace.
+func loadProviders(previous []*trackedProvider) []*trackedProvider {
+	threshold := config.GetProviderFailureThreshold()
+	cooldown := config.GetProviderCooldown()
+
+	byName := make(map[string]*trackedProvider, len(previous))
+	for _, provider := range previous {
+		byName[provider.configName] = provider
+	}
+
+	var providers []*trackedProvider
+	var active []string
+	for _, name := range config.GetIPProviders() {
+		settings := providerSettings(name)
+		old := byName[name]
+		if old != nil && old.settings == settings {
+			old.configure(threshold, cooldown)
+			providers = append(providers, old)
+			active = append(active, old.Name())
+			continue
+		}
+
+		provider, err := newProvider(name)
+		if err != nil {
+			slog.Warn("IP provider disabled", "provider", name, "error", err)
+			continue
+		}
+		if provider == nil {
+			continue
+		}
+		tracked := newTrackedProvider(provider, threshold, cooldown)
+		tracked.configName, tracked.settings = name, settings
+		if old != nil {
+			tracked.inherit(old)
+		}
+		providers = append(providers, tracked)
+		active = append(active, provider.Name())
+	}
+
+	if len(active) == 0 {
+		slog.Warn("No IP geolocation providers active, lookups will return the IP only")
+	} else {
+		slog.Info("IP geolocation providers active", "providers", strings.Join(active, " -> "))
+	}
+
+	return providers
+}
+
+// providerSettings describes the configuration a provider is built from,
+// so a reload can tell whether it needs rebuilding
+func providerSettings(name string) string {
+	token, _, _ := config.GetIPProviderToken(name)
+	cityDB, asnDB := config.GetGeoIPDatabases()
+	return fmt.Sprintf("timeout=%s token=%x city=%s asn=%s",
+		config.GetIPProviderTimeout(name), sha256.Sum256([]byte(token)), cityDB, asnDB)
+}
+
+// newProvider builds a provider by its configured name. It returns nil
+// without an error for optional providers that aren't set up.
+func newProvider(name string) (Provider, error) {
 	client := &http.Client{
-		Timeout: 5 * time.Second,
+		Timeout:   config.GetIPProviderTimeout(name),
+		Transport: tracing.Transport(nil),
 	}
 
-	service := &Service{
-		client: client,
+	switch name {
+	case "mmdb":
+		// Local MMDB databases let lookups work offline
+		cityDB, asnDB := config.GetGeoIPDatabases()
+		if cityDB == "" && asnDB == "" {
+			return nil, nil
+		}
+		return NewMMDBProvider(cityDB, asnDB)
+	case "ipinfo", "ipinfo.io":
+		token, source, err := config.GetIPProviderToken("ipinfo")
+		if err != nil {
+			return nil, err
+		}
+		if token == "" {
+			return nil, fmt.Errorf("no credentials configured (set IPINFO_TOKEN, IPINFO_TOKEN_FILE or geoip.credentials_file)")
+		}
+		slog.Info("IP provider ipinfo.io using token", "source", source)
+		return NewIPInfoProvider(client, token), nil
+	case "ip-api", "ip-api.com":
+		return NewIPAPIProvider(client), nil
+	case "freeipapi", "freeipapi.com":
+		return NewFreeGeoIPProvider(client), nil
+	default:
+		return nil, fmt.Errorf("unknown provider")
+	}
+}
+
+// ProviderStatus returns the health of each provider in chain order
+func (s *Service) ProviderStatus() []ProviderStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make([]ProviderStatus, 0, len(s.chain.providers))
+	for _, provider := range s.chain.providers {
+		statuses = append(statuses, provider.status())
 	}
+	return statuses
+}
+
+// UsePersistentCache adds a persistent store behind the in-memory cache
+func (s *Service) UsePersistentCache(store CacheStore) {
+	s.store = store
+}
 
-	// Add providers in order of preference
-	service.providers = []Provider{
-		NewIPInfoProvider(client),
-		NewIPAPIProvider(client),
-		NewFreeGeoIPProvider(client),
+// CacheStats returns cache hit/miss counters, or nil if caching is disabled
+func (s *Service) CacheStats() *CacheStats {
+	if s.cache == nil {
+		return nil
 	}
+	stats := s.cache.stats()
+	return &stats
+}
 
-	return service
+// GetIPInfo returns IP information labelled with its network type and any
+// campus subnet. Private, loopback and CGNAT addresses are answered locally;
+// public ones come from the cache or the providers.
+func (s *Service) GetIPInfo(ctx context.Context, ip string) (*types.IPResponse, error) {
+	ctx, span := tracing.Start(ctx, "geo lookup", attribute.String("client.address", ip))
+	defer span.End()
+
+	labels := s.Classify(ip)
+	if labels.NetworkType != "" && labels.NetworkType != NetworkPublic {
+		labels.Source = "local"
+		span.SetAttributes(attribute.String("geo.source", labels.Source))
+		return labels, nil
+	}
+
+	info, err := s.resolve(ctx, ip)
+	info.NetworkType = labels.NetworkType
+	info.NetworkName = labels.NetworkName
+	info.Building = labels.Building
+	span.SetAttributes(attribute.String("geo.source", info.Source))
+	tracing.Fail(span, err)
+	return info, err
+}
+
+// Classify returns the network labels for ip without geolocating it
+func (s *Service) Classify(ip string) *types.IPResponse {
+	s.mu.RLock()
+	classifier := s.classifier
+	s.mu.RUnlock()
+
+	labels := &types.IPResponse{IP: ip}
+	if classifier != nil {
+		classifier.Classify(labels)
+	}
+	return labels
+}
+
+// resolve returns IP information from the cache, or looks it up using
+// providers in order until one succeeds. Concurrent lookups for the same
+// address share a single provider request.
+func (s *Service) resolve(ctx context.Context, ip string) (*types.IPResponse, error) {
+	if s.cache == nil {
+		return s.queryProviders(ctx, ip)
+	}
+
+	if entry, ok := s.cache.get(ip); ok {
+		if entry.err != nil {
+			s.cache.negativeHits.Add(1)
+			return &types.IPResponse{IP: ip}, &errCachedFailure{err: entry.err}
+		}
+		s.cache.hits.Add(1)
+		return copyIPResponse(entry.info), nil
+	}
+	s.cache.misses.Add(1)
+
+	// Only the caller that ran the lookup sets leader; the rest piggybacked on
+	// it. The shared lookup stays in the leader's trace but isn't cancelled
+	// with its request, as the outcome is cached for everyone.
+	leader := false
+	result, err, shared := s.group.Do(ip, func() (interface{}, error) {
+		leader = true
+		return s.lookup(context.WithoutCancel(ctx), ip)
+	})
+	if shared && !leader {
+		s.cache.sharedLookups.Add(1)
+	}
+	if err != nil {
+		return &types.IPResponse{IP: ip}, err
+	}
+
+	return copyIPResponse(result.(*types.IPResponse)), nil
+}
+
+// lookup consults the persistent store, then the providers, and caches the outcome
+func (s *Service) lookup(ctx context.Context, ip string) (*types.IPResponse, error) {
+	if s.store != nil {
+		info, expiresAt, err := s.store.LoadIPInfo(ctx, ip)
+		if err == nil && info != nil && time.Now().Before(expiresAt) {
+			s.cache.persistentHits.Add(1)
+			s.cache.putUntil(ip, info, nil, expiresAt)
+			return info, nil
+		}
+	}
+
+	info, err := s.queryProviders(ctx, ip)
+	if err != nil {
+		s.cache.put(ip, nil, err)
+		return nil, err
+	}
+
+	expiresAt := s.cache.put(ip, info, nil)
+	if s.store != nil {
+		go func() {
+			if err := s.store.SaveIPInfo(ctx, ip, info, expiresAt); err != nil {
+				slog.ErrorContext(ctx, "Failed to persist IP info", "ip", ip, "error", err)
+			}
+		}()
+	}
+
+	return info, nil
 }
 
-// GetIPInfo attempts to get IP information using providers in order until one succeeds
-func (s *Service) GetIPInfo(ip string) (*types.IPResponse, error) {
-	var lastErr error
+// queryProviders attempts to get IP information using providers in order,
+// skipping providers whose circuit is open. In first mode the first success
+// wins; in merge mode later providers fill in fields the earlier ones lacked.
+func (s *Service) queryProviders(ctx context.Context, ip string) (*types.IPResponse, error) {
+	s.mu.RLock()
+	chain, mode := s.chain, s.mode
+	chain.lookups.Add(1)
+	s.mu.RUnlock()
+	defer chain.lookups.Done()
+
+	lastErr := fmt.Errorf("no providers available")
+	var merged *types.IPResponse
+
+	for _, provider := range chain.providers {
+		result, attempted, err := provider.lookup(ctx, ip)
+		if !attempted {
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
 
-	for _, provider := range s.providers {
-		result, err := provider.GetIPInfo(ip)
-		if err == nil {
+		normalizeASN(result)
+		if mode != ModeMerge {
 			result.Source = provider.Name()
 			return result, nil
 		}
-		lastErr = err
+
+		if merged == nil {
+			merged = result
+			merged.Source = provider.Name()
+			if attributeFields(merged, provider.Name()) {
+				break
+			}
+		} else if mergeResult(merged, result, provider.Name()) {
+			break
+		}
+	}
+
+	if merged != nil {
+		return merged, nil
 	}
 
 	return &types.IPResponse{IP: ip}, fmt.Errorf("all providers failed, last error: %v", lastErr)
 }
 
+// get issues a GET request bound to ctx, with an Authorization header if
+// authorization is set
+func get(ctx context.Context, client *http.Client, url, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return client.Do(req)
+}
+
 // IPInfoProvider implements the ipinfo.io API
 type IPInfoProvider struct {
 	client *http.Client
@@ -79,12 +425,7 @@ type IPInfoResponse struct {
 }
 
 // NewIPInfoProvider creates a new ipinfo.io provider
-func NewIPInfoProvider(client *http.Client) *IPInfoProvider {
-	token := os.Getenv("IPINFO_TOKEN")
-	if token == "" {
-		token = "20e16b08cd509a" // Fallback token
-	}
-
+func NewIPInfoProvider(client *http.Client, token string) *IPInfoProvider {
 	return &IPInfoProvider{
 		client: client,
 		token:  token,
@@ -97,10 +438,9 @@ func (p *IPInfoProvider) Name() string {
 }
 
 // GetIPInfo fetches IP information from ipinfo.io
-func (p *IPInfoProvider) GetIPInfo(ip string) (*types.IPResponse, error) {
-	url := fmt.Sprintf("https://ipinfo.io/%s?token=%s", ip, p.token)
-
-	resp, err := p.client.Get(url)
+func (p *IPInfoProvider) GetIPInfo(ctx context.Context, ip string) (*types.IPResponse, error) {
+	// The token goes in a header so it stays out of traced request URLs
+	resp, err := get(ctx, p.client, fmt.Sprintf("https://ipinfo.io/%s", ip), "Bearer "+p.token)
 	if err != nil {
 		return nil, fmt.Errorf("ipinfo request failed: %v", err)
 	}
@@ -168,10 +508,8 @@ func (p *IPAPIProvider) Name() string {
 }
 
 // GetIPInfo fetches IP information from ip-api.com
-func (p *IPAPIProvider) GetIPInfo(ip string) (*types.IPResponse, error) {
-	url := fmt.Sprintf("http://ip-api.com/json/%s", ip)
-
-	resp, err := p.client.Get(url)
+func (p *IPAPIProvider) GetIPInfo(ctx context.Context, ip string) (*types.IPResponse, error) {
+	resp, err := get(ctx, p.client, fmt.Sprintf("http://ip-api.com/json/%s", ip), "")
 	if err != nil {
 		return nil, fmt.Errorf("ip-api request failed: %v", err)
 	}
@@ -238,10 +576,8 @@ func (p *FreeGeoIPProvider) Name() string {
 }
 
 // GetIPInfo fetches IP information from a free GeoIP service
-func (p *FreeGeoIPProvider) GetIPInfo(ip string) (*types.IPResponse, error) {
-	url := fmt.Sprintf("https://freeipapi.com/api/json/%s", ip)
-
-	resp, err := p.client.Get(url)
+func (p *FreeGeoIPProvider) GetIPInfo(ctx context.Context, ip string) (*types.IPResponse, error) {
+	resp, err := get(ctx, p.client, fmt.Sprintf("https://freeipapi.com/api/json/%s", ip), "")
 	if err != nil {
 		return nil, fmt.Errorf("freeipapi request failed: %v", err)
 	}
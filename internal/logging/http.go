@@ -0,0 +1,27 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// RequestIDHeader carries the request ID in requests and responses
+const RequestIDHeader = "X-Request-ID"
+
+// Error replies like http.Error, adding the request ID so users can quote
+// it: JSON error bodies get a "request_id" field, plain text ones a final
+// "Request ID:" line
+func Error(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if id := RequestID(r.Context()); id != "" {
+		var body map[string]interface{}
+		if strings.HasPrefix(message, "{") && json.Unmarshal([]byte(message), &body) == nil {
+			body["request_id"] = id
+			encoded, _ := json.Marshal(body)
+			message = string(encoded)
+		} else {
+			message += "\nRequest ID: " + id
+		}
+	}
+	http.Error(w, message, code)
+}
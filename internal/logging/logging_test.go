@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerAddsRequestID(t *testing.T) {
+	var out bytes.Buffer
+	handler, err := NewHandler(&out, "info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(handler).With("component", "test")
+
+	logger.DebugContext(context.Background(), "hidden")
+	logger.InfoContext(WithRequestID(context.Background(), "req-1"), "served", "status", 200)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON line, got %q: %v", out.String(), err)
+	}
+	if record["msg"] != "served" || record["request_id"] != "req-1" || record["component"] != "test" || record["status"] != float64(200) {
+		t.Errorf("unexpected record %v", record)
+	}
+
+	if _, err := NewHandler(&out, "verbose", "text"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+	if _, err := NewHandler(&out, "info", "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestError(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(WithRequestID(r.Context(), "req-1"))
+
+	w := httptest.NewRecorder()
+	Error(w, r, `{"error":"Invalid JSON"}`, 400)
+	var body map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] != "Invalid JSON" || body["request_id"] != "req-1" {
+		t.Errorf("unexpected JSON error body %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	Error(w, r, "Rate limit exceeded", 429)
+	if w.Code != 429 || !strings.HasPrefix(w.Body.String(), "Rate limit exceeded\nRequest ID: req-1") {
+		t.Errorf("unexpected text error body %q", w.Body.String())
+	}
+
+	// Without a request ID the message is unchanged
+	w = httptest.NewRecorder()
+	Error(w, httptest.NewRequest("GET", "/", nil), "Unauthorized", 401)
+	if w.Body.String() != "Unauthorized\n" {
+		t.Errorf("unexpected body %q", w.Body.String())
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"4dad80c9-9abf-41c0-869f-d19a2be906d7":     true,
+		"Root=1-67891233-abcdef012345678912345678": false,
+		"edge:42.7":              true,
+		"":                       false,
+		"line\nbreak":            false,
+		strings.Repeat("a", 129): false,
+	} {
+		if ValidRequestID(id) != valid {
+			t.Errorf("ValidRequestID(%q) = %v, want %v", id, !valid, valid)
+		}
+	}
+}
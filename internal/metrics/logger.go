@@ -2,15 +2,17 @@
 package metrics
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/Krea-University/speed-test-server/internal/database"
+	"github.com/Krea-University/speed-test-server/internal/events"
 )
 
 // Metric represents a single metric measurement
@@ -49,6 +51,7 @@ type MetricsLogger struct {
 	buffer   []Metric
 	flushInt time.Duration
 	stopChan chan struct{}
+	events   *events.Bus // optional live feed of logged metrics
 }
 
 // NewMetricsLogger creates a new metrics logger
@@ -79,7 +82,7 @@ func NewMetricsLogger(db *database.Service, logDir string) (*MetricsLogger, erro
 	// Start background flusher
 	go logger.backgroundFlusher()
 
-	log.Printf("Metrics logger initialized: %s", logPath)
+	slog.Info("Metrics logger initialized", "path", logPath)
 	return logger, nil
 }
 
@@ -145,12 +148,20 @@ func (ml *MetricsLogger) LogError(clientIP, userAgent, errorCode, errorMessage s
 	ml.addMetric(metric)
 }
 
+// SetEventBus publishes every logged metric to bus, e.g. for the admin live feed
+func (ml *MetricsLogger) SetEventBus(bus *events.Bus) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.events = bus
+}
+
 // addMetric adds a metric to the buffer
 func (ml *MetricsLogger) addMetric(metric Metric) {
 	ml.mu.Lock()
 	defer ml.mu.Unlock()
 
 	ml.buffer = append(ml.buffer, metric)
+	ml.events.Publish(events.Event{Type: events.Metric, Time: metric.Timestamp, ClientIP: metric.ClientIP, Data: metric})
 
 	// Immediate flush for errors or if buffer is full
 	if metric.Type == "error" || len(ml.buffer) >= 50 {
@@ -194,8 +205,8 @@ func (ml *MetricsLogger) writeToFile(metrics []Metric) {
 // writeToDatabase writes metrics to database
 func (ml *MetricsLogger) writeToDatabase(metrics []Metric) {
 	for _, metric := range metrics {
-		if err := ml.db.CreateMetric(metric); err != nil {
-			log.Printf("Failed to save metric to database: %v", err)
+		if err := ml.db.CreateMetric(context.Background(), metric); err != nil {
+			slog.Error("Failed to save metric to database", "error", err)
 		}
 	}
 }
@@ -220,7 +231,7 @@ func (ml *MetricsLogger) backgroundFlusher() {
 func (ml *MetricsLogger) GetMetrics(metricType string, startTime, endTime time.Time, limit int) ([]Metric, error) {
 	if ml.db != nil {
 		// Get data from database and convert to metrics format
-		dbMetrics, err := ml.db.GetMetrics(metricType, startTime, endTime, limit)
+		dbMetrics, err := ml.db.GetMetrics(context.Background(), metricType, startTime, endTime, limit)
 		if err != nil {
 			return nil, err
 		}
@@ -260,7 +271,7 @@ func (ml *MetricsLogger) GetServerStats(hours int) (*ServerStats, error) {
 	startTime := endTime.Add(-time.Duration(hours) * time.Hour)
 
 	if ml.db != nil {
-		dbStats, err := ml.db.GetServerStats(startTime, endTime)
+		dbStats, err := ml.db.GetServerStats(context.Background(), startTime, endTime)
 		if err != nil {
 			return nil, err
 		}
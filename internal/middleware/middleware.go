@@ -4,10 +4,16 @@ package middleware
 import (
 	"bufio"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/clientip"
+	"github.com/Krea-University/speed-test-server/internal/logging"
+	"github.com/Krea-University/speed-test-server/internal/waitingroom"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // CORS enables Cross-Origin Resource Sharing for all routes
@@ -21,13 +27,13 @@ func CORS(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 
 		// Allow common headers including those used by the speed test
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Accept, Accept-Encoding, Accept-Language")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Accept, Accept-Encoding, Accept-Language, X-Queue-Ticket, X-Test-ID, X-Request-ID, traceparent, tracestate")
 
 		// Allow credentials if needed
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		// Expose custom headers
-		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Type")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Type, Retry-After, X-Queue-URL, X-Queue-Position, X-Progress-ID, X-Progress-URL, X-Test-ID, X-Request-ID")
 
 		// Set max age for preflight requests
 		w.Header().Set("Access-Control-Max-Age", "86400")
@@ -42,7 +48,25 @@ func CORS(next http.Handler) http.Handler {
 	})
 }
 
-// Logging logs HTTP requests with method, URL, and response time
+// RequestID tags each request with an ID, taken from a valid X-Request-ID
+// header (e.g. set by a proxy) or generated. It is returned in X-Request-ID
+// and carried in the request context, so it appears in every log line and
+// error response of the request, and on its trace span.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(logging.RequestIDHeader)
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
+		}
+
+		w.Header().Set(logging.RequestIDHeader, id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", id))
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// Logging logs HTTP requests with method, path, status, client and response
+// time; server errors are logged as warnings
 func Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -52,8 +76,17 @@ func Logging(next http.Handler) http.Handler {
 
 		next.ServeHTTP(wrapped, r)
 
-		duration := time.Since(start)
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapped.statusCode, duration)
+		level := slog.LevelInfo
+		if wrapped.statusCode >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		slog.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", wrapped.statusCode),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", clientip.FromRequest(r)),
+		)
 	})
 }
 
@@ -69,6 +102,19 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush implements http.Flusher so streamed test data is not held back
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection, e.g.
+// to extend deadlines
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // Hijack implements http.Hijacker interface for WebSocket support
 func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if hijacker, ok := rw.ResponseWriter.(http.Hijacker); ok {
@@ -98,25 +144,42 @@ func Security(next http.Handler) http.Handler {
 
 // ConcurrentRequestLimiter limits the number of concurrent requests
 type ConcurrentRequestLimiter struct {
-	semaphore chan struct{}
-	maxReqs   int
+	room    *waitingroom.Room
+	maxReqs int
 }
 
-// NewConcurrentRequestLimiter creates a new concurrent request limiter
-func NewConcurrentRequestLimiter(maxRequests int) *ConcurrentRequestLimiter {
+// NewConcurrentRequestLimiter creates a new concurrent request limiter.
+// Slots are managed by a waiting room so that clients turned away can queue
+// for the next free slot instead of retrying blindly.
+func NewConcurrentRequestLimiter(maxRequests int, opts waitingroom.Options) *ConcurrentRequestLimiter {
 	if maxRequests <= 0 {
 		// Return a limiter that doesn't actually limit when maxRequests is 0
 		return &ConcurrentRequestLimiter{
-			semaphore: nil, // No semaphore for unlimited requests
-			maxReqs:   0,   // 0 indicates unlimited
+			room:    nil, // No waiting room for unlimited requests
+			maxReqs: 0,   // 0 indicates unlimited
 		}
 	}
 	return &ConcurrentRequestLimiter{
-		semaphore: make(chan struct{}, maxRequests),
-		maxReqs:   maxRequests,
+		room:    waitingroom.New(maxRequests, opts),
+		maxReqs: maxRequests,
 	}
 }
 
+// Room returns the waiting room backing the limiter, or nil when unlimited
+func (c *ConcurrentRequestLimiter) Room() *waitingroom.Room {
+	return c.room
+}
+
+// Resize applies new limits to the waiting room. It reports false when
+// limiting would have to be switched on or off, which needs a restart.
+func (c *ConcurrentRequestLimiter) Resize(maxRequests int, opts waitingroom.Options) bool {
+	if c.room == nil || maxRequests <= 0 {
+		return c.room == nil && maxRequests <= 0
+	}
+	c.room.Reconfigure(maxRequests, opts)
+	return true
+}
+
 // Middleware returns the HTTP middleware function
 func (c *ConcurrentRequestLimiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -132,18 +195,28 @@ func (c *ConcurrentRequestLimiter) Middleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// Requests carrying an admitted waiting room ticket use the ticket's slot
+		if ticket := r.Header.Get("X-Queue-Ticket"); ticket != "" {
+			if done, ok := c.room.Use(ticket, clientip.FromRequest(r)); ok {
+				defer done()
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
 		// Try to acquire a slot for non-WebSocket requests
-		select {
-		case c.semaphore <- struct{}{}:
+		if c.room.TryAcquire() {
 			// Got a slot, continue with the request
-			defer func() { <-c.semaphore }() // Release the slot when done
+			defer c.room.Release() // Release the slot when done
 			next.ServeHTTP(w, r)
-		default:
-			// No slots available, return 503 Service Unavailable
-			w.Header().Set("Retry-After", "1")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("Server is busy. Please try again later."))
-			log.Printf("Request rejected due to concurrent limit (%d active requests)", c.maxReqs)
+			return
 		}
+
+		// No slots available, point the client at the waiting room
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set("X-Queue-URL", "/queue/tickets")
+		logging.Error(w, r, "Server is busy. Join the waiting room with POST /queue/tickets.", http.StatusServiceUnavailable)
+		slots, _, _ := c.room.Stats()
+		slog.WarnContext(r.Context(), "Request rejected due to concurrent limit", "active_requests", slots)
 	})
 }
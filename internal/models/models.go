@@ -7,29 +7,60 @@ import (
 	"github.com/google/uuid"
 )
 
+// TestTypeDualStack marks tests that measured both IPv4 and IPv6 paths
+const TestTypeDualStack = "dualstack"
+
 // SpeedTest represents a speed test record in the database
 type SpeedTest struct {
-	ID                  string    `json:"id" db:"id"`
-	ClientIP            string    `json:"client_ip" db:"client_ip"`
-	UserAgent           *string   `json:"user_agent,omitempty" db:"user_agent"`
-	TestType            string    `json:"test_type" db:"test_type"`
-	DownloadSpeedMbps   *float64  `json:"download_speed_mbps,omitempty" db:"download_speed_mbps"`
-	UploadSpeedMbps     *float64  `json:"upload_speed_mbps,omitempty" db:"upload_speed_mbps"`
-	PingLatencyMs       *float64  `json:"ping_latency_ms,omitempty" db:"ping_latency_ms"`
-	JitterMs            *float64  `json:"jitter_ms,omitempty" db:"jitter_ms"`
-	DownloadSizeBytes   *int64    `json:"download_size_bytes,omitempty" db:"download_size_bytes"`
-	UploadSizeBytes     *int64    `json:"upload_size_bytes,omitempty" db:"upload_size_bytes"`
-	TestDurationSeconds *float64  `json:"test_duration_seconds,omitempty" db:"test_duration_seconds"`
-	ISP                 *string   `json:"isp,omitempty" db:"isp"`
-	Country             *string   `json:"country,omitempty" db:"country"`
-	Region              *string   `json:"region,omitempty" db:"region"`
-	City                *string   `json:"city,omitempty" db:"city"`
-	ServerName          string    `json:"server_name" db:"server_name"`
-	ServerCountry       string    `json:"server_country" db:"server_country"`
-	ServerCity          string    `json:"server_city" db:"server_city"`
-	Sponsor             string    `json:"sponsor" db:"sponsor"`
-	CreatedAt           time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt           time.Time `json:"updated_at" db:"updated_at"`
+	ID                  string     `json:"id" db:"id"`
+	SessionID           *string    `json:"session_id,omitempty" db:"session_id"` // X-Test-ID of the test session, naming its diagnostics trace
+	ClientIP            string     `json:"client_ip" db:"client_ip"`
+	UserAgent           *string    `json:"user_agent,omitempty" db:"user_agent"`
+	TestType            string     `json:"test_type" db:"test_type"`
+	DownloadSpeedMbps   *float64   `json:"download_speed_mbps,omitempty" db:"download_speed_mbps"`
+	UploadSpeedMbps     *float64   `json:"upload_speed_mbps,omitempty" db:"upload_speed_mbps"`
+	PingLatencyMs       *float64   `json:"ping_latency_ms,omitempty" db:"ping_latency_ms"`
+	JitterMs            *float64   `json:"jitter_ms,omitempty" db:"jitter_ms"`
+	DownloadSizeBytes   *int64     `json:"download_size_bytes,omitempty" db:"download_size_bytes"`
+	UploadSizeBytes     *int64     `json:"upload_size_bytes,omitempty" db:"upload_size_bytes"`
+	TestDurationSeconds *float64   `json:"test_duration_seconds,omitempty" db:"test_duration_seconds"`
+	ISP                 *string    `json:"isp,omitempty" db:"isp"`
+	Country             *string    `json:"country,omitempty" db:"country"`
+	Region              *string    `json:"region,omitempty" db:"region"`
+	City                *string    `json:"city,omitempty" db:"city"`
+	NetworkType         *string    `json:"network_type,omitempty" db:"network_type"`
+	NetworkName         *string    `json:"network_name,omitempty" db:"network_name"`
+	Building            *string    `json:"building,omitempty" db:"building"`
+	ReverseDNS          *string    `json:"reverse_dns,omitempty" db:"reverse_dns"`
+	ASNNumber           *uint32    `json:"asn_number,omitempty" db:"asn_number"`
+	ASNOrg              *string    `json:"asn_org,omitempty" db:"asn_org"`
+	IPVersion           *int       `json:"ip_version,omitempty" db:"ip_version"`
+	EnrichedAt          *time.Time `json:"enriched_at,omitempty" db:"enriched_at"`
+	Protocol            *string    `json:"protocol,omitempty" db:"protocol"`               // HTTP version, e.g. "HTTP/3.0"
+	IPv4LatencyMs       *float64   `json:"ipv4_latency_ms,omitempty" db:"ipv4_latency_ms"` // Dual-stack tests: figures measured over IPv4
+	IPv4DownloadMbps    *float64   `json:"ipv4_download_mbps,omitempty" db:"ipv4_download_mbps"`
+	IPv4UploadMbps      *float64   `json:"ipv4_upload_mbps,omitempty" db:"ipv4_upload_mbps"`
+	IPv6LatencyMs       *float64   `json:"ipv6_latency_ms,omitempty" db:"ipv6_latency_ms"` // Dual-stack tests: figures measured over IPv6
+	IPv6DownloadMbps    *float64   `json:"ipv6_download_mbps,omitempty" db:"ipv6_download_mbps"`
+	IPv6UploadMbps      *float64   `json:"ipv6_upload_mbps,omitempty" db:"ipv6_upload_mbps"`
+	PreferredIPVersion  *int       `json:"preferred_ip_version,omitempty" db:"preferred_ip_version"` // Family the client picked for the dual-stack host
+	TLSVersion          *string    `json:"tls_version,omitempty" db:"tls_version"`                   // e.g. "TLS 1.3"; empty over plain HTTP
+	TLSCipher           *string    `json:"tls_cipher,omitempty" db:"tls_cipher"`                     // Negotiated cipher suite name
+	ServerName          string     `json:"server_name" db:"server_name"`
+	ServerCountry       string     `json:"server_country" db:"server_country"`
+	ServerCity          string     `json:"server_city" db:"server_city"`
+	Sponsor             string     `json:"sponsor" db:"sponsor"`
+	CreatedAt           time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// Enrichment holds details added to a stored speed test in the background
+type Enrichment struct {
+	ReverseDNS *string // PTR hostname of the client IP
+	ASNNumber  *uint32 // Numeric AS number
+	ASNOrg     *string // AS organization name
+	IPVersion  *int    // 4 or 6
+	EnrichedAt time.Time
 }
 
 // OoklaCompatibleResponse represents an Ookla-compatible speed test response
@@ -120,40 +151,71 @@ type RateLimitWhitelist struct {
 	IsActive    bool      `json:"is_active" db:"is_active"`
 }
 
-// NewSpeedTest creates a new speed test record
-func NewSpeedTest(clientIP, testType string) *SpeedTest {
-	return &SpeedTest{
-		ID:            uuid.New().String(),
-		ClientIP:      clientIP,
-		TestType:      testType,
-		ServerName:    "Krea Speed Test Server",
-		ServerCountry: "IN",
-		ServerCity:    "Sri City",
-		Sponsor:       "Krea University",
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
+// ServerIdentity names the server that ran a test
+type ServerIdentity struct {
+	Name    string // Display name, e.g. "Krea Speed Test Server"
+	Sponsor string // Operating organization
+	Country string // ISO 3166-1 alpha-2 country code
+	City    string
+}
+
+// NewSpeedTest creates a new speed test record run by server
+func NewSpeedTest(clientIP, testType string, server ServerIdentity) *SpeedTest {
+	test := &SpeedTest{
+		ID:        uuid.New().String(),
+		ClientIP:  clientIP,
+		TestType:  testType,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
 	}
+	test.SetServerIdentity(server, true)
+	return test
+}
+
+// SetServerIdentity records which server ran the test. Unless overwrite is
+// set, fields that are already filled in are kept.
+func (st *SpeedTest) SetServerIdentity(identity ServerIdentity, overwrite bool) {
+	if overwrite || st.ServerName == "" {
+		st.ServerName = identity.Name
+	}
+	if overwrite || st.ServerCountry == "" {
+		st.ServerCountry = identity.Country
+	}
+	if overwrite || st.ServerCity == "" {
+		st.ServerCity = identity.City
+	}
+	if overwrite || st.Sponsor == "" {
+		st.Sponsor = identity.Sponsor
+	}
+}
+
+// OoklaServerEndpoint describes how the client reached this server
+type OoklaServerEndpoint struct {
+	Host       string  // Public host name
+	Port       int     // Public port
+	BaseURL    string  // Public base URL for result links
+	DistanceKm float64 // Great-circle distance to the client, 0 if unknown
 }
 
 // ToOoklaFormat converts a SpeedTest to Ookla-compatible format
-func (st *SpeedTest) ToOoklaFormat() *OoklaCompatibleResponse {
+func (st *SpeedTest) ToOoklaFormat(endpoint OoklaServerEndpoint) *OoklaCompatibleResponse {
 	response := &OoklaCompatibleResponse{
 		Type:      "result",
 		Timestamp: st.CreatedAt,
 		Server: &OoklaServerInfo{
 			ID:       1,
-			Host:     "speed.krea.edu.in",
-			Port:     8080,
+			Host:     endpoint.Host,
+			Port:     endpoint.Port,
 			Name:     st.ServerName,
 			Location: st.ServerCity,
 			Country:  st.ServerCountry,
 			CC:       st.ServerCountry,
 			Sponsor:  st.Sponsor,
-			Distance: 0,
+			Distance: endpoint.DistanceKm,
 		},
 		Result: &OoklaResultInfo{
 			ID:  st.ID,
-			URL: "https://speed.krea.edu.in/result/" + st.ID,
+			URL: endpoint.BaseURL + "/result/" + st.ID,
 		},
 	}
 
@@ -0,0 +1,325 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// saturationThreshold is the fraction of uplink capacity treated as full
+	saturationThreshold = 0.9
+
+	// sampleInterval is how often aggregate throughput is measured
+	sampleInterval = 500 * time.Millisecond
+
+	// defaultTestDuration seeds the test duration estimate used for Retry-After
+	defaultTestDuration = 10 * time.Second
+)
+
+// ErrQueueFull is returned when no more tests can wait for admission
+var ErrQueueFull = errors.New("admission queue is full")
+
+// ErrQueueTimeout is returned when a test waited too long for admission
+var ErrQueueTimeout = errors.New("timed out waiting for bandwidth")
+
+// AdmissionError describes why a test was not admitted and when to retry
+type AdmissionError struct {
+	Err        error
+	Position   int           // Position in the queue when the test gave up (1 = next)
+	RetryAfter time.Duration // Estimated wait before capacity frees up
+}
+
+func (e *AdmissionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AdmissionError) Unwrap() error {
+	return e.Err
+}
+
+// BandwidthController admits download/upload tests based on the aggregate
+// live throughput against a configured uplink capacity, so that concurrent
+// tests do not distort each other's results
+type BandwidthController struct {
+	enabled      bool // Fixed at creation; limits can change but not the sampler
+	capacityBps  float64
+	maxActive    int
+	maxQueue     int
+	queueTimeout time.Duration
+
+	totalBytes atomic.Int64
+
+	mu           sync.Mutex
+	active       int
+	queue        []*admissionWaiter
+	throughput   float64 // bits per second, smoothed
+	lastBytes    int64
+	lastSample   time.Time
+	avgDuration  time.Duration
+	stopSampling chan struct{}
+}
+
+// admissionWaiter is a test waiting in the admission queue
+type admissionWaiter struct {
+	ready chan struct{}
+}
+
+// NewBandwidthController creates an admission controller for the given uplink
+// capacity. Each admitted test is guaranteed at least minPerTestMbps, which
+// bounds the number of concurrent tests. A capacity of 0 disables admission control.
+func NewBandwidthController(capacityMbps, minPerTestMbps float64, maxQueue int, queueTimeout time.Duration) *BandwidthController {
+	c := &BandwidthController{
+		capacityBps:  capacityMbps * 1e6,
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+		lastSample:   time.Now(),
+		avgDuration:  defaultTestDuration,
+		stopSampling: make(chan struct{}),
+	}
+	if capacityMbps <= 0 {
+		return c
+	}
+
+	c.enabled = true
+	c.maxActive = maxActiveTests(capacityMbps, minPerTestMbps)
+
+	go c.sample()
+
+	return c
+}
+
+// maxActiveTests is the number of tests that each get minPerTestMbps
+func maxActiveTests(capacityMbps, minPerTestMbps float64) int {
+	if minPerTestMbps <= 0 {
+		return math.MaxInt32
+	}
+	return int(math.Max(1, math.Floor(capacityMbps/minPerTestMbps)))
+}
+
+// Reconfigure applies new limits to a running controller. It reports false,
+// changing nothing, when admission control would have to be switched on or
+// off, which needs a restart.
+func (c *BandwidthController) Reconfigure(capacityMbps, minPerTestMbps float64, maxQueue int, queueTimeout time.Duration) bool {
+	if c.enabled != (capacityMbps > 0) {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.capacityBps = capacityMbps * 1e6
+	c.maxQueue = maxQueue
+	c.queueTimeout = queueTimeout
+	if c.enabled {
+		c.maxActive = maxActiveTests(capacityMbps, minPerTestMbps)
+		c.dispatchLocked()
+	}
+	return true
+}
+
+// Enabled reports whether admission control is active
+func (c *BandwidthController) Enabled() bool {
+	return c != nil && c.enabled
+}
+
+// Admit admits a new test, waiting in the FIFO queue while the uplink is
+// saturated. The returned Transfer must be finished with Done.
+func (c *BandwidthController) Admit(ctx context.Context) (*Transfer, error) {
+	if !c.Enabled() {
+		return &Transfer{}, nil
+	}
+
+	c.mu.Lock()
+	if len(c.queue) == 0 && !c.saturatedLocked() {
+		c.active++
+		c.mu.Unlock()
+		return c.newTransfer(), nil
+	}
+
+	queueTimeout := c.queueTimeout
+	if len(c.queue) >= c.maxQueue || queueTimeout <= 0 {
+		err := &AdmissionError{
+			Err:        ErrQueueFull,
+			Position:   len(c.queue) + 1,
+			RetryAfter: c.estimateWaitLocked(len(c.queue) + 1),
+		}
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	waiter := &admissionWaiter{ready: make(chan struct{})}
+	c.queue = append(c.queue, waiter)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-waiter.ready:
+		return c.newTransfer(), nil
+	case <-timer.C:
+		return nil, c.abandon(waiter, ErrQueueTimeout)
+	case <-ctx.Done():
+		return nil, c.abandon(waiter, ctx.Err())
+	}
+}
+
+// abandon removes a waiter from the queue, handing its slot on if it was admitted meanwhile
+func (c *BandwidthController) abandon(waiter *admissionWaiter, cause error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, w := range c.queue {
+		if w == waiter {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return &AdmissionError{
+				Err:        cause,
+				Position:   i + 1,
+				RetryAfter: c.estimateWaitLocked(i + 1),
+			}
+		}
+	}
+
+	// Already dispatched: release the slot it was given
+	c.active--
+	c.dispatchLocked()
+	return &AdmissionError{Err: cause, Position: 1, RetryAfter: c.estimateWaitLocked(1)}
+}
+
+// Status returns a snapshot of the admission state
+func (c *BandwidthController) Status() AdmissionStatus {
+	if !c.Enabled() {
+		return AdmissionStatus{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return AdmissionStatus{
+		Enabled:        true,
+		CapacityMbps:   c.capacityBps / 1e6,
+		ThroughputMbps: c.throughput / 1e6,
+		ActiveTests:    c.active,
+		MaxActiveTests: c.maxActive,
+		QueueLength:    len(c.queue),
+		MaxQueueLength: c.maxQueue,
+		Saturated:      c.saturatedLocked(),
+	}
+}
+
+// AdmissionStatus is a snapshot of the bandwidth admission controller
+type AdmissionStatus struct {
+	Enabled        bool
+	CapacityMbps   float64
+	ThroughputMbps float64
+	ActiveTests    int
+	MaxActiveTests int
+	QueueLength    int
+	MaxQueueLength int
+	Saturated      bool
+}
+
+// saturatedLocked reports whether a new test would exceed the capacity
+func (c *BandwidthController) saturatedLocked() bool {
+	return c.active >= c.maxActive || c.throughput >= c.capacityBps*saturationThreshold
+}
+
+// dispatchLocked admits queued tests while capacity is available
+func (c *BandwidthController) dispatchLocked() {
+	for len(c.queue) > 0 && !c.saturatedLocked() {
+		waiter := c.queue[0]
+		c.queue = c.queue[1:]
+		c.active++
+		close(waiter.ready)
+	}
+}
+
+// estimateWaitLocked estimates how long the test at position waits for a slot
+func (c *BandwidthController) estimateWaitLocked(position int) time.Duration {
+	slots := c.maxActive
+	if slots <= 0 || slots == math.MaxInt32 {
+		slots = 1
+	}
+	rounds := (position + slots - 1) / slots
+	wait := time.Duration(rounds) * c.avgDuration
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// finish releases a test's slot and updates the duration estimate
+func (c *BandwidthController) finish(duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active--
+	c.avgDuration = (c.avgDuration*4 + duration) / 5
+	c.dispatchLocked()
+}
+
+// sample periodically measures aggregate throughput from the shared byte counter
+func (c *BandwidthController) sample() {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			bytes := c.totalBytes.Load()
+
+			c.mu.Lock()
+			elapsed := now.Sub(c.lastSample).Seconds()
+			if elapsed > 0 {
+				rate := float64(bytes-c.lastBytes) * 8 / elapsed
+				// Exponentially weighted to smooth out bursty flushes
+				c.throughput = 0.5*c.throughput + 0.5*rate
+			}
+			c.lastBytes = bytes
+			c.lastSample = now
+			c.dispatchLocked()
+			c.mu.Unlock()
+		case <-c.stopSampling:
+			return
+		}
+	}
+}
+
+// Close stops the throughput sampler
+func (c *BandwidthController) Close() {
+	if c.Enabled() {
+		close(c.stopSampling)
+	}
+}
+
+// newTransfer creates a tracked transfer for an admitted test
+func (c *BandwidthController) newTransfer() *Transfer {
+	return &Transfer{controller: c, started: time.Now()}
+}
+
+// Transfer tracks the bytes moved by one admitted test
+type Transfer struct {
+	controller *BandwidthController
+	started    time.Time
+	done       atomic.Bool
+}
+
+// Add records n bytes sent or received
+func (t *Transfer) Add(n int) {
+	if t == nil || t.controller == nil {
+		return
+	}
+	t.controller.totalBytes.Add(int64(n))
+}
+
+// Done releases the test's admission slot; it is safe to call more than once
+func (t *Transfer) Done() {
+	if t == nil || t.controller == nil || !t.done.CompareAndSwap(false, true) {
+		return
+	}
+	t.controller.finish(time.Since(t.started))
+}
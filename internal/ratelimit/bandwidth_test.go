@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBandwidthControllerQueuesWhenSaturated(t *testing.T) {
+	c := NewBandwidthController(200, 100, 4, 5*time.Second)
+	defer c.Close()
+
+	first, err := c.Admit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Admit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan error, 1)
+	go func() {
+		transfer, err := c.Admit(context.Background())
+		if err == nil {
+			transfer.Done()
+		}
+		admitted <- err
+	}()
+
+	// Wait for the third test to join the queue
+	deadline := time.Now().Add(time.Second)
+	for c.Status().QueueLength != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("third test was not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !c.Status().Saturated {
+		t.Error("expected controller to report saturation")
+	}
+
+	first.Done()
+	first.Done() // idempotent
+
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Fatalf("queued test not admitted: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued test not admitted after a slot freed")
+	}
+
+	if active := c.Status().ActiveTests; active != 1 {
+		t.Errorf("active tests = %d, want 1", active)
+	}
+}
+
+func TestBandwidthControllerRejectsWhenQueueFull(t *testing.T) {
+	c := NewBandwidthController(100, 100, 0, time.Second)
+	defer c.Close()
+
+	if _, err := c.Admit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := c.Admit(context.Background())
+	var admissionErr *AdmissionError
+	if !errors.As(err, &admissionErr) || !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected queue full admission error, got %v", err)
+	}
+	if admissionErr.Position != 1 || admissionErr.RetryAfter < time.Second {
+		t.Errorf("unexpected rejection details: %+v", admissionErr)
+	}
+}
+
+func TestBandwidthControllerDisabled(t *testing.T) {
+	c := NewBandwidthController(0, 100, 0, 0)
+	for i := 0; i < 10; i++ {
+		transfer, err := c.Admit(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		transfer.Add(1024)
+		transfer.Done()
+	}
+	if c.Status().Enabled {
+		t.Error("disabled controller reports enabled")
+	}
+}
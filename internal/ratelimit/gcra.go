@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// maxCASRetries bounds the compare-and-swap loop under contention
+const maxCASRetries = 16
+
+// ErrContention is returned when a key is updated concurrently too many times in a row
+var ErrContention = errors.New("rate limit state contention")
+
+// Limit describes a rate of Rate events per Period with bursts of up to Burst events
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// PerMinute returns a limit of n requests per minute with a burst of n
+func PerMinute(n int) Limit {
+	return Limit{Rate: n, Period: time.Minute, Burst: n}
+}
+
+// Result is the outcome of a rate limit decision
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // Time until the next request would be allowed (0 if allowed)
+	ResetAfter time.Duration // Time until the bucket is completely full again
+}
+
+// Store holds the GCRA theoretical arrival time (TAT) per key, in Unix nanoseconds.
+// Implementations must make CompareAndSwap atomic; the local memory store is used
+// for single instances and a shared store (e.g. the database) for multi-instance
+// deployments.
+type Store interface {
+	// Get returns the stored TAT for key and whether one exists
+	Get(ctx context.Context, key string) (tat int64, ok bool, err error)
+	// CompareAndSwap replaces the TAT for key with new if it still equals old
+	// (or is still absent when exists is false), expiring it after ttl
+	CompareAndSwap(ctx context.Context, key string, old int64, exists bool, new int64, ttl time.Duration) (bool, error)
+}
+
+// Limiter implements the generic cell rate algorithm (GCRA), a token bucket
+// that stores a single timestamp per key instead of a token count
+type Limiter struct {
+	store Store
+	now   func() time.Time
+}
+
+// NewLimiter creates a GCRA limiter backed by the given store
+func NewLimiter(store Store) *Limiter {
+	return &Limiter{store: store, now: time.Now}
+}
+
+// Allow records one request for key and reports whether it is within limit
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	if limit.Rate <= 0 || limit.Period <= 0 {
+		return Result{Allowed: true, Limit: limit.Rate}, nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	interval := limit.Period.Nanoseconds() / int64(limit.Rate)
+	tolerance := interval * int64(burst-1)
+
+	for i := 0; i < maxCASRetries; i++ {
+		now := l.now().UnixNano()
+
+		stored, exists, err := l.store.Get(ctx, key)
+		if err != nil {
+			return Result{}, err
+		}
+
+		tat := stored
+		if !exists || tat < now {
+			tat = now
+		}
+
+		// Earliest time at which this request would conform
+		allowAt := tat - tolerance
+		if now < allowAt {
+			return Result{
+				Allowed:    false,
+				Limit:      limit.Rate,
+				Remaining:  0,
+				RetryAfter: time.Duration(allowAt - now),
+				ResetAfter: time.Duration(tat - now),
+			}, nil
+		}
+
+		newTAT := tat + interval
+		swapped, err := l.store.CompareAndSwap(ctx, key, stored, exists, newTAT, time.Duration(newTAT-now))
+		if err != nil {
+			return Result{}, err
+		}
+		if !swapped {
+			continue
+		}
+
+		return Result{
+			Allowed:    true,
+			Limit:      limit.Rate,
+			Remaining:  int((now + tolerance - newTAT + interval) / interval),
+			ResetAfter: time.Duration(newTAT - now),
+		}, nil
+	}
+
+	return Result{}, ErrContention
+}
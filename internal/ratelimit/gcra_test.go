@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(now *time.Time) *Limiter {
+	l := NewLimiter(NewMemoryStore())
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestLimiterBurstThenRefill(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := newTestLimiter(&now)
+	limit := Limit{Rate: 60, Period: time.Minute, Burst: 5}
+
+	for i := 0; i < 5; i++ {
+		res, err := l.Allow(context.Background(), "client", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed {
+			t.Fatalf("request %d denied within burst", i)
+		}
+		if want := 4 - i; res.Remaining != want {
+			t.Errorf("request %d: remaining = %d, want %d", i, res.Remaining, want)
+		}
+	}
+
+	res, _ := l.Allow(context.Background(), "client", limit)
+	if res.Allowed {
+		t.Fatal("request beyond burst allowed")
+	}
+	if res.RetryAfter != time.Second {
+		t.Errorf("retry after = %v, want 1s", res.RetryAfter)
+	}
+
+	// One emission interval later exactly one more request conforms
+	now = now.Add(time.Second)
+	if res, _ := l.Allow(context.Background(), "client", limit); !res.Allowed {
+		t.Error("request after refill denied")
+	}
+	if res, _ := l.Allow(context.Background(), "client", limit); res.Allowed {
+		t.Error("second request after single refill allowed")
+	}
+
+	// Other keys are independent
+	if res, _ := l.Allow(context.Background(), "other", limit); !res.Allowed {
+		t.Error("independent key denied")
+	}
+}
+
+func TestLimiterConcurrentAllowsExactlyBurst(t *testing.T) {
+	l := NewLimiter(NewMemoryStore())
+	limit := Limit{Rate: 10, Period: time.Hour, Burst: 10}
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := l.Allow(context.Background(), "shared", limit); err == nil && res.Allowed {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 10 {
+		t.Errorf("allowed %d concurrent requests, want 10", allowed)
+	}
+}
+
+func BenchmarkLimiterAllow(b *testing.B) {
+	l := NewLimiter(NewMemoryStore())
+	limit := PerMinute(1 << 30)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Allow(context.Background(), "203.0.113.7|/download", limit)
+	}
+}
+
+func BenchmarkLimiterAllowParallel(b *testing.B) {
+	l := NewLimiter(NewMemoryStore())
+	limit := PerMinute(60)
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256) + "|/ping"
+	}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			l.Allow(context.Background(), keys[i%len(keys)], limit)
+			i++
+		}
+	})
+}
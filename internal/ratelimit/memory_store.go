@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryShards spreads keys over independent locks to reduce contention
+const memoryShards = 64
+
+// MemoryStore is a process-local Store
+type MemoryStore struct {
+	shards [memoryShards]memoryShard
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	tat     int64
+	expires int64
+}
+
+// NewMemoryStore creates an in-memory store and starts its expiry sweeper
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{}
+	for i := range s.shards {
+		s.shards[i].entries = make(map[string]memoryEntry)
+	}
+
+	go s.cleanupExpiredEntries(time.Minute)
+
+	return s
+}
+
+// Get returns the stored TAT for key
+func (s *MemoryStore) Get(_ context.Context, key string) (int64, bool, error) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry, ok := shard.entries[key]
+	if !ok || entry.expires < time.Now().UnixNano() {
+		return 0, false, nil
+	}
+	return entry.tat, true, nil
+}
+
+// CompareAndSwap atomically replaces the TAT for key if it is unchanged
+func (s *MemoryStore) CompareAndSwap(_ context.Context, key string, old int64, exists bool, new int64, ttl time.Duration) (bool, error) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	entry, ok := shard.entries[key]
+	if ok && entry.expires < now {
+		ok = false
+	}
+	if ok != exists || (ok && entry.tat != old) {
+		return false, nil
+	}
+
+	shard.entries[key] = memoryEntry{tat: new, expires: now + ttl.Nanoseconds()}
+	return true, nil
+}
+
+// Len returns the number of tracked keys
+func (s *MemoryStore) Len() int {
+	total := 0
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+		total += len(s.shards[i].entries)
+		s.shards[i].mu.Unlock()
+	}
+	return total
+}
+
+// shard picks the shard responsible for key
+func (s *MemoryStore) shard(key string) *memoryShard {
+	// Inline FNV-1a to keep the hot path allocation-free
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &s.shards[h%memoryShards]
+}
+
+// cleanupExpiredEntries periodically drops keys whose buckets have refilled
+func (s *MemoryStore) cleanupExpiredEntries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now().UnixNano()
+		for i := range s.shards {
+			shard := &s.shards[i]
+			shard.mu.Lock()
+			for key, entry := range shard.entries {
+				if entry.expires < now {
+					delete(shard.entries, key)
+				}
+			}
+			shard.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinRateMbps is the slowest pacing rate (64 kbps). Slower streams would hold
+// their bandwidth slot and connection until the test deadline.
+const MinRateMbps = 0.064
+
+// ValidRate reports whether rateMbps is a finite rate of at least MinRateMbps
+func ValidRate(rateMbps float64) bool {
+	return !math.IsNaN(rateMbps) && !math.IsInf(rateMbps, 0) && rateMbps >= MinRateMbps
+}
+
+// Pacer is a byte-granular token bucket used to shape a single stream to a
+// fixed bit rate, emulating constrained client links
+type Pacer struct {
+	mu          sync.Mutex
+	bytesPerSec float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+}
+
+// NewPacer creates a pacer for the given rate in Mbps. Bursts are limited to
+// 50ms worth of data (at least burstBytes) so the stream stays smooth.
+func NewPacer(rateMbps float64, burstBytes int) *Pacer {
+	bytesPerSec := rateMbps * 1e6 / 8
+	burst := bytesPerSec * 0.05
+	if burst < float64(burstBytes) {
+		burst = float64(burstBytes)
+	}
+	return &Pacer{
+		bytesPerSec: bytesPerSec,
+		burst:       burst,
+		tokens:      burst,
+		last:        time.Now(),
+	}
+}
+
+// RateMbps returns the pacing rate
+func (p *Pacer) RateMbps() float64 {
+	if p == nil {
+		return 0
+	}
+	return p.bytesPerSec * 8 / 1e6
+}
+
+// Wait blocks until n bytes may be transferred; a nil pacer never blocks
+func (p *Pacer) Wait(ctx context.Context, n int) error {
+	if p == nil || n <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	p.tokens += now.Sub(p.last).Seconds() * p.bytesPerSec
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+	p.last = now
+	p.tokens -= float64(n)
+	deficit := -p.tokens
+	p.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / p.bytesPerSec * float64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ClientCaps holds admin-configured bandwidth caps per client IP or network
+type ClientCaps struct {
+	mu   sync.RWMutex
+	caps map[string]clientCap
+}
+
+type clientCap struct {
+	network  *net.IPNet
+	rateMbps float64
+}
+
+// NewClientCaps creates an empty cap table
+func NewClientCaps() *ClientCaps {
+	return &ClientCaps{caps: make(map[string]clientCap)}
+}
+
+// Set caps a client IP or CIDR to rateMbps
+func (c *ClientCaps) Set(client string, rateMbps float64) (string, error) {
+	if !ValidRate(rateMbps) {
+		return "", fmt.Errorf("rate must be at least %g Mbps", MinRateMbps)
+	}
+
+	network, err := parseNetwork(client)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.caps[network.String()] = clientCap{network: network, rateMbps: rateMbps}
+	return network.String(), nil
+}
+
+// Remove deletes the cap for a client IP or CIDR
+func (c *ClientCaps) Remove(client string) bool {
+	network, err := parseNetwork(client)
+	if err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.caps[network.String()]; !ok {
+		return false
+	}
+	delete(c.caps, network.String())
+	return true
+}
+
+// Lookup returns the cap of the most specific network containing ip
+func (c *ClientCaps) Lookup(ip string) (float64, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return 0, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	bestOnes := -1
+	rate := 0.0
+	for _, entry := range c.caps {
+		if !entry.network.Contains(parsed) {
+			continue
+		}
+		if ones, _ := entry.network.Mask.Size(); ones > bestOnes {
+			bestOnes = ones
+			rate = entry.rateMbps
+		}
+	}
+	return rate, bestOnes >= 0
+}
+
+// List returns all caps keyed by network, sorted for stable output
+func (c *ClientCaps) List() []ClientCapEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := make([]ClientCapEntry, 0, len(c.caps))
+	for network, entry := range c.caps {
+		entries = append(entries, ClientCapEntry{Client: network, RateMbps: entry.rateMbps})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Client < entries[j].Client })
+	return entries
+}
+
+// ClientCapEntry is a single configured cap
+type ClientCapEntry struct {
+	Client   string  `json:"client"`
+	RateMbps float64 `json:"rate_mbps"`
+}
+
+// parseNetwork parses a CIDR or bare IP into a network
+func parseNetwork(client string) (*net.IPNet, error) {
+	client = strings.TrimSpace(client)
+	if strings.Contains(client, "/") {
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", client)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", client)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Krea-University/speed-test-server/internal/clientip"
+	"github.com/Krea-University/speed-test-server/internal/logging"
+)
+
+// familyGuard rejects requests for the IPv4-only or IPv6-only host that
+// arrive over the other family, e.g. through a NAT64 gateway or a stale DNS
+// record, so dual-stack results never attribute figures to the wrong family
+func familyGuard(ipv4Host, ipv6Host string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, want := clientip.Hostname(r), 0
+			switch host {
+			case ipv4Host:
+				want = 4
+			case ipv6Host:
+				want = 6
+			}
+
+			if want != 0 {
+				if got := clientip.Version(clientip.FromRequest(r)); got != want {
+					logging.Error(w, r, fmt.Sprintf(`{"error":"%s only serves IPv%d clients"}`, host, want), http.StatusMisdirectedRequest)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFamilyGuard(t *testing.T) {
+	tests := []struct {
+		host       string
+		remoteAddr string
+		want       int
+	}{
+		{"v4.speed.example.edu", "192.0.2.10:5000", http.StatusOK},
+		{"v4.speed.example.edu:8443", "[2001:db8::10]:5000", http.StatusMisdirectedRequest},
+		{"v6.speed.example.edu", "[2001:db8::10]:5000", http.StatusOK},
+		{"V6.speed.example.edu", "192.0.2.10:5000", http.StatusMisdirectedRequest},
+		{"v6.speed.example.edu", "[::ffff:192.0.2.10]:5000", http.StatusMisdirectedRequest},
+		{"speed.example.edu", "192.0.2.10:5000", http.StatusOK},
+		{"speed.example.edu", "[2001:db8::10]:5000", http.StatusOK},
+	}
+
+	guard := familyGuard("v4.speed.example.edu", "v6.speed.example.edu")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/ping", nil)
+		req.Host = tt.host
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		guard.ServeHTTP(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("%s from %s: got %d, want %d", tt.host, tt.remoteAddr, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// altSvcMaxAge is how long (seconds) clients may remember the HTTP/3 endpoint
+const altSvcMaxAge = 24 * 60 * 60
+
+// newHTTP3Server creates an HTTP/3 server sharing the TLS configuration of
+// the TCP listener
+func newHTTP3Server(port int, tlsConfig *tls.Config, handler http.Handler) *http3.Server {
+	return &http3.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		// 0-RTT data can be replayed; the test endpoints gain nothing from it
+		QUICConfig: &quic.Config{Allow0RTT: false},
+	}
+}
+
+// altSvc advertises the HTTP/3 endpoint on responses sent over TLS, so
+// clients that support QUIC switch to it for later requests
+func altSvc(port int) func(http.Handler) http.Handler {
+	header := fmt.Sprintf(`h3=":%d"; ma=%d`, port, altSvcMaxAge)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				w.Header().Set("Alt-Svc", header)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestHTTP3ServesRouter(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "h3")
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certs.close()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	router.HandleFunc("/api/tests", func(w http.ResponseWriter, r *http.Request) {})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server := newHTTP3Server(0, newTLSConfig(certs, "1.3"), router)
+	go server.Serve(conn)
+	defer server.Close()
+
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+	base := "https://" + conn.LocalAddr().String()
+
+	resp, err := client.Get(base + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 3 || resp.StatusCode != http.StatusOK {
+		t.Errorf("expected HTTP/3 200, got %s %d", resp.Proto, resp.StatusCode)
+	}
+
+	resp, err = client.Get(base + "/api/tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 3 || resp.StatusCode != http.StatusOK {
+		t.Errorf("clients that switched to HTTP/3 should reach every endpoint, got %s %d", resp.Proto, resp.StatusCode)
+	}
+}
+
+func TestAltSvcOnlyOverTLS(t *testing.T) {
+	handler := altSvc(8443)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://speed.example.edu/ping", nil))
+	if got := rec.Header().Get("Alt-Svc"); got != "" {
+		t.Errorf("Alt-Svc sent over plain HTTP: %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "https://speed.example.edu/ping", nil))
+	if got := rec.Header().Get("Alt-Svc"); got != `h3=":8443"; ma=86400` {
+		t.Errorf("unexpected Alt-Svc %q", got)
+	}
+}
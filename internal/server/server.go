@@ -3,37 +3,62 @@ package server
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/Krea-University/speed-test-server/docs"
 	"github.com/Krea-University/speed-test-server/internal/auth"
+	"github.com/Krea-University/speed-test-server/internal/clientip"
 	"github.com/Krea-University/speed-test-server/internal/config"
 	"github.com/Krea-University/speed-test-server/internal/database"
 	"github.com/Krea-University/speed-test-server/internal/handlers"
+	"github.com/Krea-University/speed-test-server/internal/logging"
 	"github.com/Krea-University/speed-test-server/internal/middleware"
+	"github.com/Krea-University/speed-test-server/internal/tracing"
+	"github.com/Krea-University/speed-test-server/internal/waitingroom"
 	"github.com/gorilla/mux"
+	"github.com/quic-go/quic-go/http3"
 	httpSwagger "github.com/swaggo/http-swagger"
 )
 
 // Server represents the HTTP server instance
 type Server struct {
-	httpServer *http.Server
-	handlers   *handlers.Handlers
-	db         *database.Service
+	httpServer     *http.Server
+	http3Server    *http3.Server // nil unless test endpoints are served over HTTP/3
+	redirectServer *http.Server  // nil unless HTTP is redirected to HTTPS
+	certs          *certReloader // nil when serving plain HTTP
+	ipv4Host       string        // Host name reachable only over IPv4, empty unless dual-stack tests are configured
+	ipv6Host       string        // Host name reachable only over IPv6
+	handlers       *handlers.Handlers
+	db             *database.Service
+	resolver       *clientip.Resolver
+	stopTracing    func(context.Context) error // flushes spans still waiting to be exported
 }
 
 // New creates a new server instance with all routes configured
 func New() *Server {
+	// Export spans before anything that creates them starts
+	endpoint, serviceName, sampleRatio := config.GetTracing()
+	stopTracing, err := tracing.Setup(context.Background(), endpoint, serviceName, sampleRatio)
+	if err != nil {
+		fatal("Invalid tracing configuration", "error", err)
+	}
+	if endpoint != "" {
+		slog.Info("Exporting traces", "endpoint", endpoint, "service", serviceName, "sample_ratio", sampleRatio)
+	}
+
 	// Initialize database
 	db, err := database.New()
 	if err != nil {
-		log.Printf("Warning: Database connection failed: %v", err)
-		log.Println("Continuing without database features...")
+		slog.Warn("Database connection failed, continuing without database features", "error", err)
 	}
 
 	// Initialize handlers with database
@@ -43,36 +68,118 @@ func New() *Server {
 	var authService *auth.Service
 	if db != nil {
 		authService = auth.New(db)
+		authService.SetTraceStore(h.TraceStore())
 	}
 
+	// Resolve client IPs through trusted proxies only
+	trustedProxies := config.GetTrustedProxies()
+	if trustedProxies == nil {
+		trustedProxies = clientip.DefaultTrustedProxies
+	}
+	resolver, err := clientip.NewResolver(trustedProxies)
+	if err != nil {
+		fatal("Invalid TRUSTED_PROXIES", "error", err)
+	}
+	clientip.SetDefault(resolver)
+
 	// Create router with middleware
 	r := mux.NewRouter()
 
 	// Initialize concurrent request limiter with configurable max requests
-	concurrentLimiter := middleware.NewConcurrentRequestLimiter(config.GetMaxConcurrentRequests())
+	concurrentLimiter := middleware.NewConcurrentRequestLimiter(config.GetMaxConcurrentRequests(), waitingroom.Options{
+		WaitTimeout:  config.GetQueueWaitTimeout(),
+		AdmitTimeout: config.GetQueueAdmitTimeout(),
+		Lifetime:     config.GetQueueTicketLifetime(),
+		MaxInFlight:  config.GetQueueMaxRequestsPerTicket(),
+		MaxPerIP:     config.GetQueueMaxTicketsPerIP(),
+	})
+	h.SetWaitingRoom(concurrentLimiter.Room())
+
+	// Limits, whitelists and provider settings are re-read on SIGHUP
+	config.OnReload(func(old, updated *config.Config) {
+		if !concurrentLimiter.Resize(config.GetMaxConcurrentRequests(), waitingroom.Options{
+			WaitTimeout:  config.GetQueueWaitTimeout(),
+			AdmitTimeout: config.GetQueueAdmitTimeout(),
+			Lifetime:     config.GetQueueTicketLifetime(),
+			MaxInFlight:  config.GetQueueMaxRequestsPerTicket(),
+			MaxPerIP:     config.GetQueueMaxTicketsPerIP(),
+		}) {
+			slog.Warn("Enabling or disabling the concurrent request limit requires a restart")
+		}
+		h.Reload()
+		// Rebuilding the provider chain is only worth it when geoip changed
+		if !reflect.DeepEqual(old.GeoIP, updated.GeoIP) {
+			h.ReloadIPService()
+		}
+		if err := logging.Setup(config.GetLogSettings()); err != nil {
+			slog.Warn("Failed to apply log settings", "error", err)
+		}
+		if sections := config.RestartRequired(old, updated); len(sections) > 0 {
+			slog.Warn("Changes take effect after a restart", "sections", strings.Join(sections, ", "))
+		}
+	})
 
 	// Apply global middleware (but skip for WebSocket)
+	r.Use(resolver.Middleware)
+	r.Use(tracing.Middleware)
+	r.Use(middleware.RequestID)
 	r.Use(middleware.Logging)
 	r.Use(middleware.Security)
 	r.Use(middleware.CORS)
 
+	// The single-family hosts of dual-stack tests only accept their own family
+	ipv4Host, ipv6Host := config.GetDualStackHosts()
+	if ipv4Host != "" {
+		r.Use(familyGuard(ipv4Host, ipv6Host))
+	}
+
 	// Create a subrouter for non-WebSocket endpoints with concurrent limiting
 	api := r.PathPrefix("/").Subrouter()
 	api.Use(concurrentLimiter.Middleware)
 
-	// Apply rate limiting if database is available (to non-WebSocket endpoints)
+	// Apply rate limiting if database is available (to non-WebSocket endpoints),
+	// after authentication so API requests are counted per verified key
 	if authService != nil {
-		api.Use(authService.RateLimit)
 		api.Use(authService.APIKeyAuth)
+		api.Use(authService.RateLimit)
 	}
 
-	// Public speed test endpoints (with concurrent limiting)
-	api.HandleFunc("/ping", h.Ping).Methods("GET", "OPTIONS")
-	api.HandleFunc("/download", h.Download).Methods("GET", "OPTIONS")
-	api.HandleFunc("/upload", h.Upload).Methods("POST", "OPTIONS")
+	// Public speed test endpoints (with concurrent limiting); their responses
+	// advertise HTTP/3 to TLS clients with Alt-Svc when it is enabled
+	testRoutes := []struct {
+		path    string
+		method  string
+		handler http.HandlerFunc
+	}{
+		{"/ping", "GET", h.Ping},
+		{"/download", "GET", h.Download},
+		{"/upload", "POST", h.Upload},
+	}
+	certFile, keyFile := config.GetTLSFiles()
+	http3Port := 0
+	if certFile != "" {
+		http3Port = config.GetHTTP3Port()
+	}
+	for _, route := range testRoutes {
+		var handler http.Handler = route.handler
+		if http3Port > 0 {
+			handler = altSvc(http3Port)(handler)
+		}
+		api.Handle(route.path, handler).Methods(route.method, "OPTIONS")
+	}
 
-	// WebSocket endpoint (without concurrent limiting to avoid hijacker issues)
+	// WebSocket endpoints (without concurrent limiting to avoid hijacker issues)
 	r.HandleFunc("/ws", h.WebSocket).Methods("GET", "OPTIONS")
+	r.HandleFunc("/download/progress/{id}/ws", h.WatchDownloadProgress).Methods("GET", "OPTIONS")
+
+	// Admin live feed (long-lived, so without concurrent limiting)
+	r.HandleFunc("/admin/api/live", h.AdminLive).Methods("GET")
+
+	// Waiting room endpoints (without concurrent limiting so busy clients can queue)
+	r.HandleFunc("/queue/tickets", h.JoinQueue).Methods("POST", "OPTIONS")
+	r.HandleFunc("/queue/tickets/{id}", h.GetQueueTicket).Methods("GET", "OPTIONS")
+	r.HandleFunc("/queue/tickets/{id}", h.LeaveQueue).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/queue/tickets/{id}/ws", h.WatchQueueTicket).Methods("GET", "OPTIONS")
 
 	// Public information endpoints (with concurrent limiting)
 	api.HandleFunc("/ip", h.IP).Methods("GET", "OPTIONS")
@@ -93,6 +200,13 @@ func New() *Server {
 	admin.HandleFunc("/api/stats", h.AdminStats).Methods("GET")
 	admin.HandleFunc("/api/recent-tests", h.AdminRecentTests).Methods("GET")
 	admin.HandleFunc("/api/system", h.AdminSystemInfo).Methods("GET")
+	admin.HandleFunc("/api/ip-cache", h.AdminIPCacheStats).Methods("GET")
+	admin.HandleFunc("/api/ip-providers", h.AdminIPProviders).Methods("GET")
+	admin.HandleFunc("/api/throttles", h.AdminThrottles).Methods("GET")
+	admin.HandleFunc("/api/throttles", h.AdminSetThrottle).Methods("PUT", "POST")
+	admin.HandleFunc("/api/throttles", h.AdminDeleteThrottle).Methods("DELETE")
+	admin.HandleFunc("/api/traces", h.AdminTraces).Methods("GET")
+	admin.HandleFunc("/api/traces/{id}", h.AdminTestTrace).Methods("GET")
 
 	// API endpoints (require authentication if database is available)
 	if db != nil {
@@ -101,85 +215,149 @@ func New() *Server {
 		apiAuth.HandleFunc("/tests", h.CreateSpeedTest).Methods("POST")
 		apiAuth.HandleFunc("/tests/{id}", h.GetSpeedTest).Methods("GET")
 	} // Swagger documentation endpoint
-	docs.SwaggerInfo.Title = "Krea Speed Test API"
-	docs.SwaggerInfo.Description = "A comprehensive speed test API with IP geolocation, rate limiting, and Ookla compatibility"
+	identity := config.GetServerIdentity()
+	docs.SwaggerInfo.Title = identity.Name + " API"
+	docs.SwaggerInfo.Description = fmt.Sprintf("A comprehensive speed test API with IP geolocation, rate limiting, and Ookla compatibility, operated by %s (%s, %s)",
+		identity.Sponsor, identity.City, identity.Country)
 	docs.SwaggerInfo.Version = config.Version
 
-	// Set host from environment or use default
-	swaggerHost := os.Getenv("SWAGGER_HOST")
-	if swaggerHost == "" {
-		swaggerHost = "localhost:8080"
-	}
-	docs.SwaggerInfo.Host = swaggerHost
+	docs.SwaggerInfo.Host = config.GetSwaggerHost()
 	docs.SwaggerInfo.BasePath = "/"
 	docs.SwaggerInfo.Schemes = []string{"http", "https"}
 	r.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
 
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = config.DefaultPort
-	}
-
-	// Create HTTP server
+	// Create HTTP server. The timeouts are strict for API routes; /download
+	// and /upload extend their own deadlines from the requested transfer size.
+	readTimeout, writeTimeout, idleTimeout := config.GetServerTimeouts()
 	httpServer := &http.Server{
-		Addr:         ":" + port,
+		Addr:         fmt.Sprintf(":%d", config.GetListenPort()),
 		Handler:      r,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+
+	srv := &Server{
+		httpServer:  httpServer,
+		handlers:    h,
+		db:          db,
+		resolver:    resolver,
+		ipv4Host:    ipv4Host,
+		ipv6Host:    ipv6Host,
+		stopTracing: stopTracing,
 	}
 
-	return &Server{
-		httpServer: httpServer,
-		handlers:   h,
-		db:         db,
+	// Serve HTTPS (with HTTP/2) directly when a certificate is configured
+	if certFile != "" {
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			fatal("Invalid TLS configuration", "error", err)
+		}
+		srv.certs = certs
+		httpServer.TLSConfig = newTLSConfig(certs, config.GetTLSMinVersion())
+
+		if redirectPort := config.GetHTTPRedirectPort(); redirectPort > 0 {
+			srv.redirectServer = &http.Server{
+				Addr:         fmt.Sprintf(":%d", redirectPort),
+				Handler:      redirectHandler(config.GetListenPort()),
+				ReadTimeout:  10 * time.Second,
+				WriteTimeout: 10 * time.Second,
+			}
+		}
+
+		if http3Port > 0 {
+			// Alt-Svc applies to the whole origin, so clients that switch to
+			// QUIC send every later request there; serve the full router
+			srv.http3Server = newHTTP3Server(http3Port, httpServer.TLSConfig, r)
+		}
 	}
+
+	return srv
 }
 
 // Start starts the HTTP server and handles graceful shutdown
 func (s *Server) Start() error {
 	// Start server in a goroutine
 	go func() {
-		log.Printf("Speed Test Server starting on port %s", s.httpServer.Addr)
-		log.Printf("Version: %s", config.Version)
+		slog.Info("Speed Test Server starting", "addr", s.httpServer.Addr)
+		slog.Info("Version", "version", config.Version)
 		maxConcurrent := config.GetMaxConcurrentRequests()
 		if maxConcurrent == 0 {
-			log.Printf("Max concurrent requests: unlimited")
+			slog.Info("Max concurrent requests: unlimited")
 		} else {
-			log.Printf("Max concurrent requests: %d", maxConcurrent)
-		}
-		log.Printf("Available endpoints:")
-		log.Printf("  GET  /ping      - Latency measurement")
-		log.Printf("  GET  /download  - Download speed test")
-		log.Printf("  POST /upload    - Upload speed test")
-		log.Printf("  GET  /ws        - WebSocket for jitter measurement")
-		log.Printf("  GET  /ip        - IP geolocation information")
-		log.Printf("  GET  /healthz   - Health check")
-		log.Printf("  GET  /version   - Application version")
-		log.Printf("  GET  /config    - Server configuration")
-		log.Printf("  GET  /speedtest.html - Main speed test interface")
-		log.Printf("  GET  /new       - Modern speed test interface")
-		log.Printf("  GET  /result/{id} - Ookla-compatible speed test results")
+			slog.Info("Max concurrent requests (waiting room enabled)", "max", maxConcurrent)
+		}
+		slog.Info("Available endpoints:")
+		slog.Info("  GET  /ping      - Latency measurement")
+		slog.Info("  GET  /download  - Download speed test (?rate=MBPS to throttle)")
+		slog.Info("  POST /upload    - Upload speed test (?rate=MBPS to throttle)")
+		slog.Info("  GET  /ws        - WebSocket for jitter measurement")
+		slog.Info("  GET  /download/progress/{id}/ws - Server-side progress of a download")
+		if maxConcurrent > 0 {
+			slog.Info("  POST /queue/tickets - Join the waiting room when the server is busy")
+		}
+		slog.Info("  GET  /ip        - IP geolocation information")
+		slog.Info("  GET  /healthz   - Health check")
+		slog.Info("  GET  /version   - Application version")
+		slog.Info("  GET  /config    - Server configuration")
+		slog.Info("  GET  /speedtest.html - Main speed test interface")
+		slog.Info("  GET  /new       - Modern speed test interface")
+		slog.Info("  GET  /result/{id} - Ookla-compatible speed test results")
+		slog.Info("  GET  /admin/api/live - Live test activity (Server-Sent Events, admin key)")
 
 		if s.db != nil {
-			log.Printf("API endpoints (require authentication):")
-			log.Printf("  GET  /api/tests    - List all speed tests")
-			log.Printf("  POST /api/tests    - Create speed test")
-			log.Printf("  GET  /api/tests/{id} - Get specific speed test")
+			slog.Info("API endpoints (require authentication):")
+			slog.Info("  GET  /api/tests    - List all speed tests")
+			slog.Info("  POST /api/tests    - Create speed test")
+			slog.Info("  GET  /api/tests/{id} - Get specific speed test")
+		}
+
+		if s.ipv4Host != "" {
+			slog.Info("Dual-stack tests enabled", "ipv4_host", s.ipv4Host, "ipv6_host", s.ipv6Host)
+		}
+
+		listener, err := net.Listen("tcp", s.httpServer.Addr)
+		if err != nil {
+			fatal("Failed to start server", "error", err)
+		}
+		if config.GetProxyProtocolEnabled() {
+			slog.Info("PROXY protocol enabled for trusted proxies")
+			listener = clientip.NewProxyListener(listener, s.resolver)
 		}
 
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
+		if s.certs != nil {
+			slog.Info("TLS enabled (HTTP/2)", "min_version", config.GetTLSMinVersion())
+			err = s.httpServer.ServeTLS(listener, "", "")
+		} else {
+			err = s.httpServer.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("Failed to start server", "error", err)
 		}
 	}()
 
+	if s.http3Server != nil {
+		go func() {
+			slog.Info("HTTP/3 enabled", "udp_addr", s.http3Server.Addr)
+			if err := s.http3Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("Failed to start HTTP/3 listener", "error", err)
+			}
+		}()
+	}
+
+	if s.redirectServer != nil {
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "addr", s.redirectServer.Addr)
+			if err := s.redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("Failed to start HTTP redirect listener", "error", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	waitForShutdown()
 
-	log.Println("Shutting down server...")
+	slog.Info("Shutting down server...")
 
 	// Create a deadline to wait for
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -187,16 +365,62 @@ func (s *Server) Start() error {
 
 	// Attempt graceful shutdown
 	if err := s.httpServer.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown: %v", err)
+		slog.Error("Server forced to shutdown", "error", err)
 	}
+	if s.redirectServer != nil {
+		s.redirectServer.Shutdown(ctx)
+	}
+	if s.http3Server != nil {
+		s.http3Server.Shutdown(ctx)
+	}
+	if s.certs != nil {
+		s.certs.close()
+	}
+
+	// Finish background work before the database goes away
+	s.handlers.Close()
 
 	// Close database connection
 	if s.db != nil {
 		if err := s.db.Close(); err != nil {
-			log.Printf("Error closing database: %v", err)
+			slog.Error("Error closing database", "error", err)
 		}
 	}
 
-	log.Println("Server exited")
+	if err := s.stopTracing(ctx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+
+	slog.Info("Server exited")
 	return nil
 }
+
+// fatal logs msg as an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM, reloading the
+// configuration on each SIGHUP meanwhile
+func waitForShutdown() {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-reload:
+			if _, err := config.Reload(); err != nil {
+				slog.Error("Configuration reload rejected, keeping current settings", "error", err)
+				continue
+			}
+			slog.Info("Configuration reloaded")
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/clientip"
+	"github.com/Krea-University/speed-test-server/internal/filewatch"
+)
+
+// certReloadInterval is how often the certificate files are checked for changes
+const certReloadInterval = 30 * time.Second
+
+// certReloader serves a certificate pair that is reloaded when either file
+// changes on disk, so renewals (e.g. by certbot) apply without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	watcher *filewatch.Watcher
+}
+
+// newCertReloader loads the certificate pair and starts watching it
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	watcher, err := filewatch.New("TLS certificate", certReloadInterval, c.reload, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.watcher = watcher
+
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// reload loads the pair and swaps it in if it is valid
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+
+	expiry := "unknown expiry"
+	if cert.Leaf != nil {
+		expiry = "expires " + cert.Leaf.NotAfter.UTC().Format("2006-01-02")
+	}
+	slog.Info("Loaded TLS certificate", "file", c.certFile, "expiry", expiry)
+	return nil
+}
+
+// close stops the watcher
+func (c *certReloader) close() {
+	c.watcher.Close()
+}
+
+// newTLSConfig builds the listener TLS configuration. HTTP/2 is negotiated
+// via ALPN by http.Server.ServeTLS.
+func newTLSConfig(certs *certReloader, minVersion string) *tls.Config {
+	version := uint16(tls.VersionTLS12)
+	if minVersion == "1.3" {
+		version = tls.VersionTLS13
+	}
+
+	return &tls.Config{
+		MinVersion:     version,
+		GetCertificate: certs.GetCertificate,
+	}
+}
+
+// redirectHandler sends plain HTTP requests to the same path over HTTPS on httpsPort
+func redirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := clientip.Hostname(r)
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
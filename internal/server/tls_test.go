@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for localhost with the given common name
+func writeTestCert(t *testing.T, dir, commonName string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestCertReloaderServesHTTP2AndReloads(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "first")
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certs.close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tls.VersionName(r.TLS.Version)))
+		}),
+		TLSConfig: newTLSConfig(certs, "1.2"),
+	}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	get := func() *http.Response {
+		t.Helper()
+		resp, err := client.Get("https://" + listener.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+	if name := resp.TLS.PeerCertificates[0].Subject.CommonName; name != "first" {
+		t.Errorf("unexpected certificate %q", name)
+	}
+
+	// A renewed certificate is served to new connections after a reload
+	writeTestCert(t, dir, "second")
+	if err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	client.CloseIdleConnections()
+	if name := get().TLS.PeerCertificates[0].Subject.CommonName; name != "second" {
+		t.Errorf("certificate not reloaded, got %q", name)
+	}
+
+	// A broken pair is rejected and the previous certificate kept
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	if err := certs.reload(); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+	if cert, _ := certs.GetCertificate(nil); cert.Leaf.Subject.CommonName != "second" {
+		t.Errorf("previous certificate dropped, got %q", cert.Leaf.Subject.CommonName)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		host      string
+		httpsPort int
+		want      string
+	}{
+		{"speed.example.edu", 443, "https://speed.example.edu/download?size=10"},
+		{"speed.example.edu:80", 8443, "https://speed.example.edu:8443/download?size=10"},
+		{"[2001:db8::1]:80", 443, "https://[2001:db8::1]/download?size=10"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://"+tt.host+"/download?size=10", nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		redirectHandler(tt.httpsPort).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tt.want {
+			t.Errorf("%s: got %d %s, want %s", tt.host, rec.Code, rec.Header().Get("Location"), tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package throughput samples the progress of a transfer at fixed intervals
+// and derives a stable throughput figure that leaves out TCP ramp-up
+package throughput
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+// DefaultInterval is the sampling interval of test transfers
+const DefaultInterval = 100 * time.Millisecond
+
+// rampUpThreshold is the fraction of the median interval throughput a sample
+// must reach before the transfer counts as past ramp-up
+const rampUpThreshold = 0.9
+
+// Sampler counts transferred bytes and records them once per interval
+type Sampler struct {
+	interval time.Duration
+	onSample func(types.ThroughputSample)
+	total    atomic.Int64
+
+	mu       sync.Mutex
+	start    time.Time
+	last     int64         // Total at the end of the previous sample
+	lastAt   time.Duration // Elapsed time at the end of the previous sample
+	samples  []types.ThroughputSample
+	stop     chan struct{}
+	done     chan struct{}
+	finished bool
+}
+
+// NewSampler creates a sampler; onSample, if set, is called with each sample
+// as it is taken
+func NewSampler(interval time.Duration, onSample func(types.ThroughputSample)) *Sampler {
+	return &Sampler{
+		interval: interval,
+		onSample: onSample,
+		samples:  []types.ThroughputSample{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins sampling
+func (s *Sampler) Start() {
+	s.mu.Lock()
+	s.start = time.Now()
+	s.mu.Unlock()
+
+	go s.run()
+}
+
+// Add counts n transferred bytes; a nil sampler ignores them
+func (s *Sampler) Add(n int) {
+	if s != nil && n > 0 {
+		s.total.Add(int64(n))
+	}
+}
+
+// Total returns the bytes counted so far
+func (s *Sampler) Total() int64 {
+	return s.total.Load()
+}
+
+// Stop ends sampling, records the final partial interval and returns all samples
+func (s *Sampler) Stop() []types.ThroughputSample {
+	s.mu.Lock()
+	if !s.finished {
+		s.finished = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.samples
+}
+
+// run takes a sample every interval until stopped
+func (s *Sampler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sample(now, false)
+		case <-s.stop:
+			s.sample(time.Now(), true)
+			return
+		}
+	}
+}
+
+// sample records the bytes transferred since the previous sample. The final
+// sample is skipped if nothing happened since the last full interval.
+func (s *Sampler) sample(now time.Time, final bool) {
+	total := s.total.Load()
+
+	s.mu.Lock()
+	bytes := total - s.last
+	elapsed := now.Sub(s.start)
+	if final && bytes == 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	sample := types.ThroughputSample{
+		ElapsedMs: elapsed.Milliseconds(),
+		Bytes:     bytes,
+		Mbps:      mbps(bytes, elapsed-s.lastAt),
+	}
+	s.last, s.lastAt = total, elapsed
+	s.samples = append(s.samples, sample)
+	s.mu.Unlock()
+
+	if s.onSample != nil {
+		s.onSample(sample)
+	}
+}
+
+// Stable returns the throughput in Mbps after ramp-up: leading samples are
+// dropped until one reaches 90% of the median sample throughput (at most half
+// of them), and the rate is taken over the rest. Transfers too short to
+// sample are measured end to end.
+func Stable(samples []types.ThroughputSample) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	var total int64
+	for _, sample := range samples {
+		total += sample.Bytes
+	}
+	end := time.Duration(samples[len(samples)-1].ElapsedMs) * time.Millisecond
+	if len(samples) < 3 {
+		return mbps(total, end)
+	}
+
+	rates := make([]float64, len(samples))
+	for i, sample := range samples {
+		rates[i] = sample.Mbps
+	}
+	sort.Float64s(rates)
+	median := rates[len(rates)/2]
+
+	skip := 0
+	for skip < len(samples)/2 && samples[skip].Mbps < rampUpThreshold*median {
+		total -= samples[skip].Bytes
+		skip++
+	}
+	if skip == 0 {
+		return mbps(total, end)
+	}
+
+	start := time.Duration(samples[skip-1].ElapsedMs) * time.Millisecond
+	return mbps(total, end-start)
+}
+
+// mbps converts bytes over a duration to megabits per second
+func mbps(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / d.Seconds() / 1e6
+}
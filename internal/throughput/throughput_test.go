@@ -0,0 +1,74 @@
+package throughput
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Krea-University/speed-test-server/internal/types"
+)
+
+// series builds 100ms samples with the given per-interval throughput in Mbps
+func series(rates ...float64) []types.ThroughputSample {
+	samples := make([]types.ThroughputSample, len(rates))
+	for i, rate := range rates {
+		samples[i] = types.ThroughputSample{
+			ElapsedMs: int64(i+1) * 100,
+			Bytes:     int64(rate * 1e6 / 8 / 10),
+			Mbps:      rate,
+		}
+	}
+	return samples
+}
+
+func TestStable(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []types.ThroughputSample
+		want    float64
+	}{
+		{"empty", nil, 0},
+		{"too short to sample", series(20, 40), 30},
+		{"steady", series(100, 100, 100, 100), 100},
+		{"ramp-up discarded", series(10, 40, 95, 100, 100, 100), 98.75},
+		{"at most half discarded", series(1, 2, 3, 100, 100), 67.67},
+	}
+
+	for _, tt := range tests {
+		if got := Stable(tt.samples); math.Abs(got-tt.want) > 0.01 {
+			t.Errorf("%s: got %.2f, want %.2f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSampler(t *testing.T) {
+	var live []types.ThroughputSample
+	sampler := NewSampler(20*time.Millisecond, func(sample types.ThroughputSample) {
+		live = append(live, sample)
+	})
+	sampler.Start()
+
+	for i := 0; i < 5; i++ {
+		sampler.Add(1000)
+		time.Sleep(25 * time.Millisecond)
+	}
+	sampler.Add(500)
+	samples := sampler.Stop()
+
+	var total int64
+	for i, sample := range samples {
+		total += sample.Bytes
+		if i > 0 && sample.ElapsedMs < samples[i-1].ElapsedMs {
+			t.Errorf("samples out of order: %+v", samples)
+		}
+	}
+	if total != 5500 || sampler.Total() != 5500 {
+		t.Errorf("samples add up to %d bytes, want 5500", total)
+	}
+	if len(live) != len(samples) {
+		t.Errorf("callback saw %d samples, Stop returned %d", len(live), len(samples))
+	}
+	if last := samples[len(samples)-1]; last.Bytes == 0 {
+		t.Errorf("final partial interval not recorded: %+v", last)
+	}
+}
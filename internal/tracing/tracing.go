@@ -0,0 +1,113 @@
+// Package tracing sets up OpenTelemetry tracing: spans for incoming
+// requests, database queries and geolocation lookups, exported over
+// OTLP/HTTP to a collector, with W3C trace context propagated from incoming
+// and to outgoing requests
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Krea-University/speed-test-server/internal/config"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans created by this server
+const instrumentationName = "github.com/Krea-University/speed-test-server"
+
+// tracesPath is where OTLP/HTTP collectors accept spans
+const tracesPath = "/v1/traces"
+
+// Setup installs the global tracer provider exporting to the OTLP/HTTP
+// collector at endpoint, a base URL such as http://localhost:4318 to which
+// /v1/traces is added as for OTEL_EXPORTER_OTLP_ENDPOINT, sampling ratio of
+// new traces. Trace context is
+// propagated even when endpoint is empty and spans are not recorded, so a
+// proxy's trace continues through to outgoing provider requests. The
+// returned function flushes pending spans and stops the exporter.
+func Setup(ctx context.Context, endpoint, serviceName string, ratio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(tracesURL(endpoint)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	resource, err := sdkresource.Merge(sdkresource.Default(), sdkresource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(config.Version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe tracing resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracesURL returns the traces endpoint under a collector base URL
+func tracesURL(endpoint string) string {
+	if strings.HasSuffix(endpoint, tracesPath) {
+		return endpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + tracesPath
+}
+
+// Middleware starts a server span for each request, continuing the trace
+// of the incoming traceparent header. Spans are named after the matched
+// route template, e.g. "GET /api/tests/{id}".
+func Middleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.server", otelhttp.WithSpanNameFormatter(spanName))
+}
+
+// spanName names a server span after the request's route
+func spanName(_ string, r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return r.Method + " " + template
+		}
+	}
+	return r.Method + " " + r.URL.Path
+}
+
+// Transport wraps base (http.DefaultTransport if nil) so outgoing requests
+// get client spans and carry the trace context
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
+
+// Start starts a span named name as a child of the span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Fail records err on span and marks it failed; a nil err is ignored
+func Fail(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
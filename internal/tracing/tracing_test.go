@@ -0,0 +1,144 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector stands in for an OTLP/HTTP collector, keeping the spans it receives
+type collector struct {
+	mu       sync.Mutex
+	paths    []string
+	services []string
+	spans    []*tracepb.Span
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, r.URL.Path)
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, attr := range resourceSpans.Resource.GetAttributes() {
+			if attr.Key == "service.name" {
+				c.services = append(c.services, attr.Value.GetStringValue())
+			}
+		}
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			c.spans = append(c.spans, scopeSpans.Spans...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+}
+
+func (c *collector) span(name string) *tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestExportsRequestSpans(t *testing.T) {
+	received := &collector{}
+	collectorServer := httptest.NewServer(received)
+	defer collectorServer.Close()
+
+	// A geolocation provider, checking the trace continues to it
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+
+	shutdown, err := Setup(context.Background(), collectorServer.URL, "speed-test-server-test", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: Transport(nil)}
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/api/tests/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "db speed_tests.select")
+		span.End()
+
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, upstream.URL, nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	})
+
+	// The caller's sampled trace is recorded even though new traces aren't
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/api/tests/abc", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	server := received.span("GET /api/tests/{id}")
+	if server == nil {
+		t.Fatalf("no server span among %d exported to %v", len(received.spans), received.paths)
+	}
+	if got := hex.EncodeToString(server.TraceId); got != traceID {
+		t.Errorf("server span trace %s, expected the incoming %s", got, traceID)
+	}
+	if got := hex.EncodeToString(server.ParentSpanId); got != "00f067aa0ba902b7" {
+		t.Errorf("server span parent %s, expected the incoming span", got)
+	}
+
+	query := received.span("db speed_tests.select")
+	if query == nil || hex.EncodeToString(query.ParentSpanId) != hex.EncodeToString(server.SpanId) {
+		t.Errorf("expected the query span to be a child of the server span, got %v", query)
+	}
+	if !strings.Contains(upstreamTraceparent, traceID) {
+		t.Errorf("outgoing request carried traceparent %q, expected trace %s", upstreamTraceparent, traceID)
+	}
+
+	if len(received.paths) == 0 || received.paths[0] != "/v1/traces" {
+		t.Errorf("spans exported to %v, expected /v1/traces", received.paths)
+	}
+	if len(received.services) == 0 || received.services[0] != "speed-test-server-test" {
+		t.Errorf("unexpected service names %v", received.services)
+	}
+}
+
+func TestTracesURL(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"http://localhost:4318":           "http://localhost:4318/v1/traces",
+		"http://localhost:4318/":          "http://localhost:4318/v1/traces",
+		"https://otel.example.edu/otlp":   "https://otel.example.edu/otlp/v1/traces",
+		"http://localhost:4318/v1/traces": "http://localhost:4318/v1/traces",
+	} {
+		if got := tracesURL(endpoint); got != want {
+			t.Errorf("tracesURL(%q) = %q, expected %q", endpoint, got, want)
+		}
+	}
+}
@@ -3,9 +3,40 @@ package types
 
 // Config represents the server configuration that can be shared with clients
 type Config struct {
-	DefaultDownloadSize int    `json:"default_download_size"` // Default download size in bytes
-	Version             string `json:"version"`               // Application version
-	MaxUploadSize       int    `json:"max_upload_size"`       // Maximum upload size in bytes
+	DefaultDownloadSize int              `json:"default_download_size"` // Default download size in bytes
+	Version             string           `json:"version"`               // Application version
+	MaxUploadSize       int              `json:"max_upload_size"`       // Maximum upload size in bytes
+	Admission           *AdmissionStatus `json:"admission,omitempty"`   // Bandwidth admission state, if enabled
+	Server              *ServerInfo      `json:"server,omitempty"`      // Identity of this server
+	DualStack           *DualStackInfo   `json:"dual_stack,omitempty"`  // Single-family endpoints, if dual-stack tests are enabled
+}
+
+// DualStackInfo gives the base URLs that only resolve to one address family,
+// so clients can measure IPv4 and IPv6 paths separately
+type DualStackInfo struct {
+	IPv4URL string `json:"ipv4_url"` // Base URL reachable only over IPv4
+	IPv6URL string `json:"ipv6_url"` // Base URL reachable only over IPv6
+}
+
+// ServerInfo describes the server and the organization running it
+type ServerInfo struct {
+	Name     string `json:"name"`               // Server display name
+	Sponsor  string `json:"sponsor"`            // Operating organization
+	Country  string `json:"country"`            // ISO country code
+	City     string `json:"city"`               // Server city
+	Location string `json:"location,omitempty"` // Coordinates (lat,lng)
+	BaseURL  string `json:"base_url"`           // Public base URL
+}
+
+// AdmissionStatus reports bandwidth-aware admission control state
+type AdmissionStatus struct {
+	CapacityMbps   float64 `json:"capacity_mbps"`    // Configured uplink capacity
+	ThroughputMbps float64 `json:"throughput_mbps"`  // Aggregate live throughput of running tests
+	ActiveTests    int     `json:"active_tests"`     // Tests currently transferring
+	MaxActiveTests int     `json:"max_active_tests"` // Concurrent test cap derived from per-test reservation
+	QueueLength    int     `json:"queue_length"`     // Tests waiting for bandwidth
+	MaxQueueLength int     `json:"max_queue_length"` // Maximum waiting tests before rejection
+	Saturated      bool    `json:"saturated"`        // Whether new tests are currently queued
 }
 
 // PingResponse represents the response from the ping endpoint
@@ -25,11 +56,30 @@ type IPResponse struct {
 	Postal   string `json:"postal,omitempty"`   // Postal/ZIP code
 	Timezone string `json:"timezone,omitempty"` // Timezone
 	Source   string `json:"source,omitempty"`   // Data source (ipinfo, ip-api, etc.)
+
+	ASNNumber uint32            `json:"asn_number,omitempty"` // Numeric AS number parsed from ASN
+	ASNOrg    string            `json:"asn_org,omitempty"`    // AS organization name
+	Sources   map[string]string `json:"sources,omitempty"`    // Provider of each field when results are merged
+
+	NetworkType string `json:"network_type,omitempty"` // public, private, cgnat, loopback, link_local or unique_local
+	NetworkName string `json:"network_name,omitempty"` // Campus network name, if the address is in a labelled subnet
+	Building    string `json:"building,omitempty"`     // Campus building or area of the subnet
 }
 
 // UploadResponse represents the response from the upload endpoint
 type UploadResponse struct {
-	BytesReceived int64 `json:"bytes_received"` // Total bytes received
+	BytesReceived    int64              `json:"bytes_received"`     // Total bytes received
+	DurationMs       int64              `json:"duration_ms"`        // Time spent receiving the body
+	SampleIntervalMs int64              `json:"sample_interval_ms"` // Spacing of the samples
+	Samples          []ThroughputSample `json:"samples"`            // Bytes received per interval
+	ThroughputMbps   float64            `json:"throughput_mbps"`    // Stable throughput, excluding ramp-up
+}
+
+// ThroughputSample is the progress of a transfer over one sampling interval
+type ThroughputSample struct {
+	ElapsedMs int64   `json:"elapsed_ms"` // Time from the start of the transfer to the end of the interval
+	Bytes     int64   `json:"bytes"`      // Bytes transferred during the interval
+	Mbps      float64 `json:"mbps"`       // Throughput during the interval
 }
 
 // HealthResponse represents the health check response
@@ -43,3 +93,45 @@ type WebSocketResponse struct {
 	Timestamp int64  `json:"timestamp"` // Server timestamp in nanoseconds
 	Echo      string `json:"echo"`      // Echoed message from client
 }
+
+// DownloadProgressMessage is streamed to watchers of a download's progress
+type DownloadProgressMessage struct {
+	Type    string            `json:"type"`              // "sample" or "done"
+	Sample  *ThroughputSample `json:"sample,omitempty"`  // Bytes written to the connection in one interval
+	Summary *DownloadSummary  `json:"summary,omitempty"` // Set on the final "done" message
+}
+
+// DownloadSummary is the server's view of a finished download
+type DownloadSummary struct {
+	Size           int64   `json:"size"`            // Requested payload size
+	BytesWritten   int64   `json:"bytes_written"`   // Bytes written to the connection, including chunk headers
+	DurationMs     int64   `json:"duration_ms"`     // Time spent writing
+	ThroughputMbps float64 `json:"throughput_mbps"` // Stable throughput, excluding ramp-up
+	Truncated      bool    `json:"truncated"`       // The download stopped before the full payload was sent
+}
+
+// TransferProgress is a test transfer's progress on the admin live feed
+type TransferProgress struct {
+	ElapsedMs        int64   `json:"elapsed_ms"`        // Time since the transfer started
+	BytesTransferred int64   `json:"bytes_transferred"` // Bytes moved so far
+	Mbps             float64 `json:"mbps"`              // Throughput since the previous progress event
+}
+
+// UploadSummary describes a finished upload on the admin live feed
+type UploadSummary struct {
+	BytesReceived  int64   `json:"bytes_received"`  // Bytes read from the request body
+	DurationMs     int64   `json:"duration_ms"`     // Time spent reading
+	ThroughputMbps float64 `json:"throughput_mbps"` // Stable throughput, excluding ramp-up
+	Failed         bool    `json:"failed"`          // Reading the body failed or it exceeded the size limit
+}
+
+// QueueTicketResponse represents a waiting room ticket
+type QueueTicketResponse struct {
+	TicketID    string `json:"ticket_id"`           // Ticket to send as X-Queue-Ticket once admitted
+	Status      string `json:"status"`              // "waiting" or "admitted"
+	Position    int    `json:"position,omitempty"`  // 1-based queue position while waiting
+	QueueLength int    `json:"queue_length"`        // Total tickets waiting
+	ExpiresAt   string `json:"expires_at"`          // When the ticket lapses unless polled (waiting) or used (admitted)
+	PollURL     string `json:"poll_url"`            // Endpoint to poll for status
+	WatchURL    string `json:"watch_url,omitempty"` // WebSocket endpoint streaming status updates
+}
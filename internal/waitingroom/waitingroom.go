@@ -0,0 +1,392 @@
+// Package waitingroom implements a ticketed waiting room in front of the
+// concurrent request limiter, admitting clients FIFO with per-IP fairness
+package waitingroom
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Ticket states
+const (
+	StatusWaiting  = "waiting"
+	StatusAdmitted = "admitted"
+)
+
+var (
+	// ErrTicketNotFound is returned for unknown or expired tickets
+	ErrTicketNotFound = errors.New("ticket not found or expired")
+
+	// ErrTooManyTickets is returned when an IP already holds its maximum number of tickets
+	ErrTooManyTickets = errors.New("too many tickets for this client")
+)
+
+// Options configures ticket lifetimes and fairness limits
+type Options struct {
+	WaitTimeout  time.Duration // Waiting tickets expire if not polled for this long
+	AdmitTimeout time.Duration // Admitted tickets expire if unused (or idle) for this long
+	Lifetime     time.Duration // Admitted tickets expire this long after admission, even if in use (0 for no limit)
+	MaxInFlight  int           // Concurrent requests one admitted ticket may run (at least 1)
+	MaxPerIP     int           // Maximum live tickets per client IP
+}
+
+// Ticket is a client's place in the waiting room
+type Ticket struct {
+	ID         string
+	ClientIP   string
+	Status     string
+	Position   int // 1-based position while waiting, 0 once admitted
+	CreatedAt  time.Time
+	AdmittedAt time.Time
+	ExpiresAt  time.Time
+
+	lastSeen time.Time
+	inFlight int
+	retired  bool // removed while requests were in flight; the last one frees the slot
+}
+
+// Room owns the server's concurrent request slots. Requests without a ticket
+// only get a slot when nobody is waiting, so queued clients are never overtaken.
+type Room struct {
+	mu      sync.Mutex
+	slots   int
+	inUse   int
+	tickets map[string]*Ticket
+	queues  map[string][]*Ticket // waiting tickets per client IP
+	order   []string             // client IPs in round-robin order
+	changed chan struct{}
+	opts    Options
+}
+
+// New creates a waiting room guarding the given number of slots
+func New(slots int, opts Options) *Room {
+	r := &Room{
+		slots:   slots,
+		tickets: make(map[string]*Ticket),
+		queues:  make(map[string][]*Ticket),
+		changed: make(chan struct{}),
+		opts:    opts,
+	}
+
+	go r.expireTickets()
+
+	return r
+}
+
+// TryAcquire takes a slot for a request without a ticket; it fails if the
+// server is full or clients are already waiting
+func (r *Room) TryAcquire() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.order) > 0 || r.inUse >= r.slots {
+		return false
+	}
+	r.inUse++
+	return true
+}
+
+// Release returns a slot taken with TryAcquire
+func (r *Room) Release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inUse--
+	r.dispatchLocked()
+}
+
+// Join issues a new ticket for clientIP, admitting it immediately if a slot is free
+func (r *Room) Join(clientIP string) (Ticket, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, t := range r.tickets {
+		if t.ClientIP == clientIP {
+			count++
+		}
+	}
+	if r.opts.MaxPerIP > 0 && count >= r.opts.MaxPerIP {
+		return Ticket{}, ErrTooManyTickets
+	}
+
+	now := time.Now()
+	ticket := &Ticket{
+		ID:        uuid.New().String(),
+		ClientIP:  clientIP,
+		Status:    StatusWaiting,
+		CreatedAt: now,
+		lastSeen:  now,
+	}
+	r.tickets[ticket.ID] = ticket
+
+	if _, queued := r.queues[clientIP]; !queued {
+		r.order = append(r.order, clientIP)
+	}
+	r.queues[clientIP] = append(r.queues[clientIP], ticket)
+
+	r.dispatchLocked()
+	r.notifyLocked()
+
+	return r.snapshotLocked(ticket), nil
+}
+
+// Status returns the current state of a ticket and records that its owner is still polling
+func (r *Room) Status(id, clientIP string) (Ticket, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ticket, ok := r.ownedLocked(id, clientIP)
+	if !ok {
+		return Ticket{}, ErrTicketNotFound
+	}
+	if ticket.Status == StatusWaiting {
+		ticket.lastSeen = time.Now()
+	}
+	return r.snapshotLocked(ticket), nil
+}
+
+// Use marks a request from clientIP as running under an admitted ticket. It
+// returns a function to call when the request finishes, or false if the
+// ticket belongs to another client, is not admitted, has outlived its
+// lifetime or already runs as many requests as allowed; such requests need a
+// slot of their own.
+func (r *Room) Use(id, clientIP string) (func(), bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ticket, ok := r.ownedLocked(id, clientIP)
+	if !ok || ticket.Status != StatusAdmitted {
+		return nil, false
+	}
+	now := time.Now()
+	if r.pastLifetimeLocked(ticket, now) || ticket.inFlight >= max(r.opts.MaxInFlight, 1) {
+		return nil, false
+	}
+	ticket.inFlight++
+	ticket.lastSeen = now
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			ticket.inFlight--
+			ticket.lastSeen = time.Now()
+			if ticket.retired && ticket.inFlight == 0 {
+				r.inUse--
+				r.dispatchLocked()
+			}
+		})
+	}, true
+}
+
+// ownedLocked returns the ticket id if it was issued to clientIP. Tickets of
+// other clients are treated as unknown, so a leaked ticket ID can't be spent
+// or cancelled from elsewhere.
+func (r *Room) ownedLocked(id, clientIP string) (*Ticket, bool) {
+	ticket, ok := r.tickets[id]
+	if !ok || ticket.ClientIP != clientIP {
+		return nil, false
+	}
+	return ticket, true
+}
+
+// pastLifetimeLocked reports whether an admitted ticket has been admitted for
+// longer than its lifetime
+func (r *Room) pastLifetimeLocked(ticket *Ticket, now time.Time) bool {
+	return r.opts.Lifetime > 0 && now.Sub(ticket.AdmittedAt) > r.opts.Lifetime
+}
+
+// Leave gives up a ticket of clientIP, freeing its slot or queue position
+func (r *Room) Leave(id, clientIP string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ticket, ok := r.ownedLocked(id, clientIP)
+	if !ok {
+		return ErrTicketNotFound
+	}
+	r.removeLocked(ticket)
+	r.dispatchLocked()
+	r.notifyLocked()
+	return nil
+}
+
+// Changed returns a channel that is closed the next time any ticket changes
+func (r *Room) Changed() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.changed
+}
+
+// Stats returns the number of slots, slots in use and waiting tickets
+func (r *Room) Stats() (slots, inUse, waiting int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, q := range r.queues {
+		waiting += len(q)
+	}
+	return r.slots, r.inUse, waiting
+}
+
+// Reconfigure changes the number of slots and ticket options. Growing admits
+// waiting tickets right away; shrinking lets requests in flight finish.
+func (r *Room) Reconfigure(slots int, opts Options) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.slots = slots
+	r.opts = opts
+	r.dispatchLocked()
+	r.notifyLocked()
+}
+
+// dispatchLocked admits waiting tickets round-robin across client IPs while slots are free
+func (r *Room) dispatchLocked() {
+	dispatched := false
+	for len(r.order) > 0 && r.inUse < r.slots {
+		ip := r.order[0]
+		queue := r.queues[ip]
+		ticket := queue[0]
+
+		r.order = r.order[1:]
+		if len(queue) > 1 {
+			r.queues[ip] = queue[1:]
+			r.order = append(r.order, ip)
+		} else {
+			delete(r.queues, ip)
+		}
+
+		now := time.Now()
+		ticket.Status = StatusAdmitted
+		ticket.AdmittedAt = now
+		ticket.lastSeen = now
+		r.inUse++
+		dispatched = true
+	}
+	if dispatched {
+		r.notifyLocked()
+	}
+}
+
+// positionLocked computes a waiting ticket's 1-based position in dispatch order
+func (r *Room) positionLocked(ticket *Ticket) int {
+	position := 0
+	for round := 0; ; round++ {
+		remaining := false
+		for _, ip := range r.order {
+			queue := r.queues[ip]
+			if round >= len(queue) {
+				continue
+			}
+			remaining = true
+			position++
+			if queue[round] == ticket {
+				return position
+			}
+		}
+		if !remaining {
+			return 0
+		}
+	}
+}
+
+// snapshotLocked returns a copy of the ticket with position and expiry filled in
+func (r *Room) snapshotLocked(ticket *Ticket) Ticket {
+	snapshot := *ticket
+	if ticket.Status == StatusWaiting {
+		snapshot.Position = r.positionLocked(ticket)
+		snapshot.ExpiresAt = ticket.lastSeen.Add(r.opts.WaitTimeout)
+	} else {
+		snapshot.ExpiresAt = ticket.lastSeen.Add(r.opts.AdmitTimeout)
+		if r.opts.Lifetime > 0 {
+			if end := ticket.AdmittedAt.Add(r.opts.Lifetime); end.Before(snapshot.ExpiresAt) {
+				snapshot.ExpiresAt = end
+			}
+		}
+	}
+	return snapshot
+}
+
+// removeLocked deletes a ticket, releasing its slot if it was admitted. The
+// slot of a ticket with requests in flight is released when they finish.
+func (r *Room) removeLocked(ticket *Ticket) {
+	delete(r.tickets, ticket.ID)
+
+	if ticket.Status == StatusAdmitted {
+		if ticket.inFlight > 0 {
+			ticket.retired = true
+		} else {
+			r.inUse--
+		}
+		return
+	}
+
+	queue := r.queues[ticket.ClientIP]
+	for i, t := range queue {
+		if t == ticket {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		r.queues[ticket.ClientIP] = queue
+		return
+	}
+
+	delete(r.queues, ticket.ClientIP)
+	for i, ip := range r.order {
+		if ip == ticket.ClientIP {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// notifyLocked wakes everyone watching for changes
+func (r *Room) notifyLocked() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// expireTickets drops abandoned tickets: waiting tickets nobody polls,
+// admitted tickets that are unused or idle and admitted tickets past their
+// lifetime
+func (r *Room) expireTickets() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.mu.Lock()
+		now := time.Now()
+		expired := false
+		for _, ticket := range r.tickets {
+			timeout := r.opts.WaitTimeout
+			if ticket.Status == StatusAdmitted {
+				if r.pastLifetimeLocked(ticket, now) {
+					r.removeLocked(ticket)
+					expired = true
+					continue
+				}
+				if ticket.inFlight > 0 {
+					continue
+				}
+				timeout = r.opts.AdmitTimeout
+			}
+			if now.Sub(ticket.lastSeen) > timeout {
+				r.removeLocked(ticket)
+				expired = true
+			}
+		}
+		if expired {
+			r.dispatchLocked()
+			r.notifyLocked()
+		}
+		r.mu.Unlock()
+	}
+}
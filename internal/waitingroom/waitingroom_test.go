@@ -0,0 +1,185 @@
+package waitingroom
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRoom(slots int) *Room {
+	return New(slots, Options{WaitTimeout: time.Minute, AdmitTimeout: time.Minute, MaxPerIP: 3})
+}
+
+func TestRoomAdmitsFairlyAcrossIPs(t *testing.T) {
+	room := newTestRoom(1)
+	if !room.TryAcquire() {
+		t.Fatal("expected a free slot")
+	}
+
+	// One client grabs several tickets before another arrives
+	a1, _ := room.Join("10.0.0.1")
+	a2, _ := room.Join("10.0.0.1")
+	b1, _ := room.Join("10.0.0.2")
+
+	if room.TryAcquire() {
+		t.Fatal("ticketless request overtook the queue")
+	}
+
+	positions := map[string]int{}
+	for _, ticket := range []Ticket{a1, a2, b1} {
+		status, err := room.Status(ticket.ID, ticket.ClientIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions[ticket.ID] = status.Position
+	}
+	if positions[a1.ID] != 1 || positions[b1.ID] != 2 || positions[a2.ID] != 3 {
+		t.Errorf("unexpected round-robin positions: a1=%d b1=%d a2=%d",
+			positions[a1.ID], positions[b1.ID], positions[a2.ID])
+	}
+
+	room.Release()
+	if status, _ := room.Status(a1.ID, a1.ClientIP); status.Status != StatusAdmitted {
+		t.Fatalf("first ticket not admitted, got %s", status.Status)
+	}
+
+	// The admitted ticket holds the slot until it is used and given up
+	done, ok := room.Use(a1.ID, a1.ClientIP)
+	if !ok {
+		t.Fatal("admitted ticket rejected")
+	}
+	done()
+	if _, ok := room.Use(b1.ID, b1.ClientIP); ok {
+		t.Fatal("waiting ticket accepted for use")
+	}
+
+	if err := room.Leave(a1.ID, a1.ClientIP); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := room.Status(b1.ID, b1.ClientIP); status.Status != StatusAdmitted {
+		t.Errorf("second client not admitted next, got %s at position %d", status.Status, status.Position)
+	}
+}
+
+func TestRoomLimitsTicketsPerIP(t *testing.T) {
+	room := newTestRoom(0)
+	for i := 0; i < 3; i++ {
+		if _, err := room.Join("10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := room.Join("10.0.0.1"); err != ErrTooManyTickets {
+		t.Errorf("expected ErrTooManyTickets, got %v", err)
+	}
+}
+
+func TestRoomExpiresUnpolledTickets(t *testing.T) {
+	room := New(0, Options{WaitTimeout: 10 * time.Millisecond, AdmitTimeout: time.Minute})
+	ticket, _ := room.Join("10.0.0.1")
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := room.Status(ticket.ID, ticket.ClientIP); err == ErrTicketNotFound {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("waiting ticket did not expire")
+		}
+		// Wait without polling so the ticket lapses
+		time.Sleep(1100 * time.Millisecond)
+	}
+}
+
+func TestRoomReconfigureAdmitsWaiting(t *testing.T) {
+	room := newTestRoom(1)
+	room.TryAcquire()
+	ticket, _ := room.Join("10.0.0.1")
+
+	room.Reconfigure(2, Options{WaitTimeout: time.Minute, AdmitTimeout: time.Minute, MaxPerIP: 1})
+	if status, _ := room.Status(ticket.ID, ticket.ClientIP); status.Status != StatusAdmitted {
+		t.Errorf("ticket not admitted after growing the room, got %s", status.Status)
+	}
+	if _, err := room.Join("10.0.0.1"); err != ErrTooManyTickets {
+		t.Errorf("new per-IP limit not applied, got %v", err)
+	}
+}
+
+func TestRoomLimitsRequestsPerTicket(t *testing.T) {
+	room := New(1, Options{WaitTimeout: time.Minute, AdmitTimeout: time.Minute, MaxInFlight: 2, MaxPerIP: 3})
+	ticket, _ := room.Join("10.0.0.1")
+
+	first, ok := room.Use(ticket.ID, ticket.ClientIP)
+	if !ok {
+		t.Fatal("admitted ticket refused")
+	}
+	if _, ok := room.Use(ticket.ID, ticket.ClientIP); !ok {
+		t.Fatal("second request within the per-ticket limit refused")
+	}
+	if _, ok := room.Use(ticket.ID, ticket.ClientIP); ok {
+		t.Error("third concurrent request allowed on one ticket")
+	}
+
+	first()
+	if _, ok := room.Use(ticket.ID, ticket.ClientIP); !ok {
+		t.Error("request refused after another finished")
+	}
+}
+
+func TestRoomTicketLifetime(t *testing.T) {
+	room := New(1, Options{WaitTimeout: time.Minute, AdmitTimeout: time.Minute, Lifetime: 50 * time.Millisecond, MaxPerIP: 3})
+	ticket, _ := room.Join("10.0.0.1")
+	done, ok := room.Use(ticket.ID, ticket.ClientIP)
+	if !ok {
+		t.Fatal("admitted ticket refused")
+	}
+	waiting, _ := room.Join("10.0.0.2")
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := room.Use(ticket.ID, ticket.ClientIP); ok {
+		t.Error("ticket used past its lifetime")
+	}
+
+	// Expiry drops the ticket, but its slot is held until the request finishes
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, err := room.Status(ticket.ID, ticket.ClientIP); err == ErrTicketNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ticket in use did not expire")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if status, _ := room.Status(waiting.ID, waiting.ClientIP); status.Status != StatusWaiting {
+		t.Fatalf("slot freed while a request was in flight, got %s", status.Status)
+	}
+
+	done()
+	if status, _ := room.Status(waiting.ID, waiting.ClientIP); status.Status != StatusAdmitted {
+		t.Errorf("slot not passed on after the last request finished, got %s", status.Status)
+	}
+}
+
+func TestRoomRejectsTicketsOfOtherClients(t *testing.T) {
+	room := newTestRoom(1)
+	ticket, _ := room.Join("10.0.0.1")
+
+	// A leaked ticket ID is useless from another address
+	if _, err := room.Status(ticket.ID, "10.0.0.2"); err != ErrTicketNotFound {
+		t.Errorf("expected another client's status check to fail, got %v", err)
+	}
+	if _, ok := room.Use(ticket.ID, "10.0.0.2"); ok {
+		t.Error("another client spent the ticket")
+	}
+	if err := room.Leave(ticket.ID, "10.0.0.2"); err != ErrTicketNotFound {
+		t.Errorf("expected another client's leave to fail, got %v", err)
+	}
+
+	done, ok := room.Use(ticket.ID, "10.0.0.1")
+	if !ok {
+		t.Fatal("owner could not use its ticket")
+	}
+	done()
+	if err := room.Leave(ticket.ID, "10.0.0.1"); err != nil {
+		t.Errorf("owner could not leave: %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+-- Migration 005: Shared GCRA rate limiter state for multi-instance deployments
+-- Replaces the per-minute counters in rate_limits, which are no longer written
+
+CREATE TABLE IF NOT EXISTS rate_limit_state (
+    bucket_key VARCHAR(255) NOT NULL PRIMARY KEY, -- identifier|route
+    tat BIGINT NOT NULL,                          -- theoretical arrival time (Unix ns)
+    expires_at TIMESTAMP(3) NOT NULL,
+
+    INDEX idx_rate_limit_state_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,10 @@
+-- Migration 006: Persistent cache for IP geolocation lookups
+
+CREATE TABLE IF NOT EXISTS ip_info_cache (
+    ip VARCHAR(45) NOT NULL PRIMARY KEY,
+    data JSON NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+
+    INDEX idx_ip_info_cache_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
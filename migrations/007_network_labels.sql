@@ -0,0 +1,8 @@
+-- Migration 007: Network classification labels on speed tests
+-- Lets results be charted per campus network (hostel, lab, ...)
+
+ALTER TABLE speed_tests
+    ADD COLUMN network_type VARCHAR(32) DEFAULT NULL AFTER city,
+    ADD COLUMN network_name VARCHAR(255) DEFAULT NULL AFTER network_type,
+    ADD COLUMN building VARCHAR(255) DEFAULT NULL AFTER network_name,
+    ADD INDEX idx_speed_tests_network (network_name, created_at);
@@ -0,0 +1,13 @@
+-- Migration 008: Background enrichment of speed tests
+-- Filled in asynchronously after a test is stored
+
+ALTER TABLE speed_tests
+    ADD COLUMN reverse_dns VARCHAR(255) DEFAULT NULL AFTER building,
+    ADD COLUMN asn_number INT UNSIGNED DEFAULT NULL AFTER reverse_dns,
+    ADD COLUMN asn_org VARCHAR(255) DEFAULT NULL AFTER asn_number,
+    ADD COLUMN ip_version TINYINT UNSIGNED DEFAULT NULL AFTER asn_org,
+    ADD COLUMN enriched_at TIMESTAMP NULL DEFAULT NULL AFTER ip_version,
+    ADD INDEX idx_speed_tests_asn (asn_number, created_at),
+    ADD INDEX idx_speed_tests_ip_version (ip_version, created_at),
+    ADD INDEX idx_speed_tests_reverse_dns (reverse_dns, created_at),
+    ADD INDEX idx_speed_tests_building (building, created_at);
@@ -0,0 +1,6 @@
+-- Migration 009: TLS connection details on speed tests
+-- Recorded when the server terminates TLS itself
+
+ALTER TABLE speed_tests
+    ADD COLUMN tls_version VARCHAR(16) DEFAULT NULL AFTER enriched_at,
+    ADD COLUMN tls_cipher VARCHAR(64) DEFAULT NULL AFTER tls_version;
@@ -0,0 +1,6 @@
+-- Migration 010: HTTP protocol on speed tests
+-- Distinguishes HTTP/1.1, HTTP/2 and HTTP/3 (QUIC) measurements
+
+ALTER TABLE speed_tests
+    ADD COLUMN protocol VARCHAR(16) DEFAULT NULL AFTER enriched_at,
+    ADD INDEX idx_speed_tests_protocol (protocol, created_at);
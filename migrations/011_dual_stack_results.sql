@@ -0,0 +1,14 @@
+-- Migration 011: Dual-stack IPv4/IPv6 comparison results
+-- A dualstack test measures latency and throughput over both families and
+-- records which family the client preferred on the dual-stack host
+
+ALTER TABLE speed_tests
+    MODIFY COLUMN test_type ENUM('download', 'upload', 'ping', 'full', 'dualstack') NOT NULL,
+    ADD COLUMN ipv4_latency_ms DECIMAL(8,2) DEFAULT NULL AFTER protocol,
+    ADD COLUMN ipv4_download_mbps DECIMAL(10,2) DEFAULT NULL AFTER ipv4_latency_ms,
+    ADD COLUMN ipv4_upload_mbps DECIMAL(10,2) DEFAULT NULL AFTER ipv4_download_mbps,
+    ADD COLUMN ipv6_latency_ms DECIMAL(8,2) DEFAULT NULL AFTER ipv4_upload_mbps,
+    ADD COLUMN ipv6_download_mbps DECIMAL(10,2) DEFAULT NULL AFTER ipv6_latency_ms,
+    ADD COLUMN ipv6_upload_mbps DECIMAL(10,2) DEFAULT NULL AFTER ipv6_download_mbps,
+    ADD COLUMN preferred_ip_version TINYINT UNSIGNED DEFAULT NULL AFTER ipv6_upload_mbps,
+    ADD INDEX idx_speed_tests_preferred_ip_version (preferred_ip_version, created_at);
@@ -0,0 +1,7 @@
+-- Migration 012: Test session of speed tests
+-- The X-Test-ID a client named its session with, joining a stored result to
+-- its diagnostics trace. Unique so a retried save is rejected, not duplicated.
+
+ALTER TABLE speed_tests
+    ADD COLUMN session_id VARCHAR(64) DEFAULT NULL AFTER id,
+    ADD UNIQUE INDEX idx_speed_tests_session_id (session_id);